@@ -1,17 +1,114 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"plugin"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	TG "github.com/foroughi/tg-edit/tg"
 )
 
+// Overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type arguments struct {
+	configPath string
+	settings   settingList
+	pluginsDir string
+	logFile    string
+	noPlugins  bool
+	version    bool
+	record     string // Session file to record the keys and resizes to
+	replay     string // Session file to replay on a simulated screen
+	commands   commandList
+	files      []string
+	jump       string // +LINE or +/pattern, applied to the first file
+}
+
+// settingList collects every --set key=value flag, later ones win
+type settingList map[string]string
+
+func (s settingList) String() string {
+	var settings []string
+	for key, value := range s {
+		settings = append(settings, key+"="+value)
+	}
+	return strings.Join(settings, " ")
+}
+
+func (s settingList) Set(value string) error {
+	key, value, found := strings.Cut(value, "=")
+	if !found || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	s[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	return nil
+}
+
+// commandList collects every -c flag in order
+type commandList []string
+
+func (c *commandList) String() string {
+	return strings.Join(*c, "; ")
+}
+
+func (c *commandList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
 func main() {
 
+	args, err := parseArguments(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if args.version {
+		fmt.Printf("tg-edit %s\n", version)
+		return
+	}
+
+	var session *TG.Session
+	if args.replay != "" {
+		session, err = TG.LoadSession(args.replay)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// What the replay's command line leaves out comes from the one the session was recorded with
+		recorded, err := parseArguments(session.Header.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: cannot read the recorded command line %q: %v\n", args.replay, session.Header.Args, err)
+			os.Exit(1)
+		}
+		if len(args.files) == 0 {
+			args.files, args.jump, args.commands = recorded.files, recorded.jump, recorded.commands
+		}
+		if args.configPath == "" {
+			args.configPath = recorded.configPath
+		}
+		for key, value := range recorded.settings {
+			if _, exists := args.settings[key]; !exists {
+				args.settings[key] = value
+			}
+		}
+	}
+
 	// Open or create a log file
-	file, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	file, err := os.OpenFile(args.logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -19,13 +116,56 @@ func main() {
 
 	log.SetOutput(file)
 
-	tg := TG.NewTG()
+	// The project config is looked for from the first file
+	project := ""
+	if len(args.files) > 0 {
+		project = args.files[0]
+	}
+
+	tg := TG.NewTG(TG.Options{
+		ConfigPath:      args.configPath,
+		ConfigOverrides: args.settings,
+		Project:         project,
+		PluginsDir:      args.pluginsDir,
+		NoPlugins:       args.noPlugins,
+		Replay:          session,
+	})
+
+	if args.record != "" {
+		recording, err := TG.RecordSession(tg, args.record, args.replayable())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recording.Close()
+	}
 
 	loadPluginManager(tg)
 
 	log.Println("Starting TG-Edit...")
 
-	tg.Event.Dispatch("ON_APP_START", nil)
+	// Files given on the command line are opened once the screen is ready
+	tg.Event.Subscribe("ui.started", func(tg *TG.TG, data any) {
+		for i, path := range args.files {
+			buffer, _ := tg.Api.Call("EDIT", path).(*TG.Buffer)
+			if i == 0 && buffer != nil && args.jump != "" {
+				jump(tg, buffer, args.jump)
+			}
+		}
+		for _, command := range args.commands {
+			runCommand(tg, command)
+		}
+	})
+
+	tg.Event.Dispatch("app.started", nil)
+
+	// The message center is loaded by now, NewTG could only log this
+	if err := tg.Config.LoadError(); err != nil {
+		tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Loading the config: %v", err))
+	}
+	// The plugins have declared their options by now
+	for _, problem := range tg.Config.Validate() {
+		tg.Api.Call("AddMessage", "WARNING", problem)
+	}
 
 	tg.Api.Call("Start_UI")
 
@@ -33,6 +173,117 @@ func main() {
 
 }
 
+// parseArguments accepts flags anywhere among the file names, like most editors do
+func parseArguments(argv []string) (*arguments, error) {
+	args := &arguments{settings: settingList{}}
+
+	flags := flag.NewFlagSet("tg-edit", flag.ContinueOnError)
+	flags.StringVar(&args.configPath, "config", "", "config file to load over the user and project ones")
+	flags.Var(args.settings, "set", "set a config value, key=value (repeatable)")
+	flags.StringVar(&args.pluginsDir, "plugins-dir", "./plugins", "directory to load plugins from")
+	flags.StringVar(&args.logFile, "log-file", "app.log", "file to write the log to")
+	flags.BoolVar(&args.noPlugins, "no-plugins", false, "only load the plugins the UI needs")
+	flags.BoolVar(&args.version, "version", false, "print the version and exit")
+	flags.Var(&args.commands, "c", "palette command to run after startup (repeatable)")
+	flags.StringVar(&args.record, "record", "", "record the keys pressed and the screen resizes to a session file")
+	flags.StringVar(&args.replay, "replay", "", "replay a recorded session on a simulated screen and print the screen it ends with")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tg-edit [flags] [+LINE | +/pattern] [files...]")
+		flags.PrintDefaults()
+	}
+
+	// Everything after "--" is a file, even "-x" or "+notes". flags.Parse would drop the "--" and
+	// the loop below would read what follows as flags again, so it is split off first.
+	var afterDashes []string
+	for i, arg := range argv {
+		if arg == "--" {
+			argv, afterDashes = argv[:i], argv[i+1:]
+			break
+		}
+	}
+
+	for {
+		if err := flags.Parse(argv); err != nil {
+			return nil, err
+		}
+		argv = flags.Args()
+		if len(argv) == 0 {
+			break
+		}
+
+		arg := argv[0]
+		argv = argv[1:]
+		if strings.HasPrefix(arg, "+") && len(arg) > 1 {
+			args.jump = arg[1:]
+		} else {
+			args.files = append(args.files, arg)
+		}
+	}
+	args.files = append(args.files, afterDashes...)
+
+	return args, nil
+}
+
+// replayable returns the arguments that load the same config, open the same files and run the same
+// commands, for the header of a recorded session
+func (args *arguments) replayable() []string {
+	var argv []string
+	if args.configPath != "" {
+		argv = append(argv, "-config", args.configPath)
+	}
+	keys := make([]string, 0, len(args.settings))
+	for key := range args.settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		argv = append(argv, "-set", key+"="+args.settings[key])
+	}
+	for _, command := range args.commands {
+		argv = append(argv, "-c", command)
+	}
+	if args.jump != "" {
+		argv = append(argv, "+"+args.jump)
+	}
+	if len(args.files) > 0 {
+		argv = append(append(argv, "--"), args.files...)
+	}
+	return argv
+}
+
+// jump moves to a line number or to the first line matching a pattern
+func jump(tg *TG.TG, buffer *TG.Buffer, target string) {
+	if line, err := strconv.Atoi(target); err == nil {
+		tg.Api.Call("GOTO_LINE", line)
+		return
+	}
+
+	pattern, found := strings.CutPrefix(target, "/")
+	if !found {
+		tg.Api.Call("AddMessage", "ERROR", "Invalid jump target: +"+target)
+		return
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		tg.Api.Call("AddMessage", "ERROR", "Invalid pattern: "+err.Error())
+		return
+	}
+
+	for line := 0; line < buffer.LineCount(); line++ {
+		if re.MatchString(buffer.Line(line)) {
+			tg.Api.Call("GOTO_LINE", line+1)
+			return
+		}
+	}
+	tg.Api.Call("AddMessage", "WARNING", "Pattern not found: "+pattern)
+}
+
+// runCommand runs a palette command line such as "e file.txt" or "%s/a/b/g"
+func runCommand(tg *TG.TG, command string) {
+	tg.Api.Call("EX", command)
+}
+
 func loadPluginManager(tg *TG.TG) {
 
 	pluginManagerName, exists := tg.Config.Get("pluginmanager")
@@ -42,7 +293,7 @@ func loadPluginManager(tg *TG.TG) {
 	}
 
 	log.Printf("Loading plugin manager: %s...\n", pluginManagerName)
-	pluginPath := "./plugins/" + pluginManagerName + ".so"
+	pluginPath := filepath.Join(tg.Options.PluginsDir, pluginManagerName+".so")
 	plug, err := plugin.Open(pluginPath)
 	if err != nil {
 		log.Fatalf("Failed to load plugin %s: %v", pluginManagerName, err)
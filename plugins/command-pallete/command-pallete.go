@@ -1,78 +1,705 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
 	TG "github.com/foroughi/tg-edit/tg"
 )
 
+// Number of candidates the completion popup shows at once
+const popupRows = 8
+
+// Number of history entries kept when the config does not say
+const defaultHistorySize = 100
+
+type candidate struct {
+	text        string
+	description string
+}
+
 type CommandPalletePlugin struct {
 	tg                     *TG.TG
 	commandWindow          any // Pointer to the command palette window
+	popupWindow            any // Completion popup above the palette, nil while closed
 	isCommandPalleteActive bool
-	content                string
+	content                []rune
+	cursor                 int    // Position in content where typing inserts
+	prompt                 string // ":" for commands, "/" or "?" while searching
+
+	candidates []candidate // Completions for the word at the cursor
+	selected   int         // Candidate Tab last inserted, -1 before the first Tab
+	wordStart  int         // Where the word being completed starts in content
+	wordEnd    int         // Where the text Tab last inserted ends
+
+	history       []string // Submitted lines with their prompt, oldest first
+	historyLoaded bool
+	historyIndex  int    // Entry Up and Down are on, len(history) for the line being typed
+	historyPrefix string // What was typed before moving through history, entries must start with it
+	reverseSearch bool   // Ctrl+R is searching history
+	searchKeys    int    // Subscription taking key.pressed from the KeyManager while Ctrl+R searches
+	searchQuery   []rune
+	searchMatch   int    // Entry matching the query, -1 for none
+	contentBackup []rune // Content before Ctrl+R, restored when the search is cancelled
 }
 
 func (p *CommandPalletePlugin) Init(tg *TG.TG) {
 
 	p.tg = tg
 	p.isCommandPalleteActive = false
-	p.content = ""
+	p.content = nil
+
+	tg.Config.Declare("history", TG.OptionInt, defaultHistorySize, "Number of command lines the palette remembers")
+	tg.Config.Declare("historyfile", TG.OptionString, "", "File the palette history is kept in, tg-edit/history in $XDG_STATE_HOME when empty")
 
-	tg.Event.Subscribe("ACTIVE_WINDOW_CHANGED", func(tg *TG.TG, data any) {
+	tg.Event.Subscribe("window.activated", func(tg *TG.TG, data any) {
 
 		if data == p.commandWindow {
 
 			p.isCommandPalleteActive = true
-		} else {
+		} else if data != p.popupWindow {
 			p.isCommandPalleteActive = false
 		}
 
 	})
 
-	tg.Event.Subscribe("ON_KEY", func(tg *TG.TG, data any) {
-
-		if p.isCommandPalleteActive {
-
-			key := data.(string)
-			// Handle key input when the command palette is active
-			if key == "Esc" {
-				// Close the command palette window
-				tg.Api.Call("CLOSE_WINDOW", p.commandWindow)
-				p.isCommandPalleteActive = false
-				tg.Api.Call("RECORD_KEYS")
-			} else {
-				// Append the key to the command palette content
-
-				p.content += key
-				tg.Api.Call("SET_WINDOW_CONTENT", map[string]any{
-					"window":  p.commandWindow,
-					"content": p.content,
-				})
+	// Keys typed in command mode, see KeyManager
+	tg.Api.RegisterCommand("COMMAND_LINE_KEY", func(tg *TG.TG, data any) {
+
+		key, _ := data.(string)
+		if !p.isCommandPalleteActive {
+			return
+		}
+
+		switch key {
+		case "Tab":
+			p.complete(1)
+			return
+		case "Backtab":
+			p.complete(-1)
+			return
+		case "Up":
+			p.browseHistory(-1)
+			return
+		case "Down":
+			p.browseHistory(1)
+			return
+		case "Ctrl+R":
+			p.startReverseSearch()
+			return
+		case "Esc", "Ctrl+C":
+			p.close()
+			return
+		case "Enter":
+			p.submit()
+			return
+		case "Backspace", "Backspace2":
+			// Erasing past the prompt leaves the command line, like Vim
+			if len(p.content) == 0 {
+				p.close()
+				return
+			}
+			if p.cursor > 0 {
+				p.content = append(p.content[:p.cursor-1], p.content[p.cursor:]...)
+				p.cursor--
+			}
+		case "Delete":
+			if p.cursor < len(p.content) {
+				p.content = append(p.content[:p.cursor], p.content[p.cursor+1:]...)
+			}
+		case "Left":
+			p.cursor = max(p.cursor-1, 0)
+		case "Right":
+			p.cursor = min(p.cursor+1, len(p.content))
+		case "Home", "Ctrl+B":
+			p.cursor = 0
+		case "End", "Ctrl+E":
+			p.cursor = len(p.content)
+		case "Ctrl+W":
+			// Delete the word before the cursor and the spaces after it
+			start := p.cursor
+			for start > 0 && unicode.IsSpace(p.content[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(p.content[start-1]) {
+				start--
+			}
+			p.content = append(p.content[:start], p.content[p.cursor:]...)
+			p.cursor = start
+		case "Ctrl+U":
+			p.content = p.content[p.cursor:]
+			p.cursor = 0
+		default:
+			if utf8.RuneCountInString(key) != 1 {
+				return
 			}
+			r, _ := utf8.DecodeRuneInString(key)
+			p.content = append(p.content[:p.cursor], append([]rune{r}, p.content[p.cursor:]...)...)
+			p.cursor++
 		}
+
+		// Editing leaves history and starts a new completion
+		p.historyIndex = len(p.history)
+		p.updateCandidates()
+		p.update()
 	})
 
+	// Opens the palette, the optional prompt is ":" for commands or "/" and "?" to search
 	tg.Api.RegisterCommand("COMMAND", func(tg *TG.TG, data any) {
 
-		p.content = ""
-		screenSize := tg.Api.Call("GET_SCREEN_SIZE", nil).(map[string]int)
-		screenWidth := screenSize["width"]
-		screenHeight := screenSize["height"]
+		p.content = nil
+		p.prompt = ":"
+		if prompt, ok := data.(string); ok && prompt != "" {
+			p.prompt = prompt
+		}
+		// Like Vim, a command typed over a selection starts with the range of its lines
+		if p.prompt == ":" && tg.Key.Mode() == TG.ModeVisual {
+			p.content = []rune("'<,'>")
+		}
+		p.cursor = len(p.content)
+
+		p.loadHistory()
+		p.historyIndex = len(p.history)
+		p.endReverseSearch()
+		p.candidates = nil
+
+		screenWidth, screenHeight, ok := p.screenSize()
+		if !ok {
+			return
+		}
 		windowData := map[string]any{
 			"title":   "Command Pallete",
 			"x":       0,
 			"y":       screenHeight - 6, // Position at the bottom of the screen
 			"w":       screenWidth,
 			"h":       3, // Height of the command palette
-			"content": p.content,
+			"content": p.prompt + string(p.content),
+			"cursor":  len([]rune(p.prompt)) + p.cursor,
 		}
 
 		// Save the returned pointer to the command palette window
 		p.commandWindow = tg.Api.Call("OPEN_WINDOW", windowData)
 		p.isCommandPalleteActive = true
-		tg.Api.Call("DONT_RECORD_KEYS")
+		tg.Api.Call("SET_MODE", TG.ModeCommand)
 	})
 
 	tg.Key.RegisterKey(":", "COMMAND")
+	tg.Key.RegisterKey("/", "COMMAND /")
+	tg.Key.RegisterKey("?", "COMMAND ?")
+	tg.Key.RegisterModeKey(TG.ModeVisual, ":", "COMMAND")
+}
+
+// screenSize asks the UI for the size of the screen, reporting why when it cannot tell
+func (p *CommandPalletePlugin) screenSize() (width, height int, ok bool) {
+	result, err := p.tg.Api.CallE("GET_SCREEN_SIZE")
+	size, ok := result.(map[string]int)
+	if err != nil || !ok {
+		p.tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Command palette needs the screen size: %v", err))
+		return 0, 0, false
+	}
+	return size["width"], size["height"], true
+}
+
+func (p *CommandPalletePlugin) searching() bool {
+	return p.prompt == "/" || p.prompt == "?"
+}
+
+// update redraws the command line and highlights the matches of a search while it is typed
+func (p *CommandPalletePlugin) update() {
+	content := p.prompt + string(p.content)
+	cursor := len([]rune(p.prompt)) + p.cursor
+
+	if p.reverseSearch {
+		match := ""
+		if p.searchMatch >= 0 {
+			match, _ = strings.CutPrefix(p.history[p.searchMatch], p.prompt)
+		}
+		label := "(reverse-i-search)`" + string(p.searchQuery)
+		content = label + "': " + match
+		cursor = len([]rune(label))
+	}
+
+	p.tg.Api.Call("SET_WINDOW_CONTENT", map[string]any{
+		"window":  p.commandWindow,
+		"content": content,
+		"cursor":  cursor,
+	})
+	if p.searching() {
+		p.tg.Api.Call("SEARCH_PREVIEW", string(p.content))
+	}
+	p.updatePopup()
+}
+
+func (p *CommandPalletePlugin) close() {
+	p.endReverseSearch()
+	p.candidates = nil
+	p.updatePopup()
+	p.tg.Api.Call("CLOSE_WINDOW", p.commandWindow)
+	p.isCommandPalleteActive = false
+	if p.searching() {
+		p.tg.Api.Call("SEARCH_PREVIEW", "")
+	}
+	p.tg.Api.Call("SET_MODE", TG.ModeNormal)
+}
+
+// submit closes the palette and runs what was typed
+func (p *CommandPalletePlugin) submit() {
+	content := string(p.content)
+	p.close()
+	p.addHistory(p.prompt + content)
+
+	if p.searching() {
+		p.tg.Api.Call("SEARCH", map[string]any{
+			"pattern":  content,
+			"backward": p.prompt == "?",
+		})
+		return
+	}
+	p.tg.Api.Call("EX", content)
+}
+
+// Range in front of the command name, as in ":'<,'>s" or ":%s"
+var rangePrefix = regexp.MustCompile(`^[\s:]*[0-9.$%'<>+\-,;]*\s*`)
+
+// updateCandidates finds what the word at the cursor could complete to: command names while the
+// name is typed, files in the argument of commands taking files
+func (p *CommandPalletePlugin) updateCandidates() {
+	p.candidates = nil
+	p.selected = -1
+	if p.prompt != ":" {
+		return
+	}
+
+	typed := string(p.content[:p.cursor])
+	nameStart := len(rangePrefix.FindString(typed))
+	name, argument, hasArgument := strings.Cut(typed[nameStart:], " ")
+
+	if !hasArgument {
+		if name == "" || strings.ContainsAny(name, "!/") {
+			return
+		}
+		p.wordStart = utf8.RuneCountInString(typed[:nameStart])
+		p.candidates = p.commandCandidates(name)
+		return
+	}
+
+	command, exists := p.tg.Ex.Lookup(strings.TrimSuffix(name, "!"))
+	if !exists {
+		return
+	}
+	word := argument[strings.LastIndexAny(argument, " \t")+1:]
+	p.wordStart = p.cursor - utf8.RuneCountInString(word)
+	switch command.Complete {
+	case "file":
+		p.candidates = fileCandidates(word)
+	case "command":
+		if word != "" {
+			p.candidates = p.commandCandidates(word)
+		}
+	case "option":
+		p.candidates = p.optionCandidates(strings.TrimPrefix(word, "no"))
+		if strings.HasPrefix(word, "no") {
+			p.wordStart += 2
+		}
+	}
+}
+
+// commandCandidates ranks ex commands and ApiBridge commands by how well their names fuzzy match, ex
+// commands show their usage and ApiBridge commands their description
+func (p *CommandPalletePlugin) commandCandidates(pattern string) []candidate {
+	var items []candidate
+	for _, command := range p.tg.Ex.Commands() {
+		items = append(items, candidate{command.Name, command.Usage})
+	}
+	for _, info := range p.tg.Api.ListCommands() {
+		items = append(items, candidate{info.Name, info.Description})
+	}
+	return rankCandidates(pattern, items)
+}
+
+// optionCandidates ranks the config options by how well their keys fuzzy match, showing their value
+func (p *CommandPalletePlugin) optionCandidates(pattern string) []candidate {
+	var items []candidate
+	for _, option := range p.tg.Config.Options() {
+		value, _ := p.tg.Config.Get(option.Key)
+		items = append(items, candidate{option.Key, fmt.Sprintf("%s=%s  %s", option.Type, value, option.Description)})
+	}
+	return rankCandidates(pattern, items)
+}
+
+// rankCandidates keeps the items whose text fuzzy matches pattern, best first, and the first of items
+// with the same text
+func rankCandidates(pattern string, items []candidate) []candidate {
+	type scored struct {
+		candidate
+		score int
+	}
+	var matches []scored
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		if seen[item.text] {
+			continue
+		}
+		seen[item.text] = true
+		if score, ok := fuzzyScore(pattern, item.text); ok {
+			matches = append(matches, scored{item, score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].text < matches[j].text
+	})
+
+	candidates := make([]candidate, len(matches))
+	for i, match := range matches {
+		candidates[i] = match.candidate
+	}
+	return candidates
+}
+
+// fuzzyScore reports whether the characters of pattern appear in name in order, ignoring case, and
+// scores the match so runs of characters, starts of words and short names rank first
+func fuzzyScore(pattern, name string) (int, bool) {
+	pattern = strings.ToLower(pattern)
+	lower := strings.ToLower(name)
+
+	score := 0
+	previous := -2
+	pos := 0
+	for _, r := range pattern {
+		index := strings.IndexRune(lower[pos:], r)
+		if index < 0 {
+			return 0, false
+		}
+		index += pos
+
+		score++
+		if index == previous+1 {
+			score += 5
+		}
+		if index == 0 || lower[index-1] == '_' || lower[index-1] == '-' {
+			score += 8
+		}
+		previous = index
+		pos = index + utf8.RuneLen(r)
+	}
+
+	if strings.HasPrefix(lower, pattern) {
+		score += 10
+	}
+	return score*10 - len(name), true
+}
+
+// fileCandidates lists the paths a partly typed path could complete to, directories end in a slash
+func fileCandidates(word string) []candidate {
+	dir, base := filepath.Split(word)
+	listDir := dir
+	if listDir == "" {
+		listDir = "."
+	}
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(listDir, "~/") {
+		listDir = filepath.Join(home, listDir[2:])
+	}
+
+	entries, err := os.ReadDir(listDir)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []candidate
+	for _, entry := range entries {
+		name := entry.Name()
+		// Hidden files only show up once a dot is typed
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		description := "file"
+		if entry.IsDir() {
+			name += "/"
+			description = "directory"
+		}
+		candidates = append(candidates, candidate{dir + name, description})
+	}
+	return candidates
+}
+
+// complete puts the next or previous candidate in place of the word being completed
+func (p *CommandPalletePlugin) complete(step int) {
+	if p.selected < 0 {
+		p.updateCandidates()
+		p.wordEnd = p.cursor
+	}
+	if len(p.candidates) == 0 {
+		return
+	}
+
+	if p.selected < 0 && step < 0 {
+		p.selected = len(p.candidates) - 1
+	} else {
+		p.selected = (p.selected + step + len(p.candidates)) % len(p.candidates)
+	}
+	text := []rune(p.candidates[p.selected].text)
+
+	rest := append([]rune{}, p.content[p.wordEnd:]...)
+	p.content = append(append(p.content[:p.wordStart], text...), rest...)
+	p.wordEnd = p.wordStart + len(text)
+	p.cursor = p.wordEnd
+	p.update()
+}
+
+// updatePopup lists the candidates in a window above the palette, closing it when there are none
+func (p *CommandPalletePlugin) updatePopup() {
+	if len(p.candidates) == 0 {
+		if p.popupWindow != nil {
+			p.tg.Api.Call("CLOSE_WINDOW", p.popupWindow)
+			p.popupWindow = nil
+		}
+		return
+	}
+
+	// Scroll so the selected candidate stays visible
+	first := 0
+	if p.selected >= popupRows {
+		first = p.selected - popupRows + 1
+	}
+	last := min(first+popupRows, len(p.candidates))
+
+	width := 0
+	for _, c := range p.candidates[first:last] {
+		width = max(width, utf8.RuneCountInString(c.text))
+	}
+
+	lines := make([]string, 0, last-first)
+	for i := first; i < last; i++ {
+		marker := "  "
+		if i == p.selected {
+			marker = "> "
+		}
+		c := p.candidates[i]
+		lines = append(lines, marker+c.text+strings.Repeat(" ", width-utf8.RuneCountInString(c.text))+"  "+c.description)
+	}
+	if more := len(p.candidates) - last; more > 0 {
+		lines[len(lines)-1] += "  (" + strconv.Itoa(more) + " more)"
+	}
+	content := strings.Join(lines, "\n")
+
+	if p.popupWindow != nil {
+		p.tg.Api.Call("SET_WINDOW_CONTENT", map[string]any{
+			"window":  p.popupWindow,
+			"content": content,
+		})
+		return
+	}
+
+	screenWidth, screenHeight, ok := p.screenSize()
+	if !ok {
+		return
+	}
+	p.popupWindow = p.tg.Api.Call("OPEN_WINDOW", map[string]any{
+		"title":   "Completions",
+		"x":       0,
+		"y":       screenHeight - 6 - popupRows - 2, // Right above the palette
+		"w":       screenWidth,
+		"h":       popupRows + 2,
+		"content": content,
+		"focus":   false,
+	})
+}
+
+// browseHistory moves through the entries of the current prompt that start with what was typed
+func (p *CommandPalletePlugin) browseHistory(step int) {
+	if p.historyIndex == len(p.history) {
+		p.historyPrefix = string(p.content)
+	}
+
+	for i := p.historyIndex + step; i >= 0 && i <= len(p.history); i += step {
+		if i == len(p.history) {
+			p.historyIndex = i
+			p.setContent(p.historyPrefix)
+			return
+		}
+		entry, ok := strings.CutPrefix(p.history[i], p.prompt)
+		if ok && strings.HasPrefix(entry, p.historyPrefix) {
+			p.historyIndex = i
+			p.setContent(entry)
+			return
+		}
+	}
+}
+
+func (p *CommandPalletePlugin) setContent(text string) {
+	p.content = []rune(text)
+	p.cursor = len(p.content)
+	p.candidates = nil
+	p.update()
+}
+
+func (p *CommandPalletePlugin) startReverseSearch() {
+	p.reverseSearch = true
+	// Every key belongs to the search, even those bound in command mode
+	p.searchKeys = p.tg.Event.SubscribeWith("key.pressed", TG.SubscribeOptions{Priority: TG.PriorityHigh}, func(tg *TG.TG, e *TG.EventContext) {
+		key, _ := e.Data.(string)
+		p.reverseSearchKey(key)
+		e.SetHandled()
+		e.StopPropagation()
+	})
+	p.searchQuery = nil
+	p.searchMatch = -1
+	p.contentBackup = append([]rune{}, p.content...)
+	p.candidates = nil
+	p.update()
+}
+
+// reverseSearchKey handles keys while Ctrl+R searches history: typing narrows the search, Ctrl+R
+// finds an older match, Enter runs the match, Esc cancels and any other key starts editing the match
+func (p *CommandPalletePlugin) reverseSearchKey(key string) {
+	switch key {
+	case "Ctrl+R":
+		if p.searchMatch > 0 {
+			p.findHistory(p.searchMatch - 1)
+		}
+	case "Backspace", "Backspace2":
+		if len(p.searchQuery) > 0 {
+			p.searchQuery = p.searchQuery[:len(p.searchQuery)-1]
+			p.searchMatch = -1
+			p.findHistory(len(p.history) - 1)
+		}
+	case "Esc", "Ctrl+C", "Ctrl+G":
+		p.endReverseSearch()
+		p.setContent(string(p.contentBackup))
+		return
+	case "Enter":
+		p.acceptSearch()
+		p.submit()
+		return
+	default:
+		if utf8.RuneCountInString(key) != 1 {
+			p.acceptSearch()
+			return
+		}
+		r, _ := utf8.DecodeRuneInString(key)
+		p.searchQuery = append(p.searchQuery, r)
+		from := p.searchMatch
+		if from < 0 {
+			from = len(p.history) - 1
+		}
+		p.searchMatch = -1
+		p.findHistory(from)
+	}
+	p.update()
+}
+
+// endReverseSearch leaves Ctrl+R, handing keys back to the KeyManager
+func (p *CommandPalletePlugin) endReverseSearch() {
+	p.reverseSearch = false
+	if p.searchKeys != 0 {
+		p.tg.Event.Unsubscribe(p.searchKeys)
+		p.searchKeys = 0
+	}
+}
+
+// findHistory finds the newest entry of the current prompt at or before from containing the query
+func (p *CommandPalletePlugin) findHistory(from int) {
+	query := string(p.searchQuery)
+	for i := min(from, len(p.history)-1); i >= 0; i-- {
+		entry, ok := strings.CutPrefix(p.history[i], p.prompt)
+		if ok && strings.Contains(entry, query) {
+			p.searchMatch = i
+			return
+		}
+	}
+}
+
+// acceptSearch ends Ctrl+R with the match as the content
+func (p *CommandPalletePlugin) acceptSearch() {
+	p.endReverseSearch()
+	if p.searchMatch < 0 {
+		p.setContent(string(p.contentBackup))
+		return
+	}
+	entry, _ := strings.CutPrefix(p.history[p.searchMatch], p.prompt)
+	p.setContent(entry)
+}
+
+// historyPath is the "historyfile" option, by default tg-edit/history in the XDG state directory
+func (p *CommandPalletePlugin) historyPath() string {
+	if path, exists := p.tg.Config.Get("historyfile"); exists && path != "" {
+		return path
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "tg-edit", "history")
+}
+
+// historySize is the "history" option, the number of entries kept
+func (p *CommandPalletePlugin) historySize() int {
+	if size, ok := p.tg.Config.GetInt("history"); ok && size >= 0 {
+		return size
+	}
+	return defaultHistorySize
+}
+
+func (p *CommandPalletePlugin) loadHistory() {
+	if p.historyLoaded {
+		return
+	}
+	p.historyLoaded = true
+
+	data, err := os.ReadFile(p.historyPath())
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			p.history = append(p.history, line)
+		}
+	}
+}
+
+// addHistory remembers a submitted line, moving a repeated line to the end, and saves the history file
+func (p *CommandPalletePlugin) addHistory(entry string) {
+	if strings.TrimSpace(strings.TrimPrefix(entry, p.prompt)) == "" {
+		return
+	}
+	for i, existing := range p.history {
+		if existing == entry {
+			p.history = append(p.history[:i], p.history[i+1:]...)
+			break
+		}
+	}
+	p.history = append(p.history, entry)
+	if size := p.historySize(); len(p.history) > size {
+		p.history = p.history[len(p.history)-size:]
+	}
+
+	path := p.historyPath()
+	if path == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = TG.WriteAtomic(path, []byte(strings.Join(p.history, "\n")+"\n"), 0600)
+	}
+	if err != nil {
+		p.tg.Api.Call("AddMessage", "ERROR", "Failed to save history: "+err.Error())
+	}
 }
 
 func New() TG.Plugin {
@@ -14,7 +14,71 @@ type HighLightPlugin struct {
 
 func (p *HighLightPlugin) Init(tg *TG.TG) {
 	p.tg = tg
-	p.styles = map[string]any{
+	p.styles = defaultStyles()
+
+	// Config keys below "style" set the styles, "style.default.text.fg" sets "default.text.fg"
+	tg.Config.Declare("style", TG.OptionSection, nil, "Styles, [style.default.text] fg = \"white\" sets the fg of default.text")
+	for _, key := range tg.Config.Keys("style") {
+		value, _ := tg.Config.Value(key)
+		p.setStyle(strings.TrimPrefix(key, "style."), styleValue(value))
+	}
+
+	tg.Event.Subscribe("config.changed", func(tg *TG.TG, data any) {
+		changes, _ := data.([]TG.ConfigChange)
+		for _, change := range changes {
+			keyPath, found := strings.CutPrefix(change.Key, "style.")
+			if !found {
+				continue
+			}
+			if change.New != nil {
+				p.setStyle(keyPath, styleValue(change.New))
+				continue
+			}
+			// Removed from the config, back to the built in style
+			p.setStyle(keyPath, getStyle(defaultStyles(), splitKeyPath(keyPath)))
+		}
+	})
+
+	// Register the Get_STYLES command
+	tg.Api.RegisterCommand("GET_STYLES", func(tg *TG.TG, data any) any {
+		keys, ok := data.(string)
+		if !ok {
+			tg.Api.Call("AddMessage", "ERROR", "Invalid data format for Get_STYLES")
+			return nil
+		}
+		return p.getStyle(splitKeyPath(keys))
+	})
+
+	// Register the Set_STYLES command
+	tg.Api.RegisterCommand("SET_STYLES", func(tg *TG.TG, data any) any {
+		params, ok := data.(map[string]any)
+		if !ok {
+			tg.Api.Call("AddMessage", "ERROR", "Invalid data format for Set_STYLES")
+			return nil
+		}
+
+		key, ok := params["key"].(string)
+		if !ok {
+			tg.Api.Call("AddMessage", "ERROR", "Invalid keys for Set_STYLES")
+			return nil
+		}
+
+		style, ok := params["style"].(map[string]any)
+		if !ok {
+			tg.Api.Call("AddMessage", "ERROR", "Invalid style for Set_STYLES")
+			return nil
+		}
+
+		p.setStyle(key, style)
+
+		tg.Api.Call("AddMessage", "INFO", "Style updated: "+key)
+		return nil
+	})
+}
+
+// defaultStyles returns the built in styles, a new map every time so they can be changed
+func defaultStyles() map[string]any {
+	return map[string]any{
 		"default": map[string]any{
 			"text": map[string]any{
 				"fg":        "white",
@@ -61,47 +125,15 @@ func (p *HighLightPlugin) Init(tg *TG.TG) {
 			},
 		},
 	}
-
-	// Register the Get_STYLES command
-	tg.Api.RegisterCommand("GET_STYLES", func(tg *TG.TG, data any) any {
-		keys, ok := data.(string)
-		if !ok {
-			tg.Api.Call("AddMessage", "ERROR", "Invalid data format for Get_STYLES")
-			return nil
-		}
-		return p.getStyle(splitKeyPath(keys))
-	})
-
-	// Register the Set_STYLES command
-	tg.Api.RegisterCommand("SET_STYLES", func(tg *TG.TG, data any) any {
-		params, ok := data.(map[string]any)
-		if !ok {
-			tg.Api.Call("AddMessage", "ERROR", "Invalid data format for Set_STYLES")
-			return nil
-		}
-
-		key, ok := params["key"].(string)
-		if !ok {
-			tg.Api.Call("AddMessage", "ERROR", "Invalid keys for Set_STYLES")
-			return nil
-		}
-
-		style, ok := params["style"].(map[string]any)
-		if !ok {
-			tg.Api.Call("AddMessage", "ERROR", "Invalid style for Set_STYLES")
-			return nil
-		}
-
-		p.setStyle(key, style)
-
-		tg.Api.Call("AddMessage", "INFO", "Style updated: "+key)
-		return nil
-	})
 }
 
 // Recursive function to get a style
 func (p *HighLightPlugin) getStyle(keys []string) any {
-	current := p.styles
+	return getStyle(p.styles, keys)
+}
+
+func getStyle(styles map[string]any, keys []string) any {
+	current := styles
 	for i, key := range keys {
 		if next, ok := current[key]; ok {
 			if i == len(keys)-1 {
@@ -131,8 +163,12 @@ func (p *HighLightPlugin) setStyle(keyPath string, style any) {
 	current := p.styles
 	for i, key := range keys {
 		if i == len(keys)-1 {
-			// Last key, set the style
-			current[key] = style
+			// Last key, set the style, a nil style removes it
+			if style == nil {
+				delete(current, key)
+			} else {
+				current[key] = style
+			}
 			return
 		}
 
@@ -153,6 +189,25 @@ func (p *HighLightPlugin) setStyle(keyPath string, style any) {
 
 }
 
+// styleValue turns a config value into what the UI reads from styles: ints and lists of ints
+func styleValue(value any) any {
+	switch v := value.(type) {
+	case int64:
+		return int(v)
+	case []any:
+		numbers := make([]int, 0, len(v))
+		for _, item := range v {
+			number, ok := item.(int64)
+			if !ok {
+				return v
+			}
+			numbers = append(numbers, int(number))
+		}
+		return numbers
+	}
+	return value
+}
+
 // Helper function to split a dot-separated key path
 func splitKeyPath(keyPath string) []string {
 	return strings.Split(keyPath, ".")
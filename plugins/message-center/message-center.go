@@ -24,7 +24,12 @@ func (p *MessageCenterPlugin) Init(tg *TG.TG) {
 	p.tg.Api.RegisterCommand("AddMessage", p.AddMessage)
 	p.tg.Api.RegisterCommand("GetMessages", p.GetMessages)
 
-	p.tg.Event.Register("MESSAGE_ADDED")
+	p.tg.Event.Declare(TG.EventInfo{
+		Name:        "message.added",
+		Description: "A message was added with AddMessage",
+		Payload:     "Message of the message-center plugin, with its Level and Content",
+		Aliases:     []string{"MESSAGE_ADDED"},
+	})
 
 	log.Println("MessageCenter Plugin Initialized")
 }
@@ -40,7 +45,7 @@ func (p *MessageCenterPlugin) AddMessage(tg *TG.TG, args ...any) any {
 	msg := Message{Level: level, Content: content}
 	p.messages = append(p.messages, msg)
 
-	p.tg.Event.Dispatch("MESSAGE_ADDED", msg)
+	p.tg.Event.Dispatch("message.added", msg)
 	log.Printf("[%s] %s", level, content)
 
 	return msg
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
 	"plugin"
+	"slices"
 
 	TG "github.com/foroughi/tg-edit/tg"
 )
 
 type PluginManagerPlugin struct {
-	plugins map[string]TG.Plugin
-	tg      *TG.TG
+	plugins     map[string]TG.Plugin // Loaded plugins
+	available   map[string]TG.Plugin // Every plugin found in the plugins directory, loaded or not
+	wasDisabled map[string]bool      // The disabled plugins when disabledplugins last changed
+	tg          *TG.TG
 }
 
 func New() TG.Plugin {
 	return &PluginManagerPlugin{
-		plugins: make(map[string]TG.Plugin),
+		plugins:   make(map[string]TG.Plugin),
+		available: make(map[string]TG.Plugin),
 	}
 }
 
@@ -26,7 +32,7 @@ func (pm *PluginManagerPlugin) shouldLoadPlugin(fileName string) bool {
 }
 
 func (pm *PluginManagerPlugin) LoadPlugins() {
-	pluginDir := "./plugins"
+	pluginDir := pm.tg.Options.PluginsDir
 	files, err := os.ReadDir(pluginDir)
 	if err != nil {
 		log.Fatalf("Error reading plugin directory: %v", err)
@@ -58,19 +64,33 @@ func (pm *PluginManagerPlugin) LoadPlugins() {
 
 			pluginInstance := newPlugin()
 			pendingPlugins[pluginInstance.Name()] = pluginInstance
+			pm.available[pluginInstance.Name()] = pluginInstance
 		}
 	}
 
+	if pm.tg.Options.NoPlugins {
+		pendingPlugins = corePlugins(pendingPlugins)
+	}
+	for name := range pm.disabled() {
+		delete(pendingPlugins, name)
+	}
+
 	// Step 2: Load plugins in correct order
-	loadedPlugins := make(map[string]TG.Plugin)
+	if unresolved := pm.load(pendingPlugins); len(unresolved) > 0 {
+		log.Fatalf("Circular dependency detected! Unresolved plugins: %v", unresolved)
+	}
+}
 
+// load initializes plugins after the plugins they depend on and returns those left when the
+// dependencies are circular
+func (pm *PluginManagerPlugin) load(pendingPlugins map[string]TG.Plugin) map[string]TG.Plugin {
 	for len(pendingPlugins) > 0 {
 		progress := false
 
 		for name, plugin := range pendingPlugins {
 			missingDeps := []string{}
 			for _, dep := range plugin.DependsOn() {
-				if _, exists := pendingPlugins[dep]; !exists && loadedPlugins[dep] == nil {
+				if _, exists := pendingPlugins[dep]; !exists && pm.plugins[dep] == nil {
 					missingDeps = append(missingDeps, dep)
 				}
 			}
@@ -82,8 +102,9 @@ func (pm *PluginManagerPlugin) LoadPlugins() {
 			}
 
 			// Load the plugin since all dependencies exist
+			pm.tg.Api.SetPlugin(name)
 			plugin.Init(pm.tg)
-			loadedPlugins[name] = plugin
+			pm.tg.Api.SetPlugin("")
 			pm.AddPlugin(plugin)
 			delete(pendingPlugins, name)
 			log.Printf("Loaded plugin: %s", name)
@@ -92,9 +113,69 @@ func (pm *PluginManagerPlugin) LoadPlugins() {
 
 		// Step 3: If no progress, circular dependency detected
 		if !progress {
-			log.Fatalf("Circular dependency detected! Unresolved plugins: %v", pendingPlugins)
+			return pendingPlugins
+		}
+	}
+	return nil
+}
+
+// disabled returns the plugins disabledplugins names, but for the UI manager and the plugins it
+// depends on as the editor cannot run without them
+func (pm *PluginManagerPlugin) disabled() map[string]bool {
+	names, _ := pm.tg.Config.GetStringList("disabledplugins")
+	core := corePlugins(pm.available)
+	disabled := make(map[string]bool)
+	for _, name := range names {
+		if core[name] != nil {
+			log.Printf("Plugin %s cannot be disabled", name)
+			continue
 		}
+		disabled[name] = true
 	}
+	return disabled
+}
+
+// applyDisabled loads the plugins that are no longer disabled. Go cannot unload a plugin and its
+// commands, keys and subscriptions cannot be taken back, so a loaded plugin that is now disabled
+// stays loaded until tg-edit restarts. It is never initialized twice.
+func (pm *PluginManagerPlugin) applyDisabled() {
+	disabled := pm.disabled()
+
+	pending := make(map[string]TG.Plugin)
+	if !pm.tg.Options.NoPlugins {
+		for name, plugin := range pm.available {
+			if !disabled[name] && pm.plugins[name] == nil {
+				pending[name] = plugin
+			}
+		}
+	}
+	if unresolved := pm.load(pending); len(unresolved) > 0 {
+		pm.tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Circular dependency, plugins not loaded: %v", slices.Sorted(maps.Keys(unresolved))))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(disabled)) {
+		if _, loaded := pm.plugins[name]; loaded && !pm.wasDisabled[name] {
+			pm.tg.Api.Call("AddMessage", "WARNING", fmt.Sprintf("Plugin %s is disabled, this takes effect after tg-edit restarts", name))
+		}
+	}
+	pm.wasDisabled = disabled
+}
+
+// corePlugins keeps only the UI manager and the plugins it depends on
+func corePlugins(all map[string]TG.Plugin) map[string]TG.Plugin {
+	core := make(map[string]TG.Plugin)
+	queue := []string{"UIManager"}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		plugin, exists := all[name]
+		if !exists || core[name] != nil {
+			continue
+		}
+		core[name] = plugin
+		queue = append(queue, plugin.DependsOn()...)
+	}
+	return core
 }
 
 func (pm *PluginManagerPlugin) AddPlugin(plugin TG.Plugin) {
@@ -115,11 +196,22 @@ func (pm *PluginManagerPlugin) Init(tg *TG.TG) {
 
 	pm.tg = tg
 
-	pm.tg.Event.Subscribe("ON_APP_START", func(tg *TG.TG, data any) {
+	pm.tg.Config.Declare("disabledplugins", TG.OptionList, nil, `Plugins not to load, by name such as "StatusLine"`)
+
+	pm.tg.Event.Subscribe("app.started", func(tg *TG.TG, data any) {
 		pm.LoadPlugins()
 
 	})
 
+	pm.tg.Event.Subscribe("config.changed", func(tg *TG.TG, data any) {
+		changes, _ := data.([]TG.ConfigChange)
+		for _, change := range changes {
+			if change.Key == "disabledplugins" {
+				pm.applyDisabled()
+			}
+		}
+	})
+
 }
 
 func (p *PluginManagerPlugin) Name() string {
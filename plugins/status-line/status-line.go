@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"log"
+	"strings"
+
 	TG "github.com/foroughi/tg-edit/tg"
 )
 
@@ -14,13 +18,18 @@ type StatusLinePlugin struct {
 
 func (p *StatusLinePlugin) Init(tg *TG.TG) {
 	p.tg = tg
-	p.leftContent = ""
+	p.leftContent = strings.ToUpper(tg.Key.Mode())
 	p.rightContent = ""
 	p.centerContent = ""
 
-	tg.Event.Subscribe("ON_UI_START", func(tg *TG.TG, data any) {
+	tg.Event.Subscribe("ui.started", func(tg *TG.TG, data any) {
 		// Retrieve screen size
-		screenSize := tg.Api.Call("GET_SCREEN_SIZE", nil).(map[string]int)
+		result, err := tg.Api.CallE("GET_SCREEN_SIZE")
+		screenSize, ok := result.(map[string]int)
+		if err != nil || !ok {
+			log.Printf("[ERROR] Status line needs the screen size: %v", err)
+			return
+		}
 		screenWidth := screenSize["width"]
 		screenHeight := screenSize["height"]
 
@@ -69,43 +78,64 @@ func (p *StatusLinePlugin) Init(tg *TG.TG) {
 			"title":   "Status line",
 			"content": p.getStyledContent(tg), // Use styled content
 			"style":   "status_line.win",      // Use the dynamically set style
+			"focus":   false,                  // Keep focus on the window being edited
 		}
 
 		// Save the returned pointer to the status line window
 		p.statusLineWindow = tg.Api.Call("OPEN_WINDOW", windowData)
 
-		tg.Event.Subscribe("ON_KEY_COMBINATION_FOUND", func(tg *TG.TG, data any) {
+		tg.Event.Subscribe("key.sequence.found", func(tg *TG.TG, data any) {
 			p.rightContent = ""
 			p.update()
 		})
 
-		tg.Event.Subscribe("ON_KEY_COMBINATION_PROCCESSING", func(tg *TG.TG, data any) {
-			key := data.(string)
+		tg.Event.Subscribe("key.sequence.pending", func(tg *TG.TG, data any) {
+			key, _ := data.(string)
 			p.rightContent = key
 			p.update()
 		})
+
+		// Shows which match of the last search the cursor is on, like "3/17"
+		tg.Event.Subscribe("search.updated", func(tg *TG.TG, data any) {
+			search, ok := data.(TG.SearchMatches)
+			if !ok {
+				return
+			}
+			switch {
+			case !search.Highlight || search.Pattern == "":
+				p.centerContent = ""
+			case search.Current > 0:
+				p.centerContent = fmt.Sprintf("/%s %d/%d", search.Pattern, search.Current, len(search.Matches))
+			default:
+				p.centerContent = fmt.Sprintf("/%s %d", search.Pattern, len(search.Matches))
+			}
+			p.update()
+		})
+
+		tg.Event.Subscribe("mode.changed", func(tg *TG.TG, data any) {
+			if change, ok := data.(TG.ModeChange); ok {
+				p.leftContent = strings.ToUpper(change.New)
+				p.update()
+			}
+		})
 	})
 }
 
 func (p *StatusLinePlugin) getStyledContent(tg *TG.TG) string {
-	// Call STYLE_TEXT command for each part of the content
-	leftStyled := tg.Api.Call("STYLE_TEXT", map[string]any{
-		"text":  p.leftContent,
-		"style": "status_line.text", // Use the defined text style
-	}).(string)
-
-	centerStyled := tg.Api.Call("STYLE_TEXT", map[string]any{
-		"text":  p.centerContent,
-		"style": "status_line.text", // Use the defined text style
-	}).(string)
+	// Combine the styled content
+	return p.styled(p.leftContent) + " | " + p.styled(p.centerContent) + " | " + p.styled(p.rightContent)
+}
 
-	rightStyled := tg.Api.Call("STYLE_TEXT", map[string]any{
-		"text":  p.rightContent,
+// styled runs STYLE_TEXT on a part of the content, keeping the plain text when styling fails
+func (p *StatusLinePlugin) styled(text string) string {
+	result, err := p.tg.Api.CallE("STYLE_TEXT", map[string]any{
+		"text":  text,
 		"style": "status_line.text", // Use the defined text style
-	}).(string)
-
-	// Combine the styled content
-	return leftStyled + " | " + centerStyled + " | " + rightStyled
+	})
+	if styled, ok := result.(string); ok && err == nil {
+		return styled
+	}
+	return text
 }
 
 func (p *StatusLinePlugin) update() {
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strings"
+	"sync/atomic"
 
 	TG "github.com/foroughi/tg-edit/tg"
 	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/uniseg"
 )
 
 type window struct {
@@ -17,7 +20,11 @@ type window struct {
 	content string
 	order   int
 	hidden  bool
-	style   string // Field to store the style key
+	style   string     // Field to store the style key
+	buffer  *TG.Buffer // Buffer shown in the window instead of content, if any
+	top     int        // First buffer line visible in the window
+	left    int        // First display column visible in the window
+	cursor  int        // Rune of the content the cursor is shown on while the window is active, -1 for none
 }
 
 type UIManagerPlugin struct {
@@ -26,8 +33,14 @@ type UIManagerPlugin struct {
 	activeWindow *window
 	tg           *TG.TG
 	exitFlag     bool
+	running      atomic.Bool // eventLoop is running and wakes up for posted work
+	redraw       atomic.Bool // A frame was requested since the last draw
+	session      *TG.Session // Session being replayed, nil when reading the terminal
 }
 
+// replayDone follows the last event of a replayed session
+type replayDone struct{}
+
 // Function to handle opening a window
 func (ui *UIManagerPlugin) openWindow(data any) any {
 	windowData, ok := data.(map[string]any)
@@ -39,6 +52,25 @@ func (ui *UIManagerPlugin) openWindow(data any) any {
 	title, _ := windowData["title"].(string)
 	content, _ := windowData["content"].(string)
 	style, _ := windowData["style"].(string)
+	cursor, hasCursor := windowData["cursor"].(int)
+	if !hasCursor {
+		cursor = -1
+	}
+	buffer, _ := windowData["buffer"].(*TG.Buffer)
+
+	// A buffer is shown in at most one window, focus it instead of opening another
+	if buffer != nil {
+		for _, win := range ui.windows {
+			if win.buffer == buffer {
+				ui.setActiveWindow(win)
+				ui.requestRedraw()
+				return win
+			}
+		}
+		if title == "" {
+			title = buffer.Name()
+		}
+	}
 
 	// Set default style if none is provided
 	if style == "" {
@@ -80,6 +112,15 @@ func (ui *UIManagerPlugin) openWindow(data any) any {
 		h = defaultH
 	}
 
+	// Buffer windows fill the screen above the status line unless told otherwise
+	if buffer != nil && windowData["w"] == nil && windowData["h"] == nil {
+		screenWidth, screenHeight := ui.screen.Size()
+		if screenWidth > 0 && screenHeight > 3 {
+			w = screenWidth
+			h = screenHeight - 3
+		}
+	}
+
 	order := len(ui.windows)
 
 	newWindow := &window{
@@ -92,15 +133,20 @@ func (ui *UIManagerPlugin) openWindow(data any) any {
 		order:   order,
 		hidden:  false,
 		style:   style, // Store the style key
+		buffer:  buffer,
+		cursor:  cursor,
 	}
 
 	ui.windows = append(ui.windows, newWindow)
 
 	ui.tg.Api.Call("AddMessage", "INFO", "Opening "+title)
 
-	ui.activeWindow = newWindow
+	// Windows like the status line pass focus=false to stay out of the way
+	if focus, ok := windowData["focus"].(bool); !ok || focus {
+		ui.setActiveWindow(newWindow)
+	}
 
-	ui.draw()
+	ui.requestRedraw()
 
 	return newWindow
 }
@@ -117,10 +163,10 @@ func (ui *UIManagerPlugin) closeWindow(data any) any {
 		if ui.windows[i] == windowPtr {
 			ui.windows = append(ui.windows[:i], ui.windows[i+1:]...)
 			if ui.activeWindow == windowPtr {
-				ui.activeWindow = nil
+				ui.setActiveWindow(ui.lastBufferWindow())
 			}
 			ui.tg.Api.Call("AddMessage", "INFO", "Window closed")
-			ui.draw()
+			ui.requestRedraw()
 			return nil
 		}
 	}
@@ -142,10 +188,10 @@ func (ui *UIManagerPlugin) makeWindowActive(data any) any {
 
 		if win == windowPtr {
 
-			ui.activeWindow = ui.windows[i]
-			ui.tg.Event.Dispatch("ACTIVE_WINDOW_CHANGED", data)
+			ui.setActiveWindow(ui.windows[i])
+			ui.tg.Event.Dispatch("window.activated", data)
 			ui.tg.Api.Call("AddMessage", "INFO", "Window set as active")
-			ui.draw()
+			ui.requestRedraw()
 			return nil
 		}
 	}
@@ -154,6 +200,24 @@ func (ui *UIManagerPlugin) makeWindowActive(data any) any {
 	return nil
 }
 
+// setActiveWindow focuses a window and tells the core which buffer is being edited
+func (ui *UIManagerPlugin) setActiveWindow(win *window) {
+	ui.activeWindow = win
+	if win != nil && win.buffer != nil {
+		ui.tg.Buffer.SetActive(win.buffer)
+	}
+}
+
+// lastBufferWindow returns the most recently opened window showing a buffer
+func (ui *UIManagerPlugin) lastBufferWindow() *window {
+	for i := len(ui.windows) - 1; i >= 0; i-- {
+		if ui.windows[i].buffer != nil {
+			return ui.windows[i]
+		}
+	}
+	return nil
+}
+
 // Function to get the screen size
 func (ui *UIManagerPlugin) getScreenSize(data any) any {
 	width, height := ui.screen.Size()
@@ -183,7 +247,10 @@ func (ui *UIManagerPlugin) setWindowContent(data any) any {
 	for _, win := range ui.windows {
 		if win == windowPtr { // Compare pointers directly
 			win.content = content
-			ui.draw()
+			if cursor, ok := params["cursor"].(int); ok {
+				win.cursor = cursor
+			}
+			ui.requestRedraw()
 			ui.tg.Api.Call("AddMessage", "INFO", "Window content updated")
 			return nil
 		}
@@ -217,46 +284,126 @@ func (ui *UIManagerPlugin) Init(tg *TG.TG) {
 	ui.windows = []*window{}
 	ui.activeWindow = nil
 
-	screen, err := tcell.NewScreen()
-	if err != nil {
-		log.Fatalf("Failed to create screen: %v", err)
+	if tg.Options.Replay != nil {
+		ui.session = tg.Options.Replay
+		ui.screen = tcell.NewSimulationScreen("UTF-8")
+	} else {
+		screen, err := tcell.NewScreen()
+		if err != nil {
+			log.Fatalf("Failed to create screen: %v", err)
+		}
+		ui.screen = screen
 	}
-	ui.screen = screen
 	ui.exitFlag = false
 
-	tg.Event.Subscribe("ON_Quit", func(tg *TG.TG, args any) {
+	tg.Event.Declare(TG.EventInfo{
+		Name:        "window.activated",
+		Description: "A window became the active one",
+		Payload:     "The window, as OPEN_WINDOW returned it",
+		Aliases:     []string{"ACTIVE_WINDOW_CHANGED"},
+		// Handlers run once the key or command that activated the window has finished with it
+		Queued: true,
+	})
+	tg.Event.Declare(TG.EventInfo{Name: "ui.started", Description: "The screen is ready to draw on", Aliases: []string{"ON_UI_START"}})
+	tg.Event.Declare(TG.EventInfo{
+		Name:        "ui.resized",
+		Description: "The terminal was resized, the UI dispatches it once when it starts too",
+		Payload:     "TG.ScreenSize",
+		External:    true,
+	})
+
+	tg.Event.Subscribe("app.quit", func(tg *TG.TG, args any) {
 		ui.exitFlag = true
 	})
 
+	tg.Event.Subscribe("buffer.changed", func(tg *TG.TG, args any) {
+		ui.requestRedraw()
+	})
+
+	// Styles and whatever else the windows show may come from the config
+	tg.Event.Subscribe("config.changed", func(tg *TG.TG, args any) {
+		ui.requestRedraw()
+	})
+
+	tg.Event.Subscribe("ui.resized", func(tg *TG.TG, args any) {
+		size, _ := args.(TG.ScreenSize)
+		// A replayed session sets the size of the simulated screen
+		if screen, ok := ui.screen.(tcell.SimulationScreen); ok && size.Width > 0 && size.Height > 0 {
+			screen.SetSize(size.Width, size.Height)
+		}
+		ui.screen.Sync()
+		ui.requestRedraw()
+	})
+
+	tg.Event.Subscribe("buffer.closed", func(tg *TG.TG, args any) {
+		buffer, _ := args.(*TG.Buffer)
+		for _, win := range ui.windows {
+			if win.buffer != nil && win.buffer == buffer {
+				ui.closeWindow(win)
+				break
+			}
+		}
+	})
+
 	tg.Api.RegisterCommand("Start_UI", func(tg *TG.TG, data any) {
-		defer ui.screen.Fini()
+		defer func() {
+			// What a replayed session left on the screen is its outcome
+			var text string
+			if ui.session != nil {
+				text = ui.screenText()
+			}
+			ui.screen.Fini()
+			fmt.Print(text)
+		}()
 		if err := ui.screen.Init(); err != nil {
 			log.Fatalf("Failed to initialize screen: %v", err)
 		}
 
-		tg.Event.Dispatch("ON_UI_START", nil)
+		// Windows belong to the main thread, the window commands called from other goroutines are
+		// posted, which interrupts PollEvent so eventLoop runs them
+		ui.running.Store(true)
+		tg.Jobs.SetWakeup(ui.wakeup)
+		defer func() {
+			ui.running.Store(false)
+			tg.Jobs.Stop()
+		}()
+
+		tg.Event.Dispatch("ui.started", nil)
 
+		if ui.session != nil {
+			go ui.replay(ui.session)
+		}
 		ui.eventLoop()
 	})
 
+	tg.Api.Register(TG.CommandInfo{
+		Name:        "REDRAW",
+		Description: "Draw the screen again, requests made before the next frame are drawn together",
+	}, func(tg *TG.TG, data any) any {
+		ui.requestRedraw()
+		return nil
+	})
+
+	// The window commands change what eventLoop draws, they run on the main thread like it. Called
+	// from another goroutine they are posted there and wait.
 	tg.Api.RegisterCommand("SET_WINDOW_CONTENT", func(tg *TG.TG, data any) any {
-		return ui.setWindowContent(data)
+		return tg.Jobs.OnMain(func() any { return ui.setWindowContent(data) })
 	})
 
 	tg.Api.RegisterCommand("GET_WINDOW_CONTENT", func(tg *TG.TG, data any) any {
-		return ui.getWindowContent(data)
+		return tg.Jobs.OnMain(func() any { return ui.getWindowContent(data) })
 	})
 
 	tg.Api.RegisterCommand("OPEN_WINDOW", func(tg *TG.TG, data any) any {
-		return ui.openWindow(data)
+		return tg.Jobs.OnMain(func() any { return ui.openWindow(data) })
 	})
 
 	tg.Api.RegisterCommand("CLOSE_WINDOW", func(tg *TG.TG, data any) any {
-		return ui.closeWindow(data)
+		return tg.Jobs.OnMain(func() any { return ui.closeWindow(data) })
 	})
 
 	tg.Api.RegisterCommand("ACTIVE_WINDOW", func(tg *TG.TG, data any) any {
-		return ui.makeWindowActive(data)
+		return tg.Jobs.OnMain(func() any { return ui.makeWindowActive(data) })
 	})
 
 	tg.Api.RegisterCommand("GET_SCREEN_SIZE", func(tg *TG.TG, data any) any {
@@ -301,6 +448,7 @@ func (ui *UIManagerPlugin) Init(tg *TG.TG) {
 
 func (ui *UIManagerPlugin) draw() {
 	ui.screen.Clear()
+	ui.screen.HideCursor()
 
 	// Sort windows by their order
 	orderedWindows := make([]*window, len(ui.windows))
@@ -464,19 +612,167 @@ func (ui *UIManagerPlugin) drawWindow(win *window, styleKey string) {
 		}
 	}
 
+	if win.buffer != nil {
+		ui.drawBuffer(win, contentX, contentY, contentW, contentH, tcellStyle)
+		return
+	}
+
+	if contentW <= 0 {
+		return
+	}
+
 	// Draw window content
 	contentRunes := []rune(win.content)
 	for i, r := range contentRunes {
-		cx := contentX + (i % contentW)
-		cy := contentY + (i / contentW)
-		if cy < contentY+contentH {
-			ui.screen.SetContent(cx, cy, r, nil, tcellStyle)
+		if r == '\n' {
+			continue
+		}
+		col, row := contentPosition(contentRunes, i, contentW)
+		if row < contentH {
+			ui.screen.SetContent(contentX+col, contentY+row, r, nil, tcellStyle)
+		}
+	}
+
+	if win == ui.activeWindow && win.cursor >= 0 {
+		col, row := contentPosition(contentRunes, win.cursor, contentW)
+		ui.screen.ShowCursor(contentX+col, contentY+row)
+	}
+}
+
+// contentPosition finds where a rune of window content is drawn, lines wrap at the width and at line breaks
+func contentPosition(content []rune, index, width int) (col, row int) {
+	for _, r := range content[:min(index, len(content))] {
+		if r == '\n' {
+			col, row = 0, row+1
+			continue
+		}
+		col++
+		if col == width {
+			col, row = 0, row+1
+		}
+	}
+	return col, row
+}
+
+// drawBuffer renders the buffer bound to a window, scrolling the active window so its cursor stays visible
+func (ui *UIManagerPlugin) drawBuffer(win *window, x, y, w, h int, style tcell.Style) {
+	win.buffer.SetViewHeight(h)
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	snapshot := win.buffer.Snapshot()
+	active := win == ui.activeWindow
+	cursorLine, cursorCol := win.buffer.Cursor()
+	cursorX := TG.DisplayWidth(snapshot.Line(cursorLine)[:cursorCol])
+
+	if active {
+		if cursorLine < win.top {
+			win.top = cursorLine
+		} else if cursorLine >= win.top+h {
+			win.top = cursorLine - h + 1
+		}
+		if cursorX < win.left {
+			win.left = cursorX
+		} else if cursorX >= win.left+w {
+			win.left = cursorX - w + 1
 		}
 	}
+
+	spans := ui.highlights(win, active, style)
+	for row := 0; row < h && win.top+row < snapshot.LineCount(); row++ {
+		lineStart := snapshot.LineStart(win.top + row)
+		line := snapshot.Line(win.top + row)
+		ui.drawLine(line, x, y+row, w, win.left, style, lineSpans(spans, lineStart, lineStart+len(line)))
+	}
+
+	if active {
+		ui.screen.ShowCursor(x+cursorX-win.left, y+cursorLine-win.top)
+	}
+}
+
+// span styles a byte range of a buffer, or of a line once passed to drawLine
+type span struct {
+	start int
+	end   int
+	style tcell.Style
+}
+
+// highlights returns the ranges of a buffer window drawn in another style: search matches, the
+// match under the cursor and the visual selection, later spans win
+func (ui *UIManagerPlugin) highlights(win *window, active bool, style tcell.Style) []span {
+	var spans []span
+
+	if search, ok := ui.tg.Api.Call("SEARCH_MATCHES", win.buffer).(TG.SearchMatches); ok && search.Highlight {
+		for i, match := range search.Matches {
+			matchStyle := style.Background(tcell.ColorOlive).Foreground(tcell.ColorBlack)
+			if active && i+1 == search.Current {
+				matchStyle = style.Background(tcell.ColorOrange).Foreground(tcell.ColorBlack)
+			}
+			spans = append(spans, span{match.Start, match.End, matchStyle})
+		}
+	}
+
+	if active && ui.tg.Key.Mode() == TG.ModeVisual {
+		start, end := win.buffer.Selection()
+		spans = append(spans, span{start, end, style.Reverse(true)})
+	}
+	return spans
+}
+
+// lineSpans keeps the spans touching a line, moved to be relative to its start
+func lineSpans(spans []span, lineStart, lineEnd int) []span {
+	var result []span
+	for _, s := range spans {
+		if s.end > lineStart && s.start < lineEnd {
+			result = append(result, span{s.start - lineStart, s.end - lineStart, s.style})
+		}
+	}
+	return result
+}
+
+// drawLine draws one line grapheme by grapheme, expanding tabs and skipping the first left cells.
+// Graphemes inside a span take its style.
+func (ui *UIManagerPlugin) drawLine(line string, x, y, w, left int, base tcell.Style, spans []span) {
+	col := 0
+	offset := 0
+	state := -1
+	for line != "" && col-left < w {
+		var cluster string
+		var width int
+		cluster, line, width, state = uniseg.FirstGraphemeClusterInString(line, state)
+
+		style := base
+		for _, s := range spans {
+			if offset >= s.start && offset < s.end {
+				style = s.style
+			}
+		}
+		offset += len(cluster)
+
+		if cluster == "\t" {
+			width = TG.TabWidth - col%TG.TabWidth
+			for i := 0; i < width; i++ {
+				if col+i >= left && col+i-left < w {
+					ui.screen.SetContent(x+col+i-left, y, ' ', nil, style)
+				}
+			}
+			col += width
+			continue
+		}
+
+		width = max(width, 1)
+		if col >= left && col+width-left <= w {
+			runes := []rune(cluster)
+			ui.screen.SetContent(x+col-left, y, runes[0], runes[1:], style)
+		}
+		col += width
+	}
 }
 
 func (ui *UIManagerPlugin) eventLoop() {
 	ui.screen.Clear()
+	ui.redraw.Store(true)
 
 	for {
 
@@ -484,23 +780,89 @@ func (ui *UIManagerPlugin) eventLoop() {
 			return
 		}
 
+		// However many redraws were requested while handling the last event, draw one frame
+		if ui.redraw.Swap(false) {
+			ui.draw()
+		}
+
 		ev := ui.screen.PollEvent()
 		switch ev := ev.(type) {
 		case *tcell.EventKey:
-			ui.tg.Event.Dispatch("ON_KEY", ui.getKeyString(ev))
+			ui.tg.Event.Dispatch("key.pressed", ui.getKeyString(ev))
+			ui.redraw.Store(true)
+		case *tcell.EventResize:
+			// A replayed session resizes the screen itself
+			if ui.session == nil {
+				width, height := ev.Size()
+				ui.tg.Event.Dispatch("ui.resized", TG.ScreenSize{Width: width, Height: height})
+			}
+		case *tcell.EventInterrupt:
+			switch data := ev.Data().(type) {
+			case TG.SessionRecord:
+				ui.tg.Event.Dispatch(data.Event, data.Data)
+				ui.redraw.Store(true)
+			case replayDone:
+				ui.exitFlag = true
+			}
 		}
+		ui.tg.Jobs.RunPosted()
 
-		ui.draw()
+	}
+}
 
+// replay feeds the events of a session to eventLoop as if they came from the terminal, one at a
+// time, and quits after the last one
+func (ui *UIManagerPlugin) replay(session *TG.Session) {
+	for _, record := range session.Records {
+		ui.screen.PostEventWait(tcell.NewEventInterrupt(record))
 	}
+	ui.screen.PostEventWait(tcell.NewEventInterrupt(replayDone{}))
 }
 
-func (ui *UIManagerPlugin) getKeyString(ev *tcell.EventKey) string {
-	if ev.Modifiers()&tcell.ModCtrl != 0 {
-		return "Ctrl+" + ev.Name()
+// screenText returns the text on the simulated screen, one line per row
+func (ui *UIManagerPlugin) screenText() string {
+	screen, ok := ui.screen.(tcell.SimulationScreen)
+	if !ok {
+		return ""
+	}
+	ui.screen.Show()
+	cells, width, height := screen.GetContents()
+
+	var out strings.Builder
+	for row := 0; row < height; row++ {
+		var line strings.Builder
+		for col := 0; col < width; col++ {
+			cell := cells[row*width+col]
+			if len(cell.Runes) == 0 {
+				line.WriteRune(' ')
+				continue
+			}
+			line.WriteString(string(cell.Runes))
+		}
+		out.WriteString(strings.TrimRight(line.String(), " ") + "\n")
+	}
+	return out.String()
+}
+
+// requestRedraw asks for a frame, the event loop draws once however many requests come in meanwhile
+func (ui *UIManagerPlugin) requestRedraw() {
+	if ui.redraw.Swap(true) {
+		return
+	}
+	if ui.running.Load() && !ui.tg.Jobs.OnMainThread() {
+		ui.wakeup()
 	}
-	if ev.Modifiers()&tcell.ModAlt != 0 {
-		return "Alt+" + ev.Name()
+}
+
+// wakeup interrupts PollEvent so eventLoop runs posted work and draws
+func (ui *UIManagerPlugin) wakeup() {
+	ui.screen.PostEvent(tcell.NewEventInterrupt(nil))
+}
+
+func (ui *UIManagerPlugin) getKeyString(ev *tcell.EventKey) string {
+	// Name already spells out the modifiers, e.g. "Ctrl+F" or "Alt+Rune[x]"
+	if ev.Modifiers()&(tcell.ModCtrl|tcell.ModAlt) != 0 {
+		return strings.Replace(strings.TrimSuffix(ev.Name(), "]"), "Rune[", "", 1)
 	}
 	return strings.TrimPrefix(strings.TrimSuffix(ev.Name(), "]"), "Rune[") // Default key name
 }
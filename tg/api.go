@@ -1,58 +1,458 @@
 package TG
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
 )
 
+// CommandParam describes an argument a command takes after *TG
+type CommandParam struct {
+	Name        string
+	Type        string // Go type the command accepts, filled in from the function
+	Description string
+	Optional    bool // Callers may leave it out and the command gets the zero value
+}
+
+// CommandInfo describes a registered command for help screens, completion and argument checks
+type CommandInfo struct {
+	Name        string
+	Description string
+	Params      []CommandParam
+	Returns     string       // Go type of the result, empty when the command returns nothing
+	Plugin      string       // Plugin that registered the command, empty for the core
+	Keys        []KeyBinding // Keys running the command, filled in by DescribeCommand
+}
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrBadArguments   = errors.New("bad arguments")
+	ErrCommandPanic   = errors.New("command panicked")
+	ErrStopped        = errors.New("the main thread has stopped")
+)
+
+// CallError is returned by CallE, errors.Is matches it against ErrUnknownCommand, ErrBadArguments,
+// ErrCommandPanic and ErrStopped
+type CallError struct {
+	Command string
+	Err     error
+	Detail  string // What was wrong with the arguments or what the command panicked with
+	Stack   []byte // Stack of the goroutine where the command panicked
+}
+
+func (e *CallError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Command, e.Err, e.Detail)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+type command struct {
+	info CommandInfo
+	fn   reflect.Value
+}
+
 type ApiBridge struct {
-	commands map[string]any
-	mu       sync.RWMutex
-	tg       *TG
+	commands    map[string]command
+	mu          sync.RWMutex
+	tg          *TG
+	plugin      string // Plugin whose Init is running, commands registered meanwhile belong to it
+	middleware  []namedMiddleware
+	Tracer      *Tracer  // Records recent calls for :trace
+	running     []string // Plugins of the commands being run on the main thread, innermost last, see callChain
+	runningLock sync.Mutex
+	seq         uint64
 }
 
+var (
+	tgType      = reflect.TypeOf(&TG{})
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 func NewApiBridge() *ApiBridge {
 	return &ApiBridge{
-		commands: make(map[string]any),
+		commands: make(map[string]command),
 		mu:       sync.RWMutex{},
 	}
 }
 
 func (api *ApiBridge) Load(tg *TG) {
 	api.tg = tg
+
+	tg.Config.Declare("tracesize", OptionInt, defaultTraceSize, "Number of calls :trace keeps")
+	tg.Config.Declare("traceignore", OptionList, defaultTraceIgnore, "Commands :trace does not record")
+	api.Tracer = NewTracer(traceSize(tg))
+	api.Tracer.Ignore(traceIgnore(tg))
+	tg.Event.Subscribe("config.changed", func(tg *TG, data any) {
+		changes, _ := data.([]ConfigChange)
+		for _, change := range changes {
+			if change.Key == "traceignore" {
+				api.Tracer.Ignore(traceIgnore(tg))
+			}
+		}
+	})
+	api.Use("log", LogCalls())
+	api.Use("trace", api.Tracer.Middleware())
+
+	api.Register(CommandInfo{
+		Name:        "TRACE",
+		Description: "Show the most recent calls in a trace buffer, with force clear them instead",
+		Params:      []CommandParam{{Name: "filter", Description: "Part of the command names to show, or ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		filter, _ := data.(string)
+		if args, ok := data.(ExArgs); ok {
+			if args.Bang {
+				api.Tracer.Clear()
+				tg.Api.Call("AddMessage", "INFO", "Trace cleared")
+				return nil
+			}
+			filter = args.Arg
+		}
+		return tg.Buffer.ShowScratch("[trace]", "Trace", traceText(api.Tracer.Entries(), filter))
+	})
+
+	api.Register(CommandInfo{
+		Name:        "LIST_COMMANDS",
+		Description: "List the descriptions of all commands",
+		Returns:     "[]TG.CommandInfo",
+	}, func(tg *TG, data any) any {
+		return api.ListCommands()
+	})
+
+	api.Register(CommandInfo{
+		Name:        "DESCRIBE_COMMAND",
+		Description: "Describe a command, nil when it does not exist",
+		Params:      []CommandParam{{Name: "name", Description: "Name of the command"}},
+		Returns:     "*TG.CommandInfo",
+	}, func(tg *TG, name string) any {
+		info, exists := api.DescribeCommand(name)
+		if !exists {
+			return nil
+		}
+		return &info
+	})
 }
 
+// RegisterCommand registers a command without a description, see Register
 func (api *ApiBridge) RegisterCommand(name string, fn any) {
+	api.Register(CommandInfo{Name: name}, fn)
+}
+
+// Register adds a command. fn must be a function taking *TG first and returning at most one value.
+// The parameter types and the return type of the descriptor are taken from fn, declaring more
+// parameters than fn takes or a type fn does not accept is an error and the command is not registered.
+func (api *ApiBridge) Register(info CommandInfo, fn any) error {
+	if err := describeFunc(&info, fn); err != nil {
+		err = fmt.Errorf("register %s: %w", info.Name, err)
+		log.Printf("[ERROR] %v", err)
+		return err
+	}
+
 	api.mu.Lock()
 	defer api.mu.Unlock()
-	api.commands[name] = fn
+	if info.Plugin == "" {
+		info.Plugin = api.plugin
+	}
+	api.commands[info.Name] = command{info: info, fn: reflect.ValueOf(fn)}
 
-	log.Print("registering " + name)
+	log.Print("registering " + info.Name)
+	return nil
+}
+
+// describeFunc checks the signature of a command function and fills the types of its descriptor
+func describeFunc(info *CommandInfo, fn any) error {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return fmt.Errorf("%T is not a function", fn)
+	}
+	if fnType.NumIn() == 0 || fnType.In(0) != tgType {
+		return fmt.Errorf("first parameter must be *TG")
+	}
+	if fnType.NumOut() > 1 {
+		return fmt.Errorf("returns %d values, at most one is allowed", fnType.NumOut())
+	}
+
+	params := fnType.NumIn() - 1
+	if len(info.Params) > params && !fnType.IsVariadic() {
+		return fmt.Errorf("%d parameters declared but the function takes %d", len(info.Params), params)
+	}
+	for i := range info.Params {
+		actual := paramType(fnType, i+1)
+		if declared := info.Params[i].Type; declared != "" && declared != typeName(actual) && actual.Kind() != reflect.Interface {
+			return fmt.Errorf("parameter %s declared as %s but the function takes %s", info.Params[i].Name, declared, typeName(actual))
+		}
+		if info.Params[i].Type == "" {
+			info.Params[i].Type = typeName(actual)
+		}
+	}
+	// Parameters nobody declared still show up with their type
+	for i := len(info.Params); i < params; i++ {
+		name := "data"
+		if params > 1 {
+			name = fmt.Sprintf("arg%d", i+1)
+		}
+		info.Params = append(info.Params, CommandParam{Name: name, Type: typeName(paramType(fnType, i+1)), Optional: true})
+	}
+
+	if info.Returns == "" && fnType.NumOut() == 1 {
+		info.Returns = typeName(fnType.Out(0))
+	}
+	return nil
+}
+
+// paramType is the type argument i has to be, the element type for the variadic part
+func paramType(fnType reflect.Type, i int) reflect.Type {
+	if fnType.IsVariadic() && i >= fnType.NumIn()-1 {
+		return fnType.In(fnType.NumIn() - 1).Elem()
+	}
+	return fnType.In(i)
+}
+
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		return "any"
+	}
+	return t.String()
+}
+
+// SetPlugin makes commands registered from now on belong to a plugin, the plugin manager sets it
+// around each plugin's Init
+func (api *ApiBridge) SetPlugin(name string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.plugin = name
+}
+
+// Plugin returns the plugin whose Init is running, empty outside of one
+func (api *ApiBridge) Plugin() string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.plugin
+}
+
+// Exists reports whether a command is registered
+func (api *ApiBridge) Exists(name string) bool {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	_, exists := api.commands[name]
+	return exists
 }
 
+// Names lists the registered commands in alphabetical order
+func (api *ApiBridge) Names() []string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	names := make([]string, 0, len(api.commands))
+	for name := range api.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListCommands describes every registered command in alphabetical order
+func (api *ApiBridge) ListCommands() []CommandInfo {
+	var infos []CommandInfo
+	for _, name := range api.Names() {
+		if info, exists := api.DescribeCommand(name); exists {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// DescribeCommand returns the descriptor of a command with the keys currently bound to it
+func (api *ApiBridge) DescribeCommand(name string) (CommandInfo, bool) {
+	api.mu.RLock()
+	cmd, exists := api.commands[name]
+	api.mu.RUnlock()
+	if !exists {
+		return CommandInfo{}, false
+	}
+
+	info := cmd.info
+	info.Params = append([]CommandParam{}, info.Params...)
+	if api.tg != nil {
+		info.Keys = api.tg.Key.KeysFor(name)
+	}
+	return info, true
+}
+
+// Usage formats the parameters of a command, e.g. "SEARCH pattern:any [data:any]"
+func (info CommandInfo) Usage() string {
+	parts := []string{info.Name}
+	for _, param := range info.Params {
+		part := param.Name + ":" + param.Type
+		if param.Optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Call runs a command and returns its result, failures are logged and give nil. Use CallE to tell
+// them apart from a nil result.
 func (api *ApiBridge) Call(name string, args ...any) any {
-	args = append([]any{api.tg}, args...) // Ensure the first argument is TG instance
+	result, err := api.CallE(name, args...)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		var callErr *CallError
+		if errors.As(err, &callErr) && callErr.Stack != nil {
+			log.Printf("%s", callErr.Stack)
+		}
+	}
+	return result
+}
+
+// CallE runs a command like Call but reports why it failed: the error is a *CallError wrapping
+// ErrUnknownCommand, ErrBadArguments, ErrCommandPanic or ErrStopped, or whatever a middleware refused
+// the call with
+func (api *ApiBridge) CallE(name string, args ...any) (any, error) {
+	return api.CallWithContext(context.Background(), name, args...)
+}
+
+// CallWithContext runs a command like CallE, a command with a context.Context parameter the caller
+// left out or passed nil for gets ctx
+func (api *ApiBridge) CallWithContext(ctx context.Context, name string, args ...any) (any, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	onMain := api.onMainThread()
+	api.runningLock.Lock()
+	api.seq++
+	call := &CallContext{Command: name, Args: args, Seq: api.seq, Context: ctx}
+	if chain, ok := ctx.Value(callChainKey{}).(callChain); ok {
+		call.Caller, call.Depth = chain.plugin, chain.depth
+	} else if onMain {
+		call.Caller, call.Depth = api.top()
+	}
+	api.runningLock.Unlock()
+
+	return api.chain(api.invoke)(call)
+}
+
+// callChain is the innermost command running in a chain of calls off the main thread, the context
+// of those calls carries it as the running stack does for the main thread. A call off the main thread
+// without one starts a chain of its own.
+type callChain struct {
+	plugin string
+	depth  int
+}
+
+type callChainKey struct{}
+
+// top returns the plugin of the innermost command running on the main thread and how many are
+// running, the caller holds runningLock
+func (api *ApiBridge) top() (string, int) {
+	if len(api.running) == 0 {
+		return "", 0
+	}
+	return api.running[len(api.running)-1], len(api.running)
+}
+
+// CallAsync runs a command in a background job so it does not block typing. A command taking a
+// context.Context runs on the job's goroutine and gets the job's context, see JobFromContext for
+// reporting progress. It changes buffers, windows and the like through commands and events, which
+// run on the main thread, or through Jobs.Post. Any other command runs on the main thread, the job
+// waiting for it. The calls the command makes with CallWithContext and that context are traced below
+// the command that called CallAsync.
+func (api *ApiBridge) CallAsync(name string, args ...any) *Job {
+	plugin, depth := "", 0
+	if api.onMainThread() {
+		api.runningLock.Lock()
+		plugin, depth = api.top()
+		api.runningLock.Unlock()
+	}
+
+	return api.tg.Jobs.Start(name, func(ctx context.Context) (any, error) {
+		ctx = context.WithValue(ctx, callChainKey{}, callChain{plugin: plugin, depth: depth})
+		return api.CallWithContext(ctx, name, args...)
+	})
+}
+
+// invokeOnMain runs a call on the main thread and waits for it, see JobManager.OnMain
+func (api *ApiBridge) invokeOnMain(call *CallContext) (any, error) {
+	type outcome struct {
+		result any
+		err    error
+	}
+	done, ran := api.tg.Jobs.OnMain(func() any {
+		result, err := api.invoke(call)
+		return outcome{result, err}
+	}).(outcome)
+	if !ran {
+		return nil, &CallError{Command: call.Command, Err: ErrStopped}
+	}
+	return done.result, done.err
+}
+
+// onMainThread reports whether the caller runs on the main thread, calls made while the TG is being
+// made do
+func (api *ApiBridge) onMainThread() bool {
+	return api.tg == nil || api.tg.Jobs.OnMainThread()
+}
+
+// takesContext reports whether a command has a context.Context parameter
+func takesContext(fnType reflect.Type) bool {
+	for i := 0; i < fnType.NumIn(); i++ {
+		if fnType.In(i) == contextType {
+			return true
+		}
+	}
+	return false
+}
+
+// invoke runs the command of a call after the middleware
+func (api *ApiBridge) invoke(call *CallContext) (result any, err error) {
+	name := call.Command
+	args := append([]any{api.tg}, call.Args...) // Ensure the first argument is TG instance
 
 	api.mu.RLock()
-	fn, exists := api.commands[name]
+	cmd, exists := api.commands[name]
 	api.mu.RUnlock()
 	if !exists {
-		log.Printf("[ERROR] Command not found: %s", name)
-		return nil
+		return nil, &CallError{Command: name, Err: ErrUnknownCommand}
 	}
 
-	fnValue := reflect.ValueOf(fn)
+	fnValue := cmd.fn
 	fnType := fnValue.Type()
+
+	// Only commands taking a context are written to run off the main thread, the others touch
+	// buffers, windows and the like and are run there
+	onMain := api.onMainThread()
+	if !onMain && !takesContext(fnType) {
+		return api.invokeOnMain(call)
+	}
+
+	// The running stack is the chain of calls of the main thread, calls off it keep theirs in the
+	// context the command gets
+	if _, chained := call.Context.Value(callChainKey{}).(callChain); chained || !onMain {
+		call.Context = context.WithValue(call.Context, callChainKey{}, callChain{plugin: cmd.info.Plugin, depth: call.Depth + 1})
+	}
+	if len(args) > fnType.NumIn() && !fnType.IsVariadic() {
+		return nil, &CallError{Command: name, Err: ErrBadArguments, Detail: fmt.Sprintf("takes %d arguments, got %d", fnType.NumIn()-1, len(args)-1)}
+	}
 	expectedArgs := fnType.NumIn()
 
-	log.Printf("Calling function: %s", name)
 	// Ensure provided arguments match the function's expected parameters
 	for len(args) < expectedArgs {
 		argType := fnType.In(len(args))
 		var zeroValue reflect.Value
 
-		if argType.Kind() == reflect.Ptr {
+		if argType == contextType {
+			zeroValue = reflect.ValueOf(call.Context)
+		} else if argType.Kind() == reflect.Ptr {
 			zeroValue = reflect.New(argType.Elem()) // Create a pointer to zero value
 
 		} else {
@@ -67,8 +467,10 @@ func (api *ApiBridge) Call(name string, args ...any) any {
 	in := make([]reflect.Value, len(args))
 	for i, arg := range args {
 		if arg == nil {
-			argType := fnType.In(i)
-			if argType.Kind() == reflect.Ptr {
+			argType := paramType(fnType, i)
+			if argType == contextType {
+				in[i] = reflect.ValueOf(call.Context)
+			} else if argType.Kind() == reflect.Ptr {
 				in[i] = reflect.New(argType.Elem()) // Create a valid nil pointer
 
 			} else {
@@ -79,22 +481,38 @@ func (api *ApiBridge) Call(name string, args ...any) any {
 			in[i] = reflect.ValueOf(arg)
 
 		}
+		// Catch mismatches here instead of letting reflect panic
+		if want := paramType(fnType, i); !in[i].Type().AssignableTo(want) {
+			return nil, &CallError{Command: name, Err: ErrBadArguments, Detail: fmt.Sprintf("argument %d is %s, want %s", i, in[i].Type(), typeName(want))}
+		}
+	}
+
+	// Calls the command makes belong to its plugin
+	if onMain {
+		api.runningLock.Lock()
+		api.running = append(api.running, cmd.info.Plugin)
+		api.runningLock.Unlock()
 	}
 
 	defer func() {
+		if onMain {
+			api.runningLock.Lock()
+			api.running = api.running[:len(api.running)-1]
+			api.runningLock.Unlock()
+		}
+
 		if r := recover(); r != nil {
-			log.Printf("[ERROR] Panic in %s: %v", name, r)
+			result, err = nil, &CallError{Command: name, Err: ErrCommandPanic, Detail: fmt.Sprint(r), Stack: debug.Stack()}
 		}
 	}()
 
 	// Call function
 	out := fnValue.Call(in)
-	log.Printf("Function %s executed successfully", name)
 
 	if len(out) > 0 {
 
-		return out[0].Interface()
+		return out[0].Interface(), nil
 	}
 
-	return nil
+	return nil, nil
 }
@@ -0,0 +1,469 @@
+package TG
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type pieceSource int
+
+const (
+	sourceOriginal pieceSource = iota
+	sourceAdd
+)
+
+// A piece points into either the original text or the append-only add buffer
+type piece struct {
+	source pieceSource
+	start  int
+	length int
+}
+
+// BufferChange describes a single edit applied to a buffer
+type BufferChange struct {
+	Buffer   *Buffer
+	Offset   int
+	Deleted  string
+	Inserted string
+	Version  int
+}
+
+// Buffer is a piece table holding the text being edited
+type Buffer struct {
+	ID int
+
+	name     string
+	path     string // File backing the buffer, empty for scratch buffers
+	original string
+	add      []byte
+	pieces   []piece
+	length   int
+	lines    []int  // Byte offsets of every line start, nil when stale
+	cache    string // Assembled text, valid while cached is true
+	cached   bool
+	version  int
+	saved    int    // Version last loaded from or written to disk
+	point    int    // Byte offset of the cursor, where typed text is inserted
+	want     int    // Display column vertical motions aim for, -1 when unset
+	anchor   int    // Byte offset where the visual selection started
+	visual   [2]int // First and last byte of the last visual selection, the '< and '> marks
+	height   int    // Lines the window showing the buffer has room for, 0 until one is drawn
+	file     fileState
+	mu       sync.RWMutex
+	onChange func(BufferChange)
+}
+
+// Snapshot is an immutable view of a buffer at a given version
+type Snapshot struct {
+	Version int
+	text    string
+	lines   []int
+}
+
+func NewBuffer(name string, content string) *Buffer {
+	b := &Buffer{
+		name:     name,
+		original: content,
+		want:     -1,
+	}
+	if len(content) > 0 {
+		b.pieces = []piece{{source: sourceOriginal, start: 0, length: len(content)}}
+	}
+	b.length = len(content)
+	return b
+}
+
+func (b *Buffer) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.length
+}
+
+func (b *Buffer) Version() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.version
+}
+
+// Modified reports whether the buffer has edits that are not on disk
+func (b *Buffer) Modified() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.version != b.saved
+}
+
+// SetViewHeight records how many lines the window showing the buffer has room for, the UI sets it
+// when it draws the buffer so the page motions move by a window
+func (b *Buffer) SetViewHeight(lines int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.height = lines
+}
+
+// ViewHeight returns what SetViewHeight recorded, 0 when no window showed the buffer yet
+func (b *Buffer) ViewHeight() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.height
+}
+
+// Name returns the name shown for the buffer, the base name of its file once it has one
+func (b *Buffer) Name() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.name
+}
+
+// Path returns the absolute path of the file backing the buffer, empty for scratch buffers.
+// Writing the buffer to a new file changes it, possibly from another goroutine.
+func (b *Buffer) Path() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.path
+}
+
+func (b *Buffer) RuneCount() int {
+	return utf8.RuneCountInString(b.String())
+}
+
+func (b *Buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.text()
+}
+
+// Slice returns the text between two byte offsets
+func (b *Buffer) Slice(start, end int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	start, end = clamp(start, 0, b.length), clamp(end, 0, b.length)
+	if start >= end {
+		return ""
+	}
+	return b.text()[start:end]
+}
+
+func (b *Buffer) Insert(offset int, text string) error {
+	return b.Replace(offset, 0, text)
+}
+
+func (b *Buffer) Delete(offset, length int) error {
+	return b.Replace(offset, length, "")
+}
+
+// Replace deletes length bytes at offset and inserts text in their place as a single change
+func (b *Buffer) Replace(offset, length int, text string) error {
+	b.mu.Lock()
+	if offset < 0 || length < 0 || offset+length > b.length {
+		b.mu.Unlock()
+		return fmt.Errorf("range %d+%d out of bounds for buffer of length %d", offset, length, b.length)
+	}
+	if length == 0 && text == "" {
+		b.mu.Unlock()
+		return nil
+	}
+
+	deleted := ""
+	if length > 0 {
+		deleted = b.text()[offset : offset+length]
+		b.removePieces(offset, length)
+	}
+	if text != "" {
+		b.insertPiece(offset, text)
+	}
+
+	b.length += len(text) - length
+	b.point = shiftOffset(b.point, offset, length, len(text))
+	b.anchor = shiftOffset(b.anchor, offset, length, len(text))
+	b.visual[0] = shiftOffset(b.visual[0], offset, length, len(text))
+	b.visual[1] = shiftOffset(b.visual[1], offset, length, len(text))
+	b.want = -1
+	b.lines = nil
+	b.cached = false
+	b.version++
+
+	change := BufferChange{
+		Buffer:   b,
+		Offset:   offset,
+		Deleted:  deleted,
+		Inserted: text,
+		Version:  b.version,
+	}
+	onChange := b.onChange
+	b.mu.Unlock()
+
+	if onChange != nil {
+		onChange(change)
+	}
+	return nil
+}
+
+// Point returns the byte offset of the cursor
+func (b *Buffer) Point() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.point
+}
+
+// InsertAt inserts text at a line and byte column
+func (b *Buffer) InsertAt(line, col int, text string) error {
+	return b.Insert(b.PositionToOffset(line, col), text)
+}
+
+// DeleteLines removes count whole lines starting at line
+func (b *Buffer) DeleteLines(line, count int) error {
+	start := b.LineStart(line)
+	end := b.LineStart(line + count)
+	if line+count >= b.LineCount() {
+		end = b.Len()
+		// Take the newline before the first deleted line so no empty line is left behind
+		if start > 0 {
+			start--
+		}
+	}
+	return b.Delete(start, end-start)
+}
+
+func (b *Buffer) LineCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.lineIndex())
+}
+
+// Line returns the content of a line without its trailing newline
+func (b *Buffer) Line(line int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := b.lineIndex()
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return lineAt(b.text(), lines, line)
+}
+
+func (b *Buffer) LineStart(line int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := b.lineIndex()
+	if line < 0 {
+		return 0
+	}
+	if line >= len(lines) {
+		return b.length
+	}
+	return lines[line]
+}
+
+// LineEnd returns the offset of the newline ending a line, or the buffer length for the last line
+func (b *Buffer) LineEnd(line int) int {
+	return b.LineStart(line) + len(b.Line(line))
+}
+
+// OffsetToPosition converts a byte offset to a line and byte column
+func (b *Buffer) OffsetToPosition(offset int) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offset = clamp(offset, 0, b.length)
+	lines := b.lineIndex()
+	lo, hi := 0, len(lines)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if lines[mid] <= offset {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, offset - lines[lo]
+}
+
+// PositionToOffset converts a line and byte column to a byte offset, clamping both to the buffer
+func (b *Buffer) PositionToOffset(line, col int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := b.lineIndex()
+	line = clamp(line, 0, len(lines)-1)
+	return lines[line] + clamp(col, 0, len(lineAt(b.text(), lines, line)))
+}
+
+func (b *Buffer) RuneToOffset(runeIndex int) int {
+	text := b.String()
+	offset := 0
+	for i := 0; i < runeIndex && offset < len(text); i++ {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return offset
+}
+
+func (b *Buffer) OffsetToRune(offset int) int {
+	text := b.String()
+	return utf8.RuneCountInString(text[:clamp(offset, 0, len(text))])
+}
+
+func (b *Buffer) Snapshot() *Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := make([]int, len(b.lineIndex()))
+	copy(lines, b.lines)
+	return &Snapshot{
+		Version: b.version,
+		text:    b.text(),
+		lines:   lines,
+	}
+}
+
+func (s *Snapshot) String() string {
+	return s.text
+}
+
+func (s *Snapshot) Len() int {
+	return len(s.text)
+}
+
+func (s *Snapshot) LineCount() int {
+	return len(s.lines)
+}
+
+func (s *Snapshot) Line(line int) string {
+	if line < 0 || line >= len(s.lines) {
+		return ""
+	}
+	return lineAt(s.text, s.lines, line)
+}
+
+func (s *Snapshot) LineStart(line int) int {
+	if line < 0 {
+		return 0
+	}
+	if line >= len(s.lines) {
+		return len(s.text)
+	}
+	return s.lines[line]
+}
+
+// text assembles the buffer content, caller must hold the lock
+func (b *Buffer) text() string {
+	if b.cached {
+		return b.cache
+	}
+	var sb strings.Builder
+	sb.Grow(b.length)
+	for _, p := range b.pieces {
+		sb.WriteString(b.pieceText(p))
+	}
+	b.cache = sb.String()
+	b.cached = true
+	return b.cache
+}
+
+func (b *Buffer) pieceText(p piece) string {
+	if p.source == sourceOriginal {
+		return b.original[p.start : p.start+p.length]
+	}
+	return string(b.add[p.start : p.start+p.length])
+}
+
+// insertPiece splits the piece containing offset and places a new add piece between the halves
+func (b *Buffer) insertPiece(offset int, text string) {
+	added := piece{source: sourceAdd, start: len(b.add), length: len(text)}
+	b.add = append(b.add, text...)
+
+	pos := 0
+	for i, p := range b.pieces {
+		// Typing right after the previous insertion just grows its piece
+		if offset == pos+p.length && p.source == sourceAdd && p.start+p.length == added.start {
+			b.pieces[i].length += added.length
+			return
+		}
+		if offset == pos {
+			b.pieces = append(b.pieces[:i], append([]piece{added}, b.pieces[i:]...)...)
+			return
+		}
+		if offset < pos+p.length {
+			split := offset - pos
+			left := piece{source: p.source, start: p.start, length: split}
+			right := piece{source: p.source, start: p.start + split, length: p.length - split}
+			b.pieces = append(b.pieces[:i], append([]piece{left, added, right}, b.pieces[i+1:]...)...)
+			return
+		}
+		pos += p.length
+	}
+	b.pieces = append(b.pieces, added)
+}
+
+// removePieces trims every piece overlapping the deleted range
+func (b *Buffer) removePieces(offset, length int) {
+	end := offset + length
+	result := make([]piece, 0, len(b.pieces)+1)
+	pos := 0
+	for _, p := range b.pieces {
+		pStart, pEnd := pos, pos+p.length
+		pos = pEnd
+		if pEnd <= offset || pStart >= end {
+			result = append(result, p)
+			continue
+		}
+		if pStart < offset {
+			result = append(result, piece{source: p.source, start: p.start, length: offset - pStart})
+		}
+		if pEnd > end {
+			cut := end - pStart
+			result = append(result, piece{source: p.source, start: p.start + cut, length: pEnd - end})
+		}
+	}
+	b.pieces = result
+}
+
+// lineIndex rebuilds the line start table when an edit has invalidated it, caller must hold the lock
+func (b *Buffer) lineIndex() []int {
+	if b.lines != nil {
+		return b.lines
+	}
+	lines := []int{0}
+	pos := 0
+	for _, p := range b.pieces {
+		text := b.pieceText(p)
+		for i := 0; i < len(text); i++ {
+			if text[i] == '\n' {
+				lines = append(lines, pos+i+1)
+			}
+		}
+		pos += p.length
+	}
+	b.lines = lines
+	return lines
+}
+
+// shiftOffset moves an offset so it keeps pointing at the same text after an edit
+func shiftOffset(pos, offset, deleted, inserted int) int {
+	switch {
+	case pos < offset:
+		return pos
+	case pos >= offset+deleted:
+		return pos - deleted + inserted
+	default:
+		return offset + inserted
+	}
+}
+
+func lineAt(text string, lines []int, line int) string {
+	start := lines[line]
+	end := len(text)
+	if line+1 < len(lines) {
+		end = lines[line+1] - 1
+	}
+	return text[start:end]
+}
+
+func clamp(value, lo, hi int) int {
+	if value < lo {
+		return lo
+	}
+	if value > hi {
+		return hi
+	}
+	return value
+}
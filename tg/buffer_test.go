@@ -0,0 +1,190 @@
+package TG
+
+import (
+	"strings"
+	"testing"
+)
+
+type bufferEdit struct {
+	offset int
+	delete int
+	insert string
+}
+
+func TestBufferEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		edits   []bufferEdit
+		want    string
+		pieces  int
+		err     bool
+	}{
+		{
+			name:    "insert into an empty buffer",
+			content: "",
+			edits:   []bufferEdit{{offset: 0, insert: "abc"}},
+			want:    "abc",
+			pieces:  1,
+		},
+		{
+			name:    "insert splits the original piece",
+			content: "hello world",
+			edits:   []bufferEdit{{offset: 5, insert: ","}},
+			want:    "hello, world",
+			pieces:  3,
+		},
+		{
+			name:    "typing after an insertion grows its piece",
+			content: "ad",
+			edits:   []bufferEdit{{offset: 1, insert: "b"}, {offset: 2, insert: "c"}},
+			want:    "abcd",
+			pieces:  3,
+		},
+		{
+			name:    "insert at a piece boundary adds a piece between",
+			content: "ac",
+			edits:   []bufferEdit{{offset: 1, insert: "X"}, {offset: 0, insert: "Y"}, {offset: 2, insert: "b"}},
+			want:    "YabXc",
+			pieces:  5,
+		},
+		{
+			name:    "insert at the end",
+			content: "abc",
+			edits:   []bufferEdit{{offset: 3, insert: "d"}, {offset: 4, insert: "e"}},
+			want:    "abcde",
+			pieces:  2,
+		},
+		{
+			name:    "delete inside one piece",
+			content: "abcdef",
+			edits:   []bufferEdit{{offset: 2, delete: 2}},
+			want:    "abef",
+			pieces:  2,
+		},
+		{
+			name:    "delete a whole piece",
+			content: "ac",
+			edits:   []bufferEdit{{offset: 1, insert: "XYZ"}, {offset: 1, delete: 3}},
+			want:    "ac",
+			pieces:  2,
+		},
+		{
+			name:    "delete across piece boundaries",
+			content: "abcdef",
+			edits:   []bufferEdit{{offset: 3, insert: "123"}, {offset: 2, delete: 5}},
+			want:    "abef",
+			pieces:  2,
+		},
+		{
+			name:    "delete spanning several pieces",
+			content: "0123456789",
+			edits: []bufferEdit{
+				{offset: 2, insert: "a"},
+				{offset: 5, insert: "b"},
+				{offset: 8, insert: "c"},
+				{offset: 1, delete: 10},
+			},
+			want:   "089",
+			pieces: 2,
+		},
+		{
+			name:    "delete everything",
+			content: "abc",
+			edits:   []bufferEdit{{offset: 1, insert: "X"}, {offset: 0, delete: 4}},
+			want:    "",
+			pieces:  0,
+		},
+		{
+			name:    "replace across piece boundaries",
+			content: "one two",
+			edits:   []bufferEdit{{offset: 3, insert: "-"}, {offset: 2, delete: 3, insert: "_"}},
+			want:    "on_two",
+			pieces:  3,
+		},
+		{
+			name:    "delete past the end",
+			content: "abc",
+			edits:   []bufferEdit{{offset: 2, delete: 2}},
+			err:     true,
+		},
+		{
+			name:    "insert before the start",
+			content: "abc",
+			edits:   []bufferEdit{{offset: -1, insert: "x"}},
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBuffer("test", test.content)
+			var err error
+			for _, edit := range test.edits {
+				if err = b.Replace(edit.offset, edit.delete, edit.insert); err != nil {
+					break
+				}
+			}
+			if test.err {
+				if err == nil {
+					t.Errorf("want an error, got %q", b.String())
+				}
+				if got := b.String(); got != test.content {
+					t.Errorf("failed edit changed the text to %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != test.want {
+				t.Errorf("text = %q, want %q", got, test.want)
+			}
+			if got := b.Len(); got != len(test.want) {
+				t.Errorf("Len() = %d, want %d", got, len(test.want))
+			}
+			if len(b.pieces) != test.pieces {
+				t.Errorf("got %d pieces %+v, want %d", len(b.pieces), b.pieces, test.pieces)
+			}
+		})
+	}
+}
+
+// Lines stay right when newlines come from different pieces
+func TestBufferLines(t *testing.T) {
+	tests := []struct {
+		content string
+		edits   []bufferEdit
+		want    []string
+	}{
+		{content: "", want: []string{""}},
+		{content: "a\nb", want: []string{"a", "b"}},
+		{content: "a\nb\n", want: []string{"a", "b", ""}},
+		{content: "ab", edits: []bufferEdit{{offset: 1, insert: "\n"}}, want: []string{"a", "b"}},
+		{content: "a\nb\nc", edits: []bufferEdit{{offset: 1, delete: 3}}, want: []string{"ac"}},
+		{
+			content: "one\nthree",
+			edits:   []bufferEdit{{offset: 4, insert: "two\n"}, {offset: 2, delete: 4, insert: "e\ntw"}},
+			want:    []string{"one", "two", "three"},
+		},
+	}
+
+	for _, test := range tests {
+		b := NewBuffer("test", test.content)
+		for _, edit := range test.edits {
+			if err := b.Replace(edit.offset, edit.delete, edit.insert); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		for line := 0; line < b.LineCount(); line++ {
+			got = append(got, b.Line(line))
+			if start := b.LineStart(line); line > 0 && b.String()[start-1] != '\n' {
+				t.Errorf("%q: line %d starts at %d, not after a newline", b.String(), line, start)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%q after %+v: lines %q, want %q", test.content, test.edits, got, test.want)
+		}
+	}
+}
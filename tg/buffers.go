@@ -0,0 +1,357 @@
+package TG
+
+import (
+	"log"
+	"sync"
+	"unicode/utf8"
+)
+
+type BufferManager struct {
+	buffers   map[int]*Buffer
+	active    *Buffer // Buffer of the focused window, set by the UI
+	lock      sync.RWMutex
+	counter   int
+	registers map[string]Register // Yanked and deleted text, the unnamed register is `"`
+	tg        *TG
+}
+
+func NewBufferManager() *BufferManager {
+	return &BufferManager{
+		buffers:   make(map[int]*Buffer),
+		registers: make(map[string]Register),
+	}
+}
+
+func (bm *BufferManager) Load(tg *TG) {
+	bm.tg = tg
+
+	tg.Event.Declare(EventInfo{Name: "buffer.created", Description: "A buffer was created", Payload: "*TG.Buffer", Aliases: []string{"BUFFER_CREATED"}})
+	tg.Event.Declare(EventInfo{Name: "buffer.changed", Description: "Text was inserted or deleted", Payload: "TG.BufferChange", Aliases: []string{"BUFFER_CHANGED"}})
+	tg.Event.Declare(EventInfo{Name: "buffer.closed", Description: "A buffer was closed", Payload: "*TG.Buffer", Aliases: []string{"BUFFER_CLOSED"}})
+	tg.Event.Declare(EventInfo{Name: "buffer.loaded", Description: "A buffer was read from its file", Payload: "*TG.Buffer", Aliases: []string{"BUFFER_LOADED"}})
+	tg.Event.Declare(EventInfo{Name: "buffer.written", Description: "A buffer was written to its file", Payload: "*TG.Buffer", Aliases: []string{"BUFFER_WRITTEN"}})
+
+	bm.registerMotions()
+	bm.registerOperators()
+	bm.registerTextObjects()
+
+	tg.Api.Register(CommandInfo{Name: "NEW_BUFFER", Description: "Create a buffer from a map with \"name\" and \"content\""}, func(tg *TG, data any) any {
+		params, _ := data.(map[string]any)
+		name, _ := params["name"].(string)
+		content, _ := params["content"].(string)
+		return bm.Create(name, content)
+	})
+
+	tg.Api.Register(CommandInfo{Name: "GET_BUFFER", Description: "Return a buffer by id or pointer, the active buffer by default"}, func(tg *TG, data any) any {
+		return bm.resolve(data)
+	})
+
+	tg.Api.Register(CommandInfo{Name: "LIST_BUFFERS", Description: "Return all open buffers"}, func(tg *TG, data any) any {
+		return bm.List()
+	})
+
+	tg.Api.Register(CommandInfo{Name: "CLOSE_BUFFER", Description: "Close a buffer, the active buffer by default"}, func(tg *TG, data any) any {
+		if buffer := bm.resolve(data); buffer != nil {
+			bm.Close(buffer)
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "BUFFER_CONTENT", Description: "Return the text of a buffer, the active buffer by default"}, func(tg *TG, data any) any {
+		if buffer := bm.resolve(data); buffer != nil {
+			return buffer.String()
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "EDIT",
+		Description: "Open a file in a new window, with force and no file reload the active buffer",
+		Params:      []CommandParam{{Name: "file", Description: "Path, a map with \"buffer\", \"path\" and \"force\", or ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		buffer, path, force := bm.fileParams(data)
+		// Like ":e!", forcing without a file throws away the changes of the active buffer
+		if path == "" && force && buffer != nil {
+			return tg.Api.Call("RELOAD", true)
+		}
+		if path == "" {
+			bm.report("ERROR", "Usage: EDIT <file>")
+			return nil
+		}
+		buffer, err := bm.Open(path)
+		if err != nil {
+			bm.report("ERROR", err.Error())
+			return nil
+		}
+		tg.Api.Call("OPEN_WINDOW", map[string]any{
+			"title":  buffer.Name(),
+			"buffer": buffer,
+		})
+		return buffer
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "WRITE",
+		Description: "Write a buffer to its file or to a given path",
+		Params:      []CommandParam{{Name: "file", Description: "Path, a map with \"buffer\", \"path\" and \"force\", or ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		buffer, path, force := bm.fileParams(data)
+		if buffer == nil {
+			bm.report("ERROR", "No buffer to write")
+			return nil
+		}
+		if err := bm.Write(buffer, path, force); err != nil {
+			bm.report("ERROR", err.Error())
+			return nil
+		}
+		bm.report("INFO", "Written "+buffer.Path())
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "WRITE_AS",
+		Description: "Write a buffer to a new path and make it the buffer's file",
+		Params:      []CommandParam{{Name: "file", Description: "Path, a map with \"buffer\", \"path\" and \"force\", or ExArgs"}},
+	}, func(tg *TG, data any) any {
+		buffer, path, force := bm.fileParams(data)
+		if buffer == nil || path == "" {
+			bm.report("ERROR", "Usage: WRITE_AS <file>")
+			return nil
+		}
+		if err := bm.Write(buffer, path, force); err != nil {
+			bm.report("ERROR", err.Error())
+			return nil
+		}
+		bm.report("INFO", "Written "+buffer.Path())
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "RELOAD",
+		Description: "Read the file of the active buffer again, with force even when it has changes",
+		Params:      []CommandParam{{Name: "force", Optional: true}},
+	}, func(tg *TG, data any) any {
+		buffer, _, force := bm.fileParams(data)
+		if buffer == nil {
+			bm.report("ERROR", "No buffer to reload")
+			return nil
+		}
+		if err := bm.Reload(buffer, force); err != nil {
+			bm.report("ERROR", err.Error())
+			return nil
+		}
+		bm.report("INFO", "Reloaded "+buffer.Path())
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "CHANGED_ON_DISK", Description: "Report whether the file of a buffer changed since it was read or written"}, func(tg *TG, data any) any {
+		buffer, _, _ := bm.fileParams(data)
+		return buffer != nil && bm.ChangedOnDisk(buffer)
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "INSERT_TEXT",
+		Description: "Insert text at the cursor of the active buffer",
+		Params:      []CommandParam{{Name: "text"}},
+	}, func(tg *TG, data any) any {
+		text, _ := data.(string)
+		if buffer := bm.Active(); buffer != nil && text != "" {
+			buffer.Insert(buffer.Point(), text)
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "DELETE_BACKWARD", Description: "Delete the character before the cursor"}, func(tg *TG, data any) any {
+		if buffer := bm.Active(); buffer != nil {
+			point := buffer.Point()
+			if point > 0 {
+				_, size := utf8.DecodeLastRuneInString(buffer.Slice(0, point))
+				buffer.Delete(point-size, size)
+			}
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "DELETE_FORWARD", Description: "Delete the character under the cursor"}, func(tg *TG, data any) any {
+		if buffer := bm.Active(); buffer != nil {
+			point := buffer.Point()
+			if point < buffer.Len() {
+				_, size := utf8.DecodeRuneInString(buffer.Slice(point, buffer.Len()))
+				buffer.Delete(point, size)
+			}
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "BUFFER_INSERT", Description: "Insert text into a buffer, takes a map with \"buffer\", \"offset\" and \"text\""}, func(tg *TG, data any) any {
+		params, ok := data.(map[string]any)
+		if !ok {
+			log.Printf("[ERROR] Invalid data format for BUFFER_INSERT")
+			return nil
+		}
+		buffer := bm.resolve(params["buffer"])
+		offset, _ := params["offset"].(int)
+		text, _ := params["text"].(string)
+		if buffer == nil {
+			return nil
+		}
+		if err := buffer.Insert(offset, text); err != nil {
+			log.Printf("[ERROR] BUFFER_INSERT: %v", err)
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "BUFFER_DELETE", Description: "Delete from a buffer, takes a map with \"buffer\", \"offset\" and \"length\""}, func(tg *TG, data any) any {
+		params, ok := data.(map[string]any)
+		if !ok {
+			log.Printf("[ERROR] Invalid data format for BUFFER_DELETE")
+			return nil
+		}
+		buffer := bm.resolve(params["buffer"])
+		offset, _ := params["offset"].(int)
+		length, _ := params["length"].(int)
+		if buffer == nil {
+			return nil
+		}
+		if err := buffer.Delete(offset, length); err != nil {
+			log.Printf("[ERROR] BUFFER_DELETE: %v", err)
+		}
+		return nil
+	})
+}
+
+// Create registers a new buffer and starts forwarding its edits as buffer.changed events
+func (bm *BufferManager) Create(name string, content string) *Buffer {
+	return bm.add(NewBuffer(name, content))
+}
+
+// add registers a new buffer and dispatches buffer.created, anything handlers read from it, like
+// its Path, has to be set before
+func (bm *BufferManager) add(buffer *Buffer) *Buffer {
+	bm.lock.Lock()
+	bm.counter++
+	buffer.ID = bm.counter
+	bm.buffers[buffer.ID] = buffer
+	bm.lock.Unlock()
+
+	buffer.mu.Lock()
+	buffer.onChange = func(change BufferChange) {
+		bm.tg.Event.Dispatch("buffer.changed", change)
+	}
+	buffer.mu.Unlock()
+
+	bm.tg.Event.Dispatch("buffer.created", buffer)
+	return buffer
+}
+
+// ShowScratch opens text in a window on a new buffer, closing the previous buffer of the same name
+// so help and trace output does not pile up
+func (bm *BufferManager) ShowScratch(name string, title string, text string) *Buffer {
+	for _, buffer := range bm.List() {
+		if buffer.Name() == name && buffer.Path() == "" {
+			bm.Close(buffer)
+		}
+	}
+	buffer := bm.Create(name, text)
+	bm.tg.Api.Call("OPEN_WINDOW", map[string]any{
+		"title":  title,
+		"buffer": buffer,
+	})
+	return buffer
+}
+
+func (bm *BufferManager) SetActive(buffer *Buffer) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	bm.active = buffer
+}
+
+func (bm *BufferManager) Active() *Buffer {
+	bm.lock.RLock()
+	defer bm.lock.RUnlock()
+	return bm.active
+}
+
+func (bm *BufferManager) Get(id int) (*Buffer, bool) {
+	bm.lock.RLock()
+	defer bm.lock.RUnlock()
+	buffer, exists := bm.buffers[id]
+	return buffer, exists
+}
+
+func (bm *BufferManager) List() []*Buffer {
+	bm.lock.RLock()
+	defer bm.lock.RUnlock()
+	buffers := make([]*Buffer, 0, len(bm.buffers))
+	for id := 1; id <= bm.counter; id++ {
+		if buffer, exists := bm.buffers[id]; exists {
+			buffers = append(buffers, buffer)
+		}
+	}
+	return buffers
+}
+
+func (bm *BufferManager) Close(buffer *Buffer) {
+	bm.lock.Lock()
+	delete(bm.buffers, buffer.ID)
+	if bm.active == buffer {
+		bm.active = nil
+	}
+	bm.lock.Unlock()
+
+	buffer.mu.Lock()
+	buffer.onChange = nil
+	buffer.mu.Unlock()
+
+	bm.tg.Event.Dispatch("buffer.closed", buffer)
+}
+
+// resolve accepts either a buffer pointer or a buffer id
+func (bm *BufferManager) resolve(data any) *Buffer {
+	switch value := data.(type) {
+	case *Buffer:
+		return value
+	case int:
+		if buffer, exists := bm.Get(value); exists {
+			return buffer
+		}
+	}
+	log.Printf("[ERROR] Buffer not found: %v", data)
+	return nil
+}
+
+// fileParams reads the arguments of the file commands: a path string, a force flag, a map with
+// "buffer", "path" and "force" keys, or ExArgs with the path as argument and ! forcing. The buffer
+// defaults to the active one.
+func (bm *BufferManager) fileParams(data any) (*Buffer, string, bool) {
+	buffer := bm.Active()
+	path := ""
+	force := false
+
+	switch value := data.(type) {
+	case string:
+		path = value
+	case bool:
+		force = value
+	case *Buffer:
+		buffer = value
+	case map[string]any:
+		if b, ok := value["buffer"]; ok {
+			buffer = bm.resolve(b)
+		}
+		path, _ = value["path"].(string)
+		force, _ = value["force"].(bool)
+	case ExArgs:
+		if value.Buffer != nil {
+			buffer = value.Buffer
+		}
+		path = value.Arg
+		force = value.Bang
+	}
+	return buffer, path, force
+}
+
+// report surfaces a message to the user through the message center
+func (bm *BufferManager) report(level string, message string) {
+	bm.tg.Api.Call("AddMessage", level, message)
+}
@@ -1,121 +1,588 @@
 package TG
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Config layers from the lowest precedence to the highest, a value set in a layer hides the values
+// the layers below it have for the same key
+const (
+	ConfigDefault = "default" // Built into the editor
+	ConfigSystem  = "system"  // tg-edit/config in $XDG_CONFIG_DIRS, /etc/xdg by default
+	ConfigUser    = "user"    // tg-edit/config in $XDG_CONFIG_HOME, ~/.config by default
+	ConfigProject = "project" // The nearest .tg-edit above the file being edited
+	ConfigFile    = "file"    // The file given with --config
+	ConfigCLI     = "cli"     // --set key=value on the command line
+	ConfigSet     = "set"     // Changed while the editor runs, Save writes them to the user config
+)
+
+// Types of config options, see Declare
+const (
+	OptionString   = "string"
+	OptionInt      = "int"
+	OptionBool     = "bool"
+	OptionDuration = "duration"
+	OptionList     = "list"
+	OptionSection  = "section" // Any key below it, "style" allows "style.default.text.fg", its owner checks them
+)
+
+// ConfigOption is a config key the core or a plugin reads
+type ConfigOption struct {
+	Key         string
+	Type        string
+	Default     any // Nil when the option has none
+	Description string
+}
+
+// Name of the project config file looked for in the directory of the edited file and above it
+const projectConfigName = ".tg-edit"
+
+// ConfigLayer is the values one source of configuration provides
+type ConfigLayer struct {
+	Name   string
+	Path   string // File the values were read from, empty for layers without one
+	values map[string]any
+}
+
 type ConfigManager struct {
-	configs map[string]string
-	lock    sync.RWMutex
-	changed bool // Track whether any changes have been made
+	options  Options
+	layers   []*ConfigLayer // Lowest precedence first
+	declared map[string]ConfigOption
+	defaults map[string]any // Values of the default layer, the defaults of the declared options
+	lock     sync.RWMutex
+	changed  bool  // Track whether any changes have been made
+	loadErr  error // What Load returned last
+	tg       *TG   // Set by Watch, config.changed is only dispatched from then on
+	watcher  *fileWatcher
 }
 
-func NewConfigManager() *ConfigManager {
+func NewConfigManager(options Options) *ConfigManager {
 	return &ConfigManager{
-		configs: make(map[string]string),
+		options:  options,
+		declared: make(map[string]ConfigOption),
+		defaults: make(map[string]any),
 	}
 }
 
+// Load reads every layer, files that do not exist are skipped. The lines of a file that cannot be
+// read are skipped too, and a file that cannot be read when loading again keeps the values it had.
 func (cm *ConfigManager) Load() error {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
-	// Check if config file exists
-	if _, err := os.Stat("config"); os.IsNotExist(err) {
-		// If the config file does not exist, create it and write defaults
-		if err := cm.createDefaultConfig(); err != nil {
-			return err
+	layers := []*ConfigLayer{{Name: ConfigDefault, values: cm.defaults}}
+
+	cm.lock.RLock()
+	previous := cm.layers
+	cm.lock.RUnlock()
+
+	var errs []error
+	addFile := func(name, path string) {
+		if path == "" {
+			return
+		}
+		values, err := readConfig(path)
+		// Only the file asked for with --config has to exist
+		if errors.Is(err, fs.ErrNotExist) && name != ConfigFile {
+			return
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		// Lines that cannot be read are skipped, a file that cannot be read at all keeps its values
+		if values == nil {
+			for _, layer := range previous {
+				if layer.Name == name && layer.Path == path {
+					layers = append(layers, layer)
+				}
+			}
+			return
 		}
+		layers = append(layers, &ConfigLayer{Name: name, Path: path, values: values})
 	}
-	file, err := os.Open("config")
-	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+
+	// The first directory in $XDG_CONFIG_DIRS is the most important one
+	systemPaths := systemConfigPaths()
+	for i := len(systemPaths) - 1; i >= 0; i-- {
+		addFile(ConfigSystem, systemPaths[i])
 	}
-	defer file.Close()
+	addFile(ConfigUser, userConfigPath())
+	addFile(ConfigProject, findProjectConfig(cm.options.Project))
+	addFile(ConfigFile, cm.options.ConfigPath)
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Split into key and value
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			cm.configs[key] = value
-		}
+	overrides := make(map[string]any)
+	for key, value := range cm.options.ConfigOverrides {
+		overrides[key] = value
 	}
+	layers = append(layers, &ConfigLayer{Name: ConfigCLI, values: overrides})
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading config file: %v", err)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	set := &ConfigLayer{Name: ConfigSet, values: make(map[string]any)}
+	if len(cm.layers) > 0 {
+		set = cm.layers[len(cm.layers)-1]
 	}
+	cm.layers = append(layers, set)
+	cm.loadErr = errors.Join(errs...)
 
-	return nil
+	return cm.loadErr
+}
+
+// LoadError returns what went wrong the last time the files were loaded, nil if nothing did
+func (cm *ConfigManager) LoadError() error {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	return cm.loadErr
 }
 
+// Save writes the values changed while the editor runs to the user config, keeping its comments and
+// the order of its lines
 func (cm *ConfigManager) Save() error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
 	if !cm.changed {
 		return nil // No changes to save
 	}
 
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	path := userConfigPath()
+	if path == "" {
+		return fmt.Errorf("no user config directory to save to")
+	}
+	// Lines that cannot be read are written back as they are
+	file, err := readConfigFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		file, _ = parseConfig("")
+	} else if file == nil {
+		return err
+	}
+	set := cm.layers[len(cm.layers)-1].values
+	for _, key := range configKeys(set) {
+		file.set(key, set[key])
+	}
 
-	file, err := os.Create("config")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(file.String()), 0644); err != nil {
+		return fmt.Errorf("error writing config file: %v", err)
+	}
+
+	cm.changed = false // Reset the flag after saving
+	return nil
+}
+
+// Get returns a value as text, arrays with their items separated by commas
+func (cm *ConfigManager) Get(key string) (string, bool) {
+	value, exists := cm.Value(key)
+	if !exists {
+		return "", false
+	}
+	return configString(value), true
+}
+
+// Value returns a value as the config file has it: a string, int64, float64, bool or []any. Values
+// set while the editor runs and on the command line are strings.
+func (cm *ConfigManager) Value(key string) (any, bool) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	if layer := cm.source(key); layer != nil {
+		return layer.values[key], true
+	}
+	return nil, false
+}
+
+// GetInt returns a value as an integer, false when it is not set or is not a whole number
+func (cm *ConfigManager) GetInt(key string) (int, bool) {
+	value, exists := cm.Value(key)
+	if !exists {
+		return 0, false
+	}
+	number, err := configInt(value)
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+		log.Printf("[ERROR] Config %s: %v", key, err)
+		return 0, false
 	}
-	defer file.Close()
+	return number, true
+}
 
-	writer := bufio.NewWriter(file)
-	for key, value := range cm.configs {
-		_, err := writer.WriteString(fmt.Sprintf("%s=%s\n", key, value))
-		if err != nil {
-			return fmt.Errorf("error writing config file: %v", err)
+// GetBool returns a value as a boolean, false when it is not set or is not true, false, yes, no, on
+// or off
+func (cm *ConfigManager) GetBool(key string) (bool, bool) {
+	value, exists := cm.Value(key)
+	if !exists {
+		return false, false
+	}
+	flag, err := configBool(value)
+	if err != nil {
+		log.Printf("[ERROR] Config %s: %v", key, err)
+		return false, false
+	}
+	return flag, true
+}
+
+// GetDuration returns a value such as "1m30s" or "250ms" as a duration, a number is seconds
+func (cm *ConfigManager) GetDuration(key string) (time.Duration, bool) {
+	value, exists := cm.Value(key)
+	if !exists {
+		return 0, false
+	}
+	duration, err := configDuration(value)
+	if err != nil {
+		log.Printf("[ERROR] Config %s: %v", key, err)
+		return 0, false
+	}
+	return duration, true
+}
+
+// GetStringList returns an array as strings, a string is split on commas
+func (cm *ConfigManager) GetStringList(key string) ([]string, bool) {
+	value, exists := cm.Value(key)
+	if !exists {
+		return nil, false
+	}
+	return configList(value), true
+}
+
+// Declare registers a config option so its value is checked and :set can list and change it. The
+// default is what Get returns when no layer sets the key.
+func (cm *ConfigManager) Declare(key, typ string, def any, description string) error {
+	switch typ {
+	case OptionString, OptionInt, OptionBool, OptionDuration, OptionList, OptionSection:
+	default:
+		return fmt.Errorf("Config option %s has an unknown type %s", key, typ)
+	}
+
+	option := ConfigOption{Key: key, Type: typ, Description: description}
+	if def != nil {
+		// Defaults are kept the way the config file would have them
+		switch v := def.(type) {
+		case int:
+			def = int64(v)
+		case time.Duration:
+			def = v.String()
+		case []string:
+			items := make([]any, len(v))
+			for i, item := range v {
+				items[i] = item
+			}
+			def = items
+		}
+		if err := option.check(def); err != nil {
+			return fmt.Errorf("Config option %s: default %v", key, err)
 		}
+		option.Default = def
 	}
 
-	cm.changed = false // Reset the flag after saving
-	return writer.Flush()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.declared[key] = option
+	if def != nil {
+		cm.defaults[key] = def
+	}
+	return nil
 }
 
-func (cm *ConfigManager) Get(key string) (string, bool) {
+// Options returns the declared options sorted by key
+func (cm *ConfigManager) Options() []ConfigOption {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	options := make([]ConfigOption, 0, len(cm.declared))
+	for _, option := range cm.declared {
+		options = append(options, option)
+	}
+	sort.Slice(options, func(i, j int) bool { return options[i].Key < options[j].Key })
+	return options
+}
+
+func (cm *ConfigManager) Option(key string) (ConfigOption, bool) {
 	cm.lock.RLock()
 	defer cm.lock.RUnlock()
-	value, exists := cm.configs[key]
-	return value, exists
+	option, exists := cm.declared[key]
+	return option, exists
 }
 
+// Validate checks the values the config files and the command line set against the declared
+// options, and describes the keys nobody declared and the values of the wrong type
+func (cm *ConfigManager) Validate() []string {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	var problems []string
+	for _, layer := range cm.layers {
+		if layer.Name == ConfigDefault || layer.Name == ConfigSet {
+			continue
+		}
+		where := layer.Path
+		if where == "" {
+			where = "--set"
+		}
+		for _, key := range configKeys(layer.values) {
+			option, exists := cm.declared[key]
+			if !exists && cm.inSection(key) {
+				continue
+			}
+			if !exists {
+				problems = append(problems, fmt.Sprintf("Unknown config key %s in %s", key, where))
+				continue
+			}
+			if err := option.check(layer.values[key]); err != nil {
+				problems = append(problems, fmt.Sprintf("Config %s in %s: %v", key, where, err))
+			}
+		}
+	}
+	return problems
+}
+
+// inSection reports whether a key is below a declared section, the caller holds the lock
+func (cm *ConfigManager) inSection(key string) bool {
+	for dot := strings.LastIndex(key, "."); dot > 0; dot = strings.LastIndex(key[:dot], ".") {
+		if option, exists := cm.declared[key[:dot]]; exists && option.Type == OptionSection {
+			return true
+		}
+	}
+	return false
+}
+
+// check reports whether a value can be read as the option's type
+func (option ConfigOption) check(value any) error {
+	var err error
+	switch option.Type {
+	case OptionString:
+		if _, isList := value.([]any); isList {
+			err = fmt.Errorf("%s is not a string", configString(value))
+		}
+	case OptionInt:
+		_, err = configInt(value)
+	case OptionBool:
+		_, err = configBool(value)
+	case OptionDuration:
+		_, err = configDuration(value)
+	}
+	return err
+}
+
+// Set changes a value while the editor runs and dispatches config.changed when that changes it
 func (cm *ConfigManager) Set(key string, value string) {
 	cm.lock.Lock()
-	defer cm.lock.Unlock()
-	cm.configs[key] = value
+	var old any
+	existed := false
+	if layer := cm.source(key); layer != nil {
+		old, existed = layer.values[key], true
+	}
+	if len(cm.layers) == 0 {
+		cm.layers = []*ConfigLayer{{Name: ConfigSet, values: make(map[string]any)}}
+	}
+	cm.layers[len(cm.layers)-1].values[key] = value
 	cm.changed = true // Mark as changed
+	tg := cm.tg
+	cm.lock.Unlock()
+
+	// Values from the files are typed, compare them the way :set writes them
+	if tg != nil && (!existed || configString(old) != value) {
+		tg.Event.Dispatch("config.changed", []ConfigChange{{Key: key, Old: old, New: value}})
+	}
 }
 
-func (cm *ConfigManager) createDefaultConfig() error {
-	file, err := os.Create("config")
-	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+// Keys returns the keys some layer sets below prefix, "style" gives "style.default.text.fg" and
+// the like, sorted
+func (cm *ConfigManager) Keys(prefix string) []string {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	found := make(map[string]any)
+	for _, layer := range cm.layers {
+		for key := range layer.values {
+			if strings.HasPrefix(key, prefix+".") {
+				found[key] = nil
+			}
+		}
+	}
+	return configKeys(found)
+}
+
+// Source returns the layer the value of a key comes from
+func (cm *ConfigManager) Source(key string) (ConfigLayer, bool) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	if layer := cm.source(key); layer != nil {
+		return ConfigLayer{Name: layer.Name, Path: layer.Path}, true
 	}
-	defer file.Close()
+	return ConfigLayer{}, false
+}
 
-	writer := bufio.NewWriter(file)
+// Layers returns the layers that were loaded, lowest precedence first, without their values
+func (cm *ConfigManager) Layers() []ConfigLayer {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	layers := make([]ConfigLayer, len(cm.layers))
+	for i, layer := range cm.layers {
+		layers[i] = ConfigLayer{Name: layer.Name, Path: layer.Path}
+	}
+	return layers
+}
 
-	// Write default configurations
-	for key, value := range defaultConfig {
-		_, err := writer.WriteString(fmt.Sprintf("%s=%s\n", key, value))
+// source finds the highest layer setting key, the caller holds the lock
+func (cm *ConfigManager) source(key string) *ConfigLayer {
+	for i := len(cm.layers) - 1; i >= 0; i-- {
+		if _, exists := cm.layers[i].values[key]; exists {
+			return cm.layers[i]
+		}
+	}
+	return nil
+}
+
+// configSourceText describes where the value of a key comes from, e.g. "tabs=4 from project /src/.tg-edit"
+func configSourceText(cm *ConfigManager, key string) string {
+	value, exists := cm.Get(key)
+	if !exists {
+		return key + " is not set"
+	}
+	layer, _ := cm.Source(key)
+	text := fmt.Sprintf("%s=%s from %s", key, value, layer.Name)
+	if layer.Path != "" {
+		text += " " + layer.Path
+	}
+	return text
+}
+
+func configInt(value any) (int, error) {
+	switch v := value.(type) {
+	case int64:
+		return int(v), nil
+	case string:
+		if number, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a whole number", configString(value))
+}
+
+func configBool(value any) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "yes", "on":
+			return true, nil
+		case "false", "no", "off":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("%s is not true or false", configString(value))
+}
+
+func configDuration(value any) (time.Duration, error) {
+	switch v := value.(type) {
+	case int64:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	case string:
+		if duration, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			return duration, nil
+		}
+		if seconds, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a duration such as 1m30s", configString(value))
+}
+
+func configList(value any) []string {
+	switch v := value.(type) {
+	case []any:
+		list := make([]string, len(v))
+		for i, item := range v {
+			list[i] = configString(item)
+		}
+		return list
+	case string:
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return []string{configString(value)}
+}
+
+// configString writes a value as Get returns it
+func configString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configString(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// userConfigPath is tg-edit/config in the XDG config directory
+func userConfigPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
 		if err != nil {
-			return fmt.Errorf("error writing to config file: %v", err)
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "tg-edit", "config")
+}
+
+// systemConfigPaths is tg-edit/config in every XDG system config directory, most important first
+func systemConfigPaths() []string {
+	dirs := os.Getenv("XDG_CONFIG_DIRS")
+	if dirs == "" {
+		dirs = "/etc/xdg"
+	}
+	var paths []string
+	for _, dir := range filepath.SplitList(dirs) {
+		if dir != "" {
+			paths = append(paths, filepath.Join(dir, "tg-edit", "config"))
 		}
 	}
+	return paths
+}
 
-	// Flush to ensure data is written
-	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("error flushing config file: %v", err)
+// findProjectConfig walks up from a file or directory, the working directory when empty, to the
+// nearest .tg-edit
+func findProjectConfig(from string) string {
+	if from == "" {
+		from = "."
+	}
+	dir, err := filepath.Abs(from)
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		dir = filepath.Dir(dir)
 	}
 
-	return nil
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
 }
@@ -0,0 +1,340 @@
+package TG
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config files are a small part of TOML:
+//
+//	# Comments start with a hash, on their own line or after a value
+//	tracesize = 200
+//	undofile = true
+//
+//	[command-pallete]          # Keys below a section are read as "command-pallete.<key>"
+//	historyfile = "~/.tg-history"
+//	ignore = ["*.o", "*.so"]
+//
+// Values are strings, quoted with " (escapes allowed) or ' (taken as is), integers, floats,
+// booleans and single-line arrays of those. An unquoted value that is none of these is read as a
+// string, so key=value files from before sections still load. A comment after an unquoted value
+// starts with a space before the hash, so colors such as fg = #ff0000 need no quotes.
+//
+// A line that cannot be read is reported and skipped, the rest of the file still loads.
+
+// configFile is a parsed config file that keeps its lines so values can be changed without losing
+// the comments and layout around them
+type configFile struct {
+	lines    []string
+	values   map[string]any
+	entries  map[string]configEntry // Key -> where its value is written
+	sections map[string]int         // Section -> last line belonging to it
+	order    []string               // Sections in the order they appear, "" for the keys before any
+}
+
+type configEntry struct {
+	line       int
+	valueStart int // Byte offsets of the value in the line
+	valueEnd   int
+}
+
+// readConfig reads the values of a config file, keys in a section are prefixed with its name. When
+// only some lines cannot be read it returns the values of the others along with the error.
+func readConfig(path string) (map[string]any, error) {
+	file, err := readConfigFile(path)
+	if file == nil {
+		return nil, err
+	}
+	return file.values, err
+}
+
+// readConfigFile reads a config file, the error tells which lines were skipped if any
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, problems := parseConfig(string(data))
+	errs := make([]error, len(problems))
+	for i, problem := range problems {
+		errs[i] = fmt.Errorf("%s:%w", path, problem)
+	}
+	return file, errors.Join(errs...)
+}
+
+// parseConfig reads the lines it can and returns an error for each of the others
+func parseConfig(text string) (*configFile, []error) {
+	file := &configFile{
+		values:   make(map[string]any),
+		entries:  make(map[string]configEntry),
+		sections: map[string]int{"": -1},
+		order:    []string{""},
+	}
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if text != "" {
+		file.lines = strings.Split(text, "\n")
+	}
+
+	var problems []error
+	section := ""
+	for i, line := range file.lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") {
+			end := strings.Index(trimmed, "]")
+			if strings.HasPrefix(trimmed, "[[") || end < 0 || !isComment(trimmed[end+1:]) {
+				problems = append(problems, fmt.Errorf("%d: invalid section header %s", i+1, trimmed))
+				continue
+			}
+			name := strings.TrimSpace(trimmed[1:end])
+			if !validConfigKey(name) {
+				problems = append(problems, fmt.Errorf("%d: invalid section name %q", i+1, name))
+				continue
+			}
+			section = name
+			if _, exists := file.sections[section]; !exists {
+				file.order = append(file.order, section)
+			}
+			file.sections[section] = i
+			continue
+		}
+
+		key, rest, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !validConfigKey(key) {
+			problems = append(problems, fmt.Errorf("%d: expected key = value, got %s", i+1, trimmed))
+			continue
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+
+		start := len(line) - len(rest)
+		start += len(rest) - len(strings.TrimLeft(rest, " \t"))
+		value, end, err := parseConfigValue(line, start)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%d: %s: %v", i+1, key, err))
+			continue
+		}
+
+		file.values[key] = value
+		file.entries[key] = configEntry{line: i, valueStart: start, valueEnd: end}
+		file.sections[section] = i
+	}
+	return file, problems
+}
+
+// parseConfigValue parses the value starting at line[start:], up to an optional comment, and
+// returns it with the offset where it ends
+func parseConfigValue(line string, start int) (any, int, error) {
+	value, end, err := parseConfigScalar(line, start, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !isComment(line[end:]) {
+		return nil, 0, fmt.Errorf("unexpected %s after the value", strings.TrimSpace(line[end:]))
+	}
+	return value, end, nil
+}
+
+// parseConfigScalar parses one value, in an array bare values also end at a comma or bracket
+func parseConfigScalar(line string, start int, inArray bool) (any, int, error) {
+	rest := line[start:]
+	switch {
+	case rest == "":
+		return nil, 0, fmt.Errorf("missing value")
+
+	case rest[0] == '"':
+		for i := 1; i < len(rest); i++ {
+			switch rest[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(rest[:i+1])
+				if err != nil {
+					return nil, 0, fmt.Errorf("invalid string %s", rest[:i+1])
+				}
+				return value, start + i + 1, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("unterminated string")
+
+	case rest[0] == '\'':
+		end := strings.IndexByte(rest[1:], '\'')
+		if end < 0 {
+			return nil, 0, fmt.Errorf("unterminated string")
+		}
+		return rest[1 : end+1], start + end + 2, nil
+
+	case rest[0] == '[' && !inArray:
+		list := []any{}
+		i := start + 1
+		for {
+			i += len(line[i:]) - len(strings.TrimLeft(line[i:], " \t"))
+			if i < len(line) && line[i] == ']' {
+				return list, i + 1, nil
+			}
+			value, end, err := parseConfigScalar(line, i, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, value)
+			i = end + len(line[end:]) - len(strings.TrimLeft(line[end:], " \t"))
+			switch {
+			case i < len(line) && line[i] == ',':
+				i++
+			case i < len(line) && line[i] == ']':
+				return list, i + 1, nil
+			default:
+				return nil, 0, fmt.Errorf("unterminated array")
+			}
+		}
+	}
+
+	end := len(rest)
+	for i := 0; i < len(rest); i++ {
+		if inArray && (rest[i] == ',' || rest[i] == ']') || rest[i] == '#' && startsComment(rest, i) {
+			end = i
+			break
+		}
+	}
+	bare := strings.TrimRight(rest[:end], " \t")
+	if bare == "" {
+		return nil, 0, fmt.Errorf("missing value")
+	}
+	return bareConfigValue(bare), start + len(bare), nil
+}
+
+// bareConfigValue reads an unquoted value as a boolean or number when it is one
+func bareConfigValue(text string) any {
+	switch text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if number, err := strconv.ParseInt(text, 0, 64); err == nil {
+		return number
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXpP") {
+		return number
+	}
+	return text
+}
+
+// startsComment reports whether the hash at text[i] starts a comment rather than belonging to an
+// unquoted value such as #ff0000: it follows a space, or begins the value and a space follows it
+func startsComment(text string, i int) bool {
+	if i > 0 {
+		return text[i-1] == ' ' || text[i-1] == '\t'
+	}
+	return i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t'
+}
+
+func isComment(text string) bool {
+	text = strings.TrimSpace(text)
+	return text == "" || strings.HasPrefix(text, "#")
+}
+
+func validConfigKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") {
+		return false
+	}
+	for _, r := range key {
+		if !(r == '_' || r == '-' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// set changes a value in place, keeping the comment after it, or adds the key to its section
+func (file *configFile) set(key string, value any) {
+	text := formatConfigValue(value)
+
+	if entry, exists := file.entries[key]; exists {
+		line := file.lines[entry.line]
+		file.lines[entry.line] = line[:entry.valueStart] + text + line[entry.valueEnd:]
+	} else {
+		// The longest section the key belongs to, or a new one named by everything before its last dot
+		section, name := "", key
+		for _, candidate := range file.order {
+			if candidate != "" && strings.HasPrefix(key, candidate+".") && len(candidate) > len(section) {
+				section, name = candidate, strings.TrimPrefix(key, candidate+".")
+			}
+		}
+		dot := strings.LastIndex(key, ".")
+
+		switch {
+		case section != "":
+			file.insert(file.sections[section]+1, name+" = "+text)
+		case dot > 0:
+			file.lines = append(file.lines, "", "["+key[:dot]+"]", key[dot+1:]+" = "+text)
+		case file.sections[""] >= 0 || len(file.lines) == 0:
+			file.insert(file.sections[""]+1, key+" = "+text)
+		default:
+			// The first key outside any section goes before the first section
+			file.insert(0, key+" = "+text, "")
+		}
+	}
+
+	// Parsing again updates the offsets of every line after the change, the lines that could not be
+	// read stay as they are
+	parsed, _ := parseConfig(file.String())
+	*file = *parsed
+}
+
+// insert puts lines before the line at index at
+func (file *configFile) insert(at int, lines ...string) {
+	file.lines = append(file.lines[:at], append(lines, file.lines[at:]...)...)
+}
+
+func (file *configFile) String() string {
+	if len(file.lines) == 0 {
+		return ""
+	}
+	return strings.Join(file.lines, "\n") + "\n"
+}
+
+// formatConfigValue writes a value the way parseConfigValue reads it back
+func formatConfigValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		if _, isString := bareConfigValue(v).(string); !isString {
+			// A string that looks like a number or boolean is written as one, as the user typed it
+			return v
+		}
+		return strconv.Quote(v)
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = formatConfigValue(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case []string:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = strconv.Quote(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// configKeys returns the keys of values sorted
+func configKeys(values map[string]any) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,194 @@
+package TG
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		values   map[string]any
+		problems int
+	}{
+		{
+			name:   "scalars",
+			text:   "a = 1\nb = 1.5\nc = true\nd = \"x y\"\ne = 'C:\\tmp'\nf = plain text\n",
+			values: map[string]any{"a": int64(1), "b": 1.5, "c": true, "d": "x y", "e": `C:\tmp`, "f": "plain text"},
+		},
+		{
+			name:   "comments after values",
+			text:   "# header\na = 1 # one\nb = \"x # y\" # quoted hash\nc = [1, 2] # list\nd = plain # text\n",
+			values: map[string]any{"a": int64(1), "b": "x # y", "c": []any{int64(1), int64(2)}, "d": "plain"},
+		},
+		{
+			name:   "hash inside an unquoted value",
+			text:   "fg = #ff0000\nbg = #000 # black\nurl = a#b\n",
+			values: map[string]any{"fg": "#ff0000", "bg": "#000", "url": "a#b"},
+		},
+		{
+			name:   "sections",
+			text:   "a = 1\n[ui]\nb = 2\n[ui.status] # nested\nc = 3\n",
+			values: map[string]any{"a": int64(1), "ui.b": int64(2), "ui.status.c": int64(3)},
+		},
+		{
+			name:   "arrays",
+			text:   "a = []\nb = [\"x\", 'y', z]\n",
+			values: map[string]any{"a": []any{}, "b": []any{"x", "y", "z"}},
+		},
+		{
+			name:     "bad lines are skipped",
+			text:     "a = 1\nb =\nc = # nothing\nnot a key\nd = \"open\ne = [1, 2\n[bad section\nf = 2\n",
+			values:   map[string]any{"a": int64(1), "f": int64(2)},
+			problems: 6,
+		},
+		{
+			name:     "keys after a bad section header stay in the section before",
+			text:     "[ui]\na = 1\n[b d]\nb = 2\n",
+			values:   map[string]any{"ui.a": int64(1), "ui.b": int64(2)},
+			problems: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, problems := parseConfig(test.text)
+			if !reflect.DeepEqual(file.values, test.values) {
+				t.Errorf("values = %#v, want %#v", file.values, test.values)
+			}
+			if len(problems) != test.problems {
+				t.Errorf("got %d problems %v, want %d", len(problems), problems, test.problems)
+			}
+		})
+	}
+}
+
+func TestConfigFileSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		key   string
+		value any
+		want  string
+	}{
+		{
+			name:  "empty file",
+			key:   "tabstop",
+			value: "4",
+			want:  "tabstop = 4\n",
+		},
+		{
+			name:  "keeps the comment after the value",
+			text:  "# settings\ntabstop = 8 # columns\nundofile = true\n",
+			key:   "tabstop",
+			value: "4",
+			want:  "# settings\ntabstop = 4 # columns\nundofile = true\n",
+		},
+		{
+			name:  "quotes strings that are not numbers or booleans",
+			text:  "name = x\n",
+			key:   "name",
+			value: "a # b",
+			want:  "name = \"a # b\"\n",
+		},
+		{
+			name:  "top level key goes before the first section",
+			text:  "[ui]\ntheme = dark\n",
+			key:   "tabstop",
+			value: "4",
+			want:  "tabstop = 4\n\n[ui]\ntheme = dark\n",
+		},
+		{
+			name:  "top level key goes after the other top level keys",
+			text:  "a = 1\n\n[ui]\ntheme = dark\n",
+			key:   "b",
+			value: "2",
+			want:  "a = 1\nb = 2\n\n[ui]\ntheme = dark\n",
+		},
+		{
+			name:  "key goes at the end of its section",
+			text:  "[ui]\ntheme = dark\n\n[search]\nwrap = true\n",
+			key:   "ui.font",
+			value: "mono",
+			want:  "[ui]\ntheme = dark\nfont = \"mono\"\n\n[search]\nwrap = true\n",
+		},
+		{
+			name:  "key goes in the longest section it belongs to",
+			text:  "[ui]\na = 1\n[ui.status]\nb = 2\n",
+			key:   "ui.status.c",
+			value: "3",
+			want:  "[ui]\na = 1\n[ui.status]\nb = 2\nc = 3\n",
+		},
+		{
+			name:  "new section",
+			text:  "a = 1\n",
+			key:   "ui.theme",
+			value: "dark",
+			want:  "a = 1\n\n[ui]\ntheme = \"dark\"\n",
+		},
+		{
+			name:  "lists",
+			text:  "ignore = []\n",
+			key:   "ignore",
+			value: []string{"*.o", "a\"b"},
+			want:  "ignore = [\"*.o\", \"a\\\"b\"]\n",
+		},
+		{
+			name:  "bad lines are kept",
+			text:  "not a key\na = 1\n",
+			key:   "a",
+			value: "2",
+			want:  "not a key\na = 2\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, _ := parseConfig(test.text)
+			file.set(test.key, test.value)
+			if got := file.String(); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// Values written by set read back as what was set
+func TestConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		value any
+		want  any
+	}{
+		{"4", int64(4)},
+		{"1.5", 1.5},
+		{"true", true},
+		{"text", "text"},
+		{"two words", "two words"},
+		{"#ff0000", "#ff0000"},
+		{"a # b", "a # b"},
+		{`quote " and \ backslash`, `quote " and \ backslash`},
+		{"", ""},
+		{int64(-3), int64(-3)},
+		{false, false},
+		{[]any{"a", int64(1), true}, []any{"a", int64(1), true}},
+		{[]string{"x,y", "[z]"}, []any{"x,y", "[z]"}},
+	}
+
+	for _, test := range tests {
+		file, _ := parseConfig("# comment\n[section]\nother = 1\n")
+		file.set("section.key", test.value)
+		read, problems := parseConfig(file.String())
+		if len(problems) > 0 {
+			t.Errorf("%#v: %v", test.value, problems)
+			continue
+		}
+		if got := read.values["section.key"]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%#v read back as %#v, want %#v", test.value, got, test.want)
+		}
+		if !strings.HasPrefix(file.String(), "# comment\n[section]\nother = 1\n") {
+			t.Errorf("%#v: lines before the key changed:\n%s", test.value, file.String())
+		}
+	}
+}
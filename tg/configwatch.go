@@ -0,0 +1,227 @@
+package TG
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigChange is a value that changed, config.changed carries a []ConfigChange sorted by key
+type ConfigChange struct {
+	Key string
+	Old any // Nil when the key was not set
+	New any // Nil when the key is no longer set
+}
+
+// How often the config files are checked when configpoll is not set
+const defaultConfigPoll = time.Second
+
+// Watch declares config.changed and starts checking the config files for changes every configpoll,
+// loading them again on the main thread when one does. Replays do not watch, what they do must not
+// depend on the files changing under them.
+func (cm *ConfigManager) Watch(tg *TG) {
+	cm.lock.Lock()
+	cm.tg = tg
+	cm.lock.Unlock()
+
+	tg.Event.Declare(EventInfo{
+		Name:        "config.changed",
+		Description: "Config values changed, a config file was edited, reloaded or :set was used",
+		Payload:     "[]TG.ConfigChange",
+		Aliases:     []string{"CONFIG_CHANGED"},
+	})
+	tg.Config.Declare("configpoll", OptionDuration, defaultConfigPoll, "How often the config files are checked for changes, 0 to stop")
+
+	tg.Api.Register(CommandInfo{
+		Name:        "RELOAD_CONFIG",
+		Description: "Read the config files again and dispatch config.changed for the values that changed",
+	}, func(tg *TG, data any) any {
+		cm.reload()
+		return nil
+	})
+
+	cm.watcher = newFileWatcher()
+	cm.watcher.Watch(cm.paths, func() {
+		tg.Jobs.Post(cm.reload)
+	})
+	if tg.Options.Replay == nil {
+		go cm.watcher.run(func() time.Duration {
+			interval, _ := cm.GetDuration("configpoll")
+			return interval
+		})
+		tg.Event.Subscribe("app.quit", func(tg *TG, data any) {
+			cm.watcher.Stop()
+		})
+	}
+}
+
+// WatchFiles calls onChange on the main thread when one of the files paths returns is created,
+// changed or removed. Paths is called each time the files are checked, so the files may change too.
+func (cm *ConfigManager) WatchFiles(paths func() []string, onChange func()) {
+	cm.watcher.Watch(paths, func() {
+		cm.tg.Jobs.Post(onChange)
+	})
+}
+
+// Reload reads the config files again and dispatches config.changed with the values that changed
+func (cm *ConfigManager) Reload() ([]ConfigChange, error) {
+	before := cm.values()
+	err := cm.Load()
+	changes := diffConfig(before, cm.values())
+
+	cm.lock.RLock()
+	tg := cm.tg
+	cm.lock.RUnlock()
+	if tg != nil && len(changes) > 0 {
+		tg.Event.Dispatch("config.changed", changes)
+	}
+	return changes, err
+}
+
+// reload runs Reload and tells the user how it went
+func (cm *ConfigManager) reload() {
+	changes, err := cm.Reload()
+	if err != nil {
+		cm.tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Reloading the config: %v", err))
+	}
+	if len(changes) == 0 {
+		return
+	}
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+	cm.tg.Api.Call("AddMessage", "INFO", "Config reloaded, changed "+strings.Join(keys, ", "))
+	for _, problem := range cm.Validate() {
+		cm.tg.Api.Call("AddMessage", "WARNING", problem)
+	}
+}
+
+// paths are the config files to watch, those that do not exist yet included
+func (cm *ConfigManager) paths() []string {
+	paths := append(systemConfigPaths(), userConfigPath())
+	if project := findProjectConfig(cm.options.Project); project != "" {
+		paths = append(paths, project)
+	}
+	if cm.options.ConfigPath != "" {
+		paths = append(paths, cm.options.ConfigPath)
+	}
+	return paths
+}
+
+// values returns the value every key has, from the layer setting it with the highest precedence
+func (cm *ConfigManager) values() map[string]any {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	values := make(map[string]any)
+	for _, layer := range cm.layers {
+		for key, value := range layer.values {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func diffConfig(before, after map[string]any) []ConfigChange {
+	var changes []ConfigChange
+	for key, old := range before {
+		if value, exists := after[key]; !exists || !reflect.DeepEqual(old, value) {
+			changes = append(changes, ConfigChange{Key: key, Old: old, New: value})
+		}
+	}
+	for key, value := range after {
+		if _, exists := before[key]; !exists {
+			changes = append(changes, ConfigChange{Key: key, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// fileWatcher polls files for changes, the editor only needs to notice an edit within a second or
+// so and polling works the same everywhere
+type fileWatcher struct {
+	lock    sync.Mutex
+	watches []*fileWatch
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type fileWatch struct {
+	paths    func() []string
+	onChange func() // Called on the watcher's goroutine
+	stamps   map[string]fileStamp
+}
+
+// fileStamp is what tells a file changed, the zero value for a file that does not exist
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newFileWatcher() *fileWatcher {
+	return &fileWatcher{stop: make(chan struct{})}
+}
+
+// Watch starts watching the files paths returns, as they are now
+func (fw *fileWatcher) Watch(paths func() []string, onChange func()) {
+	watch := &fileWatch{paths: paths, onChange: onChange}
+	watch.stamps = watch.stat()
+
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	fw.watches = append(fw.watches, watch)
+}
+
+func (fw *fileWatcher) Stop() {
+	fw.once.Do(func() { close(fw.stop) })
+}
+
+// run checks the files every interval until Stop, an interval of 0 or less pauses the checks
+func (fw *fileWatcher) run(interval func() time.Duration) {
+	for {
+		wait := interval()
+		if wait <= 0 {
+			wait = defaultConfigPoll
+		}
+		select {
+		case <-fw.stop:
+			return
+		case <-time.After(wait):
+		}
+		if interval() > 0 {
+			fw.check()
+		}
+	}
+}
+
+// check calls onChange for every watch with a file that changed since the last check
+func (fw *fileWatcher) check() {
+	fw.lock.Lock()
+	watches := append([]*fileWatch(nil), fw.watches...)
+	fw.lock.Unlock()
+
+	for _, watch := range watches {
+		stamps := watch.stat()
+		if !reflect.DeepEqual(stamps, watch.stamps) {
+			watch.stamps = stamps
+			watch.onChange()
+		}
+	}
+}
+
+func (watch *fileWatch) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range watch.paths() {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		} else {
+			stamps[path] = fileStamp{}
+		}
+	}
+	return stamps
+}
@@ -0,0 +1,147 @@
+package TG
+
+import (
+	"github.com/rivo/uniseg"
+)
+
+// Width of a tab stop in display cells
+const TabWidth = 4
+
+// Cursor returns the line and byte column of the buffer's cursor
+func (b *Buffer) Cursor() (int, int) {
+	return b.OffsetToPosition(b.Point())
+}
+
+// MoveCursor places the cursor at an offset and forgets the column vertical motions were aiming for
+func (b *Buffer) MoveCursor(offset int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.point = clamp(offset, 0, b.length)
+	b.want = -1
+}
+
+// SetAnchor fixes the end of the visual selection that does not follow the cursor
+func (b *Buffer) SetAnchor(offset int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.anchor = clamp(offset, 0, b.length)
+}
+
+// Selection returns the range between the anchor and the cursor, both characters included
+func (b *Buffer) Selection() (int, int) {
+	b.mu.Lock()
+	start, end := min(b.anchor, b.point), max(b.anchor, b.point)
+	b.mu.Unlock()
+
+	line, col := b.OffsetToPosition(end)
+	return start, b.LineStart(line) + nextGrapheme(b.Line(line), col)
+}
+
+// VisualMarks returns the first and last byte of the last visual selection
+func (b *Buffer) VisualMarks() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.visual[0], b.visual[1]
+}
+
+// rememberSelection keeps the visual selection being left for the '< and '> marks
+func (b *Buffer) rememberSelection() {
+	start, end := b.Selection()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.visual = [2]int{start, max(start, end-1)}
+}
+
+// wantColumn returns the display column vertical motions aim for, remembering the current one if unset
+func (b *Buffer) wantColumn() int {
+	line, col := b.Cursor()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.want < 0 {
+		b.want = DisplayWidth(lineAt(b.text(), b.lineIndex(), line)[:col])
+	}
+	return b.want
+}
+
+// moveVertically places the cursor on a line at the remembered display column
+func (b *Buffer) moveVertically(line int) {
+	want := b.wantColumn()
+	line = clamp(line, 0, b.LineCount()-1)
+	offset := b.LineStart(line) + ColumnForWidth(b.Line(line), want)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.point = offset
+}
+
+// DisplayWidth returns how many screen cells a piece of a line takes, expanding tabs and
+// counting wide runes and grapheme clusters correctly
+func DisplayWidth(text string) int {
+	width := 0
+	state := -1
+	for text != "" {
+		var cluster string
+		var w int
+		cluster, text, w, state = uniseg.FirstGraphemeClusterInString(text, state)
+		if cluster == "\t" {
+			width += TabWidth - width%TabWidth
+		} else {
+			width += w
+		}
+	}
+	return width
+}
+
+// ColumnForWidth returns the byte column of the grapheme covering a display column, or the end of
+// the line if it is shorter
+func ColumnForWidth(line string, width int) int {
+	col := 0
+	cells := 0
+	state := -1
+	rest := line
+	for rest != "" {
+		var cluster string
+		var w int
+		cluster, rest, w, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		if cluster == "\t" {
+			w = TabWidth - cells%TabWidth
+		}
+		if cells+w > width {
+			return col
+		}
+		cells += w
+		col += len(cluster)
+	}
+	return col
+}
+
+// nextGrapheme returns the byte column after the grapheme starting at col
+func nextGrapheme(line string, col int) int {
+	if col >= len(line) {
+		return len(line)
+	}
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(line[col:], -1)
+	return col + len(cluster)
+}
+
+// prevGrapheme returns the byte column of the grapheme before col
+func prevGrapheme(line string, col int) int {
+	prev := 0
+	for pos := 0; pos < col && pos < len(line); {
+		prev = pos
+		pos = nextGrapheme(line, pos)
+	}
+	return prev
+}
+
+// clampToLine keeps a normal mode cursor on a character rather than past the end of the line
+func (b *Buffer) clampToLine() {
+	line, col := b.Cursor()
+	text := b.Line(line)
+	if text != "" && col >= len(text) {
+		b.mu.Lock()
+		b.point = b.point - col + prevGrapheme(text, len(text))
+		b.mu.Unlock()
+	}
+}
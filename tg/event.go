@@ -2,68 +2,427 @@ package TG
 
 import (
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Event func(tg *TG, data any)
 
+// EventHandler is a handler that can stop the event or mark it handled, see SubscribeWith
+type EventHandler func(tg *TG, event *EventContext)
+
+// Handlers run from the highest priority to the lowest, those with the same priority in the order
+// they subscribed
+const (
+	PriorityLow     = -100
+	PriorityDefault = 0
+	PriorityHigh    = 100
+)
+
+// SubscribeOptions tune a subscription made with SubscribeWith
+type SubscribeOptions struct {
+	Priority int
+	Once     bool // Unsubscribe after the first event
+}
+
+// EventContext is an event being dispatched
+type EventContext struct {
+	Name    string
+	Data    any
+	stopped bool
+	handled bool
+}
+
+// StopPropagation skips the handlers after this one
+func (e *EventContext) StopPropagation() {
+	e.stopped = true
+}
+
+// SetHandled makes Dispatch report the event as handled, the remaining handlers still run
+func (e *EventContext) SetHandled() {
+	e.handled = true
+}
+
+func (e *EventContext) Handled() bool {
+	return e.handled
+}
+
+type subscription struct {
+	id       int
+	event    string
+	priority int
+	once     bool
+	handler  EventHandler
+	active   atomic.Bool // Cleared by Unsubscribe, even while a dispatch still holds the subscription
+}
+
+// EventInfo describes an event for plugin authors, see Declare
+type EventInfo struct {
+	Name        string // Dotted name, the part before the first dot is its namespace
+	Description string
+	Payload     string   // What handlers receive as data
+	Aliases     []string // Older names that still dispatch and subscribe to this event
+	Queued      bool     // Dispatch queues it like DispatchQueued
+	External    bool     // Comes from outside the editor, sessions record it, see RecordSession
+}
+
+// Events dispatched this deep are dropped, a handler dispatching the event it handles would never
+// return otherwise
+const maxDispatchDepth = 64
+
+type queuedEvent struct {
+	event string
+	data  any
+}
+
 type EventManager struct {
-	subscriptions map[string]map[int]Event
+	subscriptions map[string][]*subscription // Event -> subscriptions in the order they run
+	patterns      []*subscription            // Subscriptions to wildcard patterns such as "buffer.*"
+	byID          map[int]*subscription
+	events        map[string]EventInfo
+	aliases       map[string]string // Alias -> event name
 	lock          sync.RWMutex
 	counter       int
 	tg            *TG
+	log           *eventLog
+
+	// Dispatches run on the main thread, these track the ones in progress there. Other goroutines
+	// never touch them, their events are forwarded with DispatchAsync.
+	dispatchLock sync.Mutex
+	dispatching  []string // Events being dispatched, outermost first
+	queue        []queuedEvent
+	draining     bool
 }
 
 func NewEventManager() *EventManager {
 	return &EventManager{
-		subscriptions: make(map[string]map[int]Event),
+		subscriptions: make(map[string][]*subscription),
+		byID:          make(map[int]*subscription),
+		events:        make(map[string]EventInfo),
+		aliases:       make(map[string]string),
 	}
 }
 
 func (em *EventManager) Load(tg *TG) {
 	em.tg = tg
+	em.registerCommands()
 }
 
+// Register declares an event without describing it
 func (em *EventManager) Register(event string) {
+	em.Declare(EventInfo{Name: event})
+}
+
+// Declare registers an event with a description of it and its payload, declaring it again updates
+// the description
+func (em *EventManager) Declare(info EventInfo) {
 	em.lock.Lock()
 	defer em.lock.Unlock()
 
-	if _, exists := em.subscriptions[event]; !exists {
-		em.subscriptions[event] = make(map[int]Event)
+	if _, exists := em.subscriptions[info.Name]; !exists {
+		em.subscriptions[info.Name] = []*subscription{}
+	}
+	em.events[info.Name] = info
+
+	for _, alias := range info.Aliases {
+		em.aliases[alias] = info.Name
+		// Handlers that subscribed by the old name before the event was declared move to the new one
+		if subscriptions, exists := em.subscriptions[alias]; exists {
+			for _, sub := range subscriptions {
+				sub.event = info.Name
+			}
+			em.subscriptions[info.Name] = sortSubscriptions(append(append([]*subscription{}, subscriptions...), em.subscriptions[info.Name]...))
+			delete(em.subscriptions, alias)
+		}
 	}
 
 	em.counter++
 
 }
 
-func (em *EventManager) Dispatch(event string, args any) {
+// Events returns the declared events sorted by name
+func (em *EventManager) Events() []EventInfo {
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+
+	events := make([]EventInfo, 0, len(em.events))
+	for _, info := range em.events {
+		events = append(events, info)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// DescribeEvent returns the declaration of an event, by its name or an alias
+func (em *EventManager) DescribeEvent(event string) (EventInfo, bool) {
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+	info, exists := em.events[em.resolve(event)]
+	return info, exists
+}
 
+// Subscribers returns the number of handlers an event would run, including wildcard subscriptions
+func (em *EventManager) Subscribers(event string) int {
 	em.lock.RLock()
-	subscriptions, exists := em.subscriptions[event]
+	defer em.lock.RUnlock()
+	return len(em.matching(em.resolve(event)))
+}
+
+// resolve turns an alias into the name of its event, the caller holds the lock
+func (em *EventManager) resolve(event string) string {
+	if name, exists := em.aliases[event]; exists {
+		return name
+	}
+	return event
+}
+
+// matching returns the subscriptions of an event followed by the patterns matching it, in the order
+// they run. The caller holds the lock.
+func (em *EventManager) matching(event string) []*subscription {
+	subscriptions := em.subscriptions[event]
+	var patterns []*subscription
+	for _, sub := range em.patterns {
+		if matchEvent(sub.event, event) {
+			patterns = append(patterns, sub)
+		}
+	}
+	if len(patterns) == 0 {
+		return subscriptions
+	}
+	return sortSubscriptions(append(append([]*subscription{}, subscriptions...), patterns...))
+}
+
+// matchEvent reports whether an event name matches a pattern. Names are split on dots, a "*" matches
+// one part of the name and a trailing "*" every part left, so "buffer.*" matches "buffer.changed" and
+// "*" matches every event.
+func matchEvent(pattern, event string) bool {
+	patternParts := strings.Split(pattern, ".")
+	eventParts := strings.Split(event, ".")
+	for i, part := range patternParts {
+		if i >= len(eventParts) {
+			return false
+		}
+		if part == "*" && i == len(patternParts)-1 {
+			return true
+		}
+		if part != "*" && part != eventParts[i] {
+			return false
+		}
+	}
+	return len(patternParts) == len(eventParts)
+}
+
+func isPattern(event string) bool {
+	return strings.Contains(event, "*")
+}
+
+// sortSubscriptions orders subscriptions from the highest priority to the lowest, those with the same
+// priority in the order they subscribed
+func sortSubscriptions(subscriptions []*subscription) []*subscription {
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		if subscriptions[i].priority != subscriptions[j].priority {
+			return subscriptions[i].priority > subscriptions[j].priority
+		}
+		return subscriptions[i].id < subscriptions[j].id
+	})
+	return subscriptions
+}
+
+// Dispatch runs the handlers of an event and reports whether one of them marked it handled. Events
+// declared Queued are queued instead, see DispatchQueued. Handlers run on the main thread, called
+// from another goroutine Dispatch forwards the event like DispatchAsync and reports it not handled.
+func (em *EventManager) Dispatch(event string, args any) bool {
+	if !em.onMainThread() {
+		em.DispatchAsync(event, args)
+		return false
+	}
+
+	em.lock.RLock()
+	event = em.resolve(event)
+	queued := em.events[event].Queued
+	em.lock.RUnlock()
+
+	if queued {
+		return em.DispatchQueued(event, args)
+	}
+	return em.dispatch(event, args)
+}
+
+// DispatchQueued dispatches an event after the dispatch in progress, if any, has finished, so its
+// handlers do not run in the middle of another event's. Queued events are dispatched in the order
+// they were queued, and reported as not handled.
+func (em *EventManager) DispatchQueued(event string, args any) bool {
+	if !em.onMainThread() {
+		em.DispatchAsync(event, args)
+		return false
+	}
+	em.dispatchLock.Lock()
+	if len(em.dispatching) > 0 {
+		em.queue = append(em.queue, queuedEvent{event, args})
+		em.dispatchLock.Unlock()
+		return false
+	}
+	em.dispatchLock.Unlock()
+
+	return em.dispatch(event, args)
+}
+
+// DispatchAsync dispatches an event on the main thread, see JobManager.Post. It is how goroutines
+// other than the main one dispatch.
+func (em *EventManager) DispatchAsync(event string, args any) {
+	em.tg.Jobs.Post(func() {
+		em.Dispatch(event, args)
+	})
+}
+
+// onMainThread reports whether handlers may run right away. Before Load the TG is still being made,
+// on the main thread.
+func (em *EventManager) onMainThread() bool {
+	return em.tg == nil || em.tg.Jobs.OnMainThread()
+}
+
+func (em *EventManager) dispatch(event string, args any) bool {
+
+	em.lock.RLock()
+	event = em.resolve(event)
+	_, exists := em.subscriptions[event]
+	subscriptions := em.matching(event)
 	em.lock.RUnlock()
 	if !exists {
 		log.Printf("[ERROR] Invalid event %s is being asked to dispatch", event)
-		return
+		return false
+	}
+
+	em.dispatchLock.Lock()
+	if len(em.dispatching) >= maxDispatchDepth {
+		chain := em.dispatching[len(em.dispatching)-8:]
+		em.dispatchLock.Unlock()
+		log.Printf("[ERROR] Event %s dropped, %d events are being dispatched: ... > %s", event, maxDispatchDepth, strings.Join(chain, " > "))
+		return false
 	}
+	em.dispatching = append(em.dispatching, event)
+	em.dispatchLock.Unlock()
+	defer em.finishDispatch()
 
+	context := &EventContext{Name: event, Data: args}
 	for _, subscription := range subscriptions {
-		subscription(em.tg, args)
+		if !subscription.active.Load() {
+			continue
+		}
+		// A handler subscribed once may dispatch the same event again, only the first dispatch gets it
+		if subscription.once && !em.Unsubscribe(subscription.id) {
+			continue
+		}
+		subscription.handler(em.tg, context)
+		if context.stopped {
+			break
+		}
+	}
+	return context.handled
+}
+
+// finishDispatch ends a dispatch, the outermost one goes on to dispatch the queued events
+func (em *EventManager) finishDispatch() {
+	em.dispatchLock.Lock()
+	em.dispatching = em.dispatching[:len(em.dispatching)-1]
+	if len(em.dispatching) > 0 || em.draining {
+		em.dispatchLock.Unlock()
+		return
+	}
+	em.draining = true
+	em.dispatchLock.Unlock()
+
+	defer func() {
+		em.dispatchLock.Lock()
+		em.draining = false
+		em.dispatchLock.Unlock()
+	}()
+
+	for {
+		em.dispatchLock.Lock()
+		if len(em.queue) == 0 {
+			em.dispatchLock.Unlock()
+			return
+		}
+		next := em.queue[0]
+		em.queue = em.queue[1:]
+		em.dispatchLock.Unlock()
+
+		em.dispatch(next.event, next.data)
 	}
 }
 
 func (em *EventManager) Subscribe(event string, handler Event) int {
+	return em.SubscribeWith(event, SubscribeOptions{}, func(tg *TG, e *EventContext) {
+		handler(tg, e.Data)
+	})
+}
+
+// Once subscribes a handler for the next dispatch of an event only
+func (em *EventManager) Once(event string, handler Event) int {
+	return em.SubscribeWith(event, SubscribeOptions{Once: true}, func(tg *TG, e *EventContext) {
+		handler(tg, e.Data)
+	})
+}
 
-	log.Printf("%s %d", event, len(em.subscriptions[event]))
+// SubscribeWith subscribes a handler with a priority or for one event only. The handler receives the
+// event and may stop it from reaching lower priority handlers. The event may be a pattern such as
+// "buffer.*", see matchEvent.
+func (em *EventManager) SubscribeWith(event string, options SubscribeOptions, handler EventHandler) int {
 
 	em.lock.Lock()
 	defer em.lock.Unlock()
 
-	if _, exists := em.subscriptions[event]; !exists {
+	event = em.resolve(event)
+	em.counter++
+	sub := &subscription{
+		id:       em.counter,
+		event:    event,
+		priority: options.Priority,
+		once:     options.Once,
+		handler:  handler,
+	}
+	sub.active.Store(true)
 
-		em.subscriptions[event] = make(map[int]Event)
+	// New slices, dispatches in progress keep iterating the old ones
+	if isPattern(event) {
+		em.patterns = sortSubscriptions(append(append([]*subscription{}, em.patterns...), sub))
+	} else {
+		em.subscriptions[event] = sortSubscriptions(append(append([]*subscription{}, em.subscriptions[event]...), sub))
 	}
+	em.byID[sub.id] = sub
+	return sub.id
+}
 
-	em.counter++
-	em.subscriptions[event][em.counter] = handler
-	return em.counter
+// Unsubscribe removes a subscription by the id Subscribe returned and reports whether it existed
+func (em *EventManager) Unsubscribe(id int) bool {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	sub, exists := em.byID[id]
+	if !exists {
+		return false
+	}
+	delete(em.byID, id)
+	sub.active.Store(false)
+
+	if isPattern(sub.event) {
+		em.patterns = without(em.patterns, sub)
+	} else {
+		em.subscriptions[sub.event] = without(em.subscriptions[sub.event], sub)
+	}
+	return true
+}
+
+// without returns a new slice of the subscriptions but one
+func without(subscriptions []*subscription, sub *subscription) []*subscription {
+	rest := []*subscription{}
+	for _, other := range subscriptions {
+		if other != sub {
+			rest = append(rest, other)
+		}
+	}
+	return rest
 }
@@ -0,0 +1,35 @@
+package TG
+
+import "testing"
+
+func TestMatchEvent(t *testing.T) {
+	tests := []struct {
+		pattern string
+		event   string
+		want    bool
+	}{
+		{"buffer.changed", "buffer.changed", true},
+		{"buffer.changed", "buffer.closed", false},
+		{"buffer", "buffer.changed", false},
+		{"buffer.changed", "buffer", false},
+		{"*", "buffer.changed", true},
+		{"*", "quit", true},
+		{"buffer.*", "buffer.changed", true},
+		{"buffer.*", "buffer.undo.grouped", true},
+		{"buffer.*", "buffer", false},
+		{"buffer.*", "buffers.changed", false},
+		{"*.changed", "buffer.changed", true},
+		{"*.changed", "config.changed", true},
+		{"*.changed", "buffer.closed", false},
+		{"*.changed", "buffer.undo.changed", false},
+		{"key.*.found", "key.sequence.found", true},
+		{"key.*.found", "key.sequence.pending", false},
+		{"key.*.found", "key.found", false},
+	}
+
+	for _, test := range tests {
+		if got := matchEvent(test.pattern, test.event); got != test.want {
+			t.Errorf("matchEvent(%q, %q) = %v, want %v", test.pattern, test.event, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package TG
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Number of events the event log keeps
+const eventLogSize = 500
+
+// EventLogEntry is an event the event log recorded
+type EventLogEntry struct {
+	Time        time.Time
+	Name        string
+	Data        string // Summary of the payload when the event was dispatched
+	Subscribers int
+}
+
+// eventLog records every event dispatched while :eventlog is on, it runs before any other handler so
+// events a handler stops are recorded too
+type eventLog struct {
+	entries      []EventLogEntry
+	next         int
+	full         bool
+	lock         sync.Mutex
+	subscription int
+}
+
+func (em *EventManager) registerCommands() {
+	em.tg.Api.Register(CommandInfo{
+		Name:        "LIST_EVENTS",
+		Description: "Return the declared events",
+		Returns:     "[]TG.EventInfo",
+	}, func(tg *TG, data any) any {
+		return em.Events()
+	})
+
+	em.tg.Api.Register(CommandInfo{
+		Name:        "EVENTS",
+		Description: "Show the declared events, their payloads and subscribers in a buffer",
+		Params:      []CommandParam{{Name: "pattern", Description: "Event pattern such as buffer.*, or ExArgs", Optional: true}},
+		Returns:     "*TG.Buffer",
+	}, func(tg *TG, data any) any {
+		return tg.Buffer.ShowScratch("[events]", "Events", em.eventsText(eventPattern(data)))
+	})
+
+	em.tg.Api.Register(CommandInfo{
+		Name:        "EVENT_LOG",
+		Description: "Start recording events and show those recorded, with force stop and forget them",
+		Params:      []CommandParam{{Name: "pattern", Description: "Event pattern such as buffer.*, or ExArgs", Optional: true}},
+		Returns:     "*TG.Buffer",
+	}, func(tg *TG, data any) any {
+		if args, ok := data.(ExArgs); ok && args.Bang {
+			em.StopLog()
+			return nil
+		}
+		text := eventLogText(em.StartLog(), eventPattern(data))
+		return tg.Buffer.ShowScratch("[event log]", "Event log", text)
+	})
+}
+
+// StartLog subscribes the event log to every event unless it already is, and returns what it
+// recorded so far
+func (em *EventManager) StartLog() []EventLogEntry {
+	em.lock.Lock()
+	if em.log == nil {
+		em.log = &eventLog{entries: make([]EventLogEntry, eventLogSize)}
+	}
+	recorder := em.log
+	em.lock.Unlock()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.subscription == 0 {
+		recorder.subscription = em.SubscribeWith("*", SubscribeOptions{Priority: math.MaxInt}, func(tg *TG, e *EventContext) {
+			recorder.record(EventLogEntry{
+				Time:        time.Now(),
+				Name:        e.Name,
+				Data:        summarize(e.Data),
+				Subscribers: em.Subscribers(e.Name) - 1,
+			})
+		})
+	}
+	return recorder.recorded()
+}
+
+// StopLog unsubscribes the event log and forgets what it recorded
+func (em *EventManager) StopLog() {
+	em.lock.Lock()
+	recorder := em.log
+	em.log = nil
+	em.lock.Unlock()
+
+	if recorder != nil {
+		em.Unsubscribe(recorder.subscription)
+	}
+}
+
+func (l *eventLog) record(entry EventLogEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	l.full = l.full || l.next == 0
+}
+
+// recorded returns the entries oldest first, the caller holds the lock
+func (l *eventLog) recorded() []EventLogEntry {
+	entries := append([]EventLogEntry{}, l.entries[:l.next]...)
+	if l.full {
+		entries = append(append([]EventLogEntry{}, l.entries[l.next:]...), entries...)
+	}
+	return entries
+}
+
+// eventPattern reads the pattern EVENTS and EVENT_LOG filter on, "*" when none is given
+func eventPattern(data any) string {
+	pattern, _ := data.(string)
+	if args, ok := data.(ExArgs); ok {
+		pattern = args.Arg
+	}
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
+
+// eventsText lists the declared events matching pattern for the :events buffer
+func (em *EventManager) eventsText(pattern string) string {
+	var out strings.Builder
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Event\tSubscribers\tDescription\n")
+	matched := false
+	for _, info := range em.Events() {
+		if !matchEvent(pattern, info.Name) {
+			continue
+		}
+		matched = true
+		fmt.Fprintf(w, "%s\t%d\t%s\n", info.Name, em.Subscribers(info.Name), info.Description)
+		if info.Payload != "" {
+			fmt.Fprintf(w, "\t\tPayload: %s\n", info.Payload)
+		}
+		if len(info.Aliases) > 0 {
+			fmt.Fprintf(w, "\t\tAlso: %s\n", strings.Join(info.Aliases, " "))
+		}
+	}
+	if !matched {
+		return "No events match " + pattern + "\n"
+	}
+	w.Flush()
+	return out.String()
+}
+
+// eventLogText formats the recorded events matching pattern for the :eventlog buffer
+func eventLogText(entries []EventLogEntry, pattern string) string {
+	var out strings.Builder
+	for _, entry := range entries {
+		if !matchEvent(pattern, entry.Name) {
+			continue
+		}
+		fmt.Fprintf(&out, "%s %-28s %2d  %s\n", entry.Time.Format("15:04:05.000"), entry.Name, entry.Subscribers, entry.Data)
+	}
+	if out.Len() == 0 {
+		return "No events recorded, they are recorded from now on\n"
+	}
+	return out.String()
+}
@@ -0,0 +1,396 @@
+package TG
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExCommand describes a command usable from the command line, e.g. ":1,10s/a/b/g" or ":w!"
+type ExCommand struct {
+	Name     string // Full name, e.g. "substitute"
+	Short    string // Shortest accepted abbreviation, e.g. "s", any longer prefix of Name works too
+	Command  string // ApiBridge command called with ExArgs
+	Usage    string // e.g. ":[range]s[ubstitute]/{pattern}/{string}/[flags]"
+	Nargs    string // How many arguments it takes, like Vim's -nargs: "0", "1", "?", "*" or "+"
+	Range    bool   // Accepts a range of lines
+	Bang     bool   // Accepts a ! after the name
+	Complete string // What the arguments are, "file", "command" or "option", for completion
+}
+
+// ExRange is a resolved range of 0-based lines
+type ExRange struct {
+	Start int
+	End   int
+	Given bool // False when the command line had no range and it defaults to the cursor line
+}
+
+// ExArgs is what the ApiBridge command behind an ex command receives
+type ExArgs struct {
+	Name   string // Full name of the ex command
+	Range  ExRange
+	Bang   bool
+	Arg    string   // Everything after the name, trimmed
+	Args   []string // Arg split on white space
+	Buffer *Buffer
+}
+
+// ExAddress is one side of a range before it is resolved against a buffer
+type ExAddress struct {
+	Base   string // "" for a line number, ".", "$", "'<" or "'>"
+	Line   int    // 1-based line when Base is empty
+	Offset int    // Added by "+N" or "-N"
+}
+
+// ExLine is a parsed command line
+type ExLine struct {
+	Range []ExAddress // None, one or two addresses
+	Name  string
+	Bang  bool
+	Arg   string
+}
+
+type ExManager struct {
+	commands map[string]ExCommand
+	lock     sync.RWMutex
+	tg       *TG
+}
+
+var defaultExCommands = []ExCommand{
+	{Name: "edit", Short: "e", Command: "EDIT", Usage: ":e[dit][!] [file]", Nargs: "?", Bang: true, Complete: "file"},
+	{Name: "write", Short: "w", Command: "WRITE", Usage: ":w[rite][!] [file]", Nargs: "?", Bang: true, Complete: "file"},
+	{Name: "saveas", Short: "sav", Command: "WRITE_AS", Usage: ":sav[eas][!] {file}", Nargs: "1", Bang: true, Complete: "file"},
+	{Name: "wq", Short: "wq", Command: "WRITE_QUIT", Usage: ":wq[!] [file]", Nargs: "?", Bang: true, Complete: "file"},
+	{Name: "xit", Short: "x", Command: "WRITE_QUIT", Usage: ":x[it][!] [file]", Nargs: "?", Bang: true, Complete: "file"},
+	{Name: "quit", Short: "q", Command: "quit", Usage: ":q[uit][!]", Nargs: "0", Bang: true},
+	{Name: "substitute", Short: "s", Command: "SUBSTITUTE", Usage: ":[range]s[ubstitute]/{pattern}/{string}/[flags]", Nargs: "*", Range: true},
+	{Name: "delete", Short: "d", Command: "DELETE_OPERATOR", Usage: ":[range]d[elete]", Nargs: "0", Range: true},
+	{Name: "yank", Short: "y", Command: "YANK_OPERATOR", Usage: ":[range]y[ank]", Nargs: "0", Range: true},
+	{Name: "nohlsearch", Short: "noh", Command: "NOHLSEARCH", Usage: ":noh[lsearch]", Nargs: "0"},
+	{Name: "undo", Short: "u", Command: "UNDO", Usage: ":u[ndo] [count]", Nargs: "?"},
+	{Name: "redo", Short: "red", Command: "REDO", Usage: ":red[o] [count]", Nargs: "?"},
+	{Name: "earlier", Short: "ea", Command: "EARLIER", Usage: ":ea[rlier] [count|time]", Nargs: "?"},
+	{Name: "later", Short: "lat", Command: "LATER", Usage: ":lat[er] [count|time]", Nargs: "?"},
+	{Name: "jobs", Short: "jobs", Command: "JOBS", Usage: ":jobs[!]", Nargs: "0", Bang: true},
+	{Name: "events", Short: "ev", Command: "EVENTS", Usage: ":ev[ents] [pattern]", Nargs: "?"},
+	{Name: "eventlog", Short: "eventl", Command: "EVENT_LOG", Usage: ":eventl[og][!] [pattern]", Nargs: "?", Bang: true},
+	{Name: "configreload", Short: "configr", Command: "RELOAD_CONFIG", Usage: ":configr[eload]", Nargs: "0"},
+	{Name: "trace", Short: "tr", Command: "TRACE", Usage: ":tr[ace][!] [filter]", Nargs: "?", Bang: true, Complete: "command"},
+}
+
+func NewExManager() *ExManager {
+	return &ExManager{
+		commands: make(map[string]ExCommand),
+	}
+}
+
+func (em *ExManager) Load(tg *TG) {
+	em.tg = tg
+
+	for _, command := range defaultExCommands {
+		em.RegisterCommand(command)
+	}
+	em.registerHelp()
+	em.registerSet()
+	em.registerMap()
+
+	tg.Api.Register(CommandInfo{
+		Name:        "EX",
+		Description: "Run an ex command line such as \"%s/a/b/g\" or \"w file\"",
+		Params:      []CommandParam{{Name: "line", Description: "Command line without the colon"}},
+	}, func(tg *TG, data any) any {
+		line, _ := data.(string)
+		if err := em.Execute(line); err != nil {
+			tg.Api.Call("AddMessage", "ERROR", err.Error())
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "LIST_EX_COMMANDS", Description: "Return the registered ex commands"}, func(tg *TG, data any) any {
+		return em.Commands()
+	})
+
+	tg.Api.Register(CommandInfo{Name: "WRITE_QUIT", Description: "Write the active buffer and quit"}, func(tg *TG, data any) any {
+		buffer, path, force := tg.Buffer.fileParams(data)
+		if buffer != nil {
+			if err := tg.Buffer.Write(buffer, path, force); err != nil {
+				tg.Api.Call("AddMessage", "ERROR", err.Error())
+				return nil
+			}
+		}
+		tg.Api.Call("quit", data)
+		return nil
+	})
+}
+
+// RegisterCommand makes an ex command available on the command line. Its abbreviation must not be a
+// prefix of another command's name, or the other way around, unless it is that command's full name.
+func (em *ExManager) RegisterCommand(command ExCommand) {
+	if command.Short == "" {
+		command.Short = command.Name
+	}
+	if command.Nargs == "" {
+		command.Nargs = "*"
+	}
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	for name, other := range em.commands {
+		if name != command.Name && strings.HasPrefix(other.Name, command.Short) && strings.HasPrefix(command.Short, other.Short) {
+			log.Printf("[ERROR] Ex command %s is ambiguous with %s", command.Name, other.Name)
+			return
+		}
+	}
+	em.commands[command.Name] = command
+}
+
+// Commands returns every ex command sorted by name
+func (em *ExManager) Commands() []ExCommand {
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+	commands := make([]ExCommand, 0, len(em.commands))
+	for _, command := range em.commands {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// Lookup finds an ex command by its name or any abbreviation at least as long as its short form
+func (em *ExManager) Lookup(name string) (ExCommand, bool) {
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+	if command, exists := em.commands[name]; exists {
+		return command, true
+	}
+	for _, command := range em.commands {
+		if strings.HasPrefix(command.Name, name) && strings.HasPrefix(name, command.Short) {
+			return command, true
+		}
+	}
+	return ExCommand{}, false
+}
+
+// ParseExLine splits a command line into its range, name, bang and argument
+func ParseExLine(text string) (ExLine, error) {
+	var line ExLine
+	rest := strings.TrimLeft(text, " \t:")
+
+	if after, found := strings.CutPrefix(rest, "%"); found {
+		line.Range = []ExAddress{{Line: 1}, {Base: "$"}}
+		rest = after
+	} else {
+		for {
+			address, after, ok, err := parseAddress(rest)
+			if err != nil {
+				return line, err
+			}
+			if !ok {
+				if len(line.Range) > 0 {
+					return line, fmt.Errorf("Missing address after ',' in %s", text)
+				}
+				break
+			}
+			line.Range = append(line.Range, address)
+			rest = after
+			if len(line.Range) == 2 || !strings.HasPrefix(rest, ",") {
+				break
+			}
+			rest = rest[1:]
+		}
+	}
+
+	rest = strings.TrimLeft(rest, " \t")
+	end := 0
+	for end < len(rest) && isWordByte(rest[end]) {
+		end++
+	}
+	line.Name = rest[:end]
+	rest = rest[end:]
+
+	if after, found := strings.CutPrefix(rest, "!"); found {
+		line.Bang = true
+		rest = after
+	}
+	line.Arg = strings.TrimSpace(rest)
+	return line, nil
+}
+
+// parseAddress reads one line address with an optional "+N" or "-N" offset
+func parseAddress(text string) (ExAddress, string, bool, error) {
+	var address ExAddress
+	rest := text
+
+	switch {
+	case strings.HasPrefix(rest, "'<"), strings.HasPrefix(rest, "'>"):
+		address.Base = rest[:2]
+		rest = rest[2:]
+	case strings.HasPrefix(rest, "."), strings.HasPrefix(rest, "$"):
+		address.Base = rest[:1]
+		rest = rest[1:]
+	case rest != "" && rest[0] >= '0' && rest[0] <= '9':
+		digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		address.Line, _ = strconv.Atoi(rest[:digits])
+		rest = rest[digits:]
+	case strings.HasPrefix(rest, "+"), strings.HasPrefix(rest, "-"):
+		// A bare offset is relative to the cursor line
+		address.Base = "."
+	case strings.HasPrefix(rest, "'"):
+		return address, text, false, fmt.Errorf("Unknown mark in %s", text)
+	default:
+		return address, text, false, nil
+	}
+
+	for rest != "" && (rest[0] == '+' || rest[0] == '-') {
+		sign := 1
+		if rest[0] == '-' {
+			sign = -1
+		}
+		rest = rest[1:]
+		digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		amount := 1
+		if digits > 0 {
+			amount, _ = strconv.Atoi(rest[:digits])
+		}
+		address.Offset += sign * amount
+		rest = rest[digits:]
+	}
+	return address, rest, true, nil
+}
+
+// resolve turns an address into a 0-based line of a buffer
+func (address ExAddress) resolve(buffer *Buffer) (int, error) {
+	line := address.Line - 1
+	switch address.Base {
+	case ".":
+		line, _ = buffer.Cursor()
+	case "$":
+		line = lastLine(buffer)
+	case "'<", "'>":
+		start, end := buffer.VisualMarks()
+		offset := start
+		if address.Base == "'>" {
+			offset = end
+		}
+		line, _ = buffer.OffsetToPosition(offset)
+	}
+	line += address.Offset
+	if line < 0 || line > lastLine(buffer) {
+		return 0, fmt.Errorf("Invalid range: line %d does not exist", line+1)
+	}
+	return line, nil
+}
+
+// lastLine returns the last line holding text, the empty line after a final line break does not count
+func lastLine(buffer *Buffer) int {
+	last := buffer.LineCount() - 1
+	if last > 0 && buffer.LineStart(last) == buffer.Len() {
+		last--
+	}
+	return last
+}
+
+// Execute parses and runs a command line. A line with only a range moves to its last line, and a name
+// that is not an ex command calls the ApiBridge command of that name with the argument as a string.
+func (em *ExManager) Execute(text string) error {
+	line, err := ParseExLine(text)
+	if err != nil {
+		return err
+	}
+
+	buffer := em.tg.Buffer.Active()
+	lineRange := ExRange{}
+	if buffer != nil {
+		lineRange.Start, _ = buffer.Cursor()
+		lineRange.End = lineRange.Start
+	}
+	if len(line.Range) > 0 {
+		if buffer == nil {
+			return fmt.Errorf("No buffer for the range in %s", text)
+		}
+		if lineRange.Start, err = line.Range[0].resolve(buffer); err != nil {
+			return err
+		}
+		lineRange.End = lineRange.Start
+		if len(line.Range) > 1 {
+			if lineRange.End, err = line.Range[1].resolve(buffer); err != nil {
+				return err
+			}
+		}
+		if lineRange.Start > lineRange.End {
+			lineRange.Start, lineRange.End = lineRange.End, lineRange.Start
+		}
+		lineRange.Given = true
+	}
+
+	if line.Name == "" {
+		if line.Arg != "" || line.Bang {
+			return fmt.Errorf("Not an editor command: %s", strings.TrimSpace(text))
+		}
+		if lineRange.Given {
+			em.tg.Api.Call("GOTO_LINE", lineRange.End+1)
+		}
+		return nil
+	}
+
+	command, exists := em.Lookup(line.Name)
+	if !exists {
+		if !em.tg.Api.Exists(line.Name) {
+			return fmt.Errorf("Not an editor command: %s", line.Name)
+		}
+		if line.Arg == "" {
+			em.tg.Api.Call(line.Name)
+		} else {
+			em.tg.Api.Call(line.Name, line.Arg)
+		}
+		return nil
+	}
+
+	if err := command.check(line); err != nil {
+		return err
+	}
+
+	em.tg.Api.Call(command.Command, ExArgs{
+		Name:   command.Name,
+		Range:  lineRange,
+		Bang:   line.Bang,
+		Arg:    line.Arg,
+		Args:   strings.Fields(line.Arg),
+		Buffer: buffer,
+	})
+	return nil
+}
+
+// check validates a parsed line against what the command accepts
+func (command ExCommand) check(line ExLine) error {
+	switch {
+	case len(line.Range) > 0 && !command.Range:
+		return fmt.Errorf("No range allowed: %s", command.Usage)
+	case line.Bang && !command.Bang:
+		return fmt.Errorf("No ! allowed: %s", command.Usage)
+	}
+
+	count := len(strings.Fields(line.Arg))
+	switch command.Nargs {
+	case "0":
+		if count > 0 {
+			return fmt.Errorf("Trailing characters: %s", line.Arg)
+		}
+	case "1":
+		if line.Arg == "" {
+			return fmt.Errorf("Argument required: %s", command.Usage)
+		}
+	case "?":
+		if count > 1 {
+			return fmt.Errorf("Only one argument allowed: %s", command.Usage)
+		}
+	case "+":
+		if count == 0 {
+			return fmt.Errorf("Argument required: %s", command.Usage)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package TG
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExLine(t *testing.T) {
+	tests := []struct {
+		text string
+		want ExLine
+		err  bool
+	}{
+		{text: "w", want: ExLine{Name: "w"}},
+		{text: ":  w!  file.txt ", want: ExLine{Name: "w", Bang: true, Arg: "file.txt"}},
+		{text: "s/a/b/g", want: ExLine{Name: "s", Arg: "/a/b/g"}},
+		{text: "%s/a/b/", want: ExLine{Range: []ExAddress{{Line: 1}, {Base: "$"}}, Name: "s", Arg: "/a/b/"}},
+		{text: "12", want: ExLine{Range: []ExAddress{{Line: 12}}}},
+		{text: "1,10d", want: ExLine{Range: []ExAddress{{Line: 1}, {Line: 10}}, Name: "d"}},
+		{text: ".,$y", want: ExLine{Range: []ExAddress{{Base: "."}, {Base: "$"}}, Name: "y"}},
+		{text: "'<,'>s/x/y/", want: ExLine{Range: []ExAddress{{Base: "'<"}, {Base: "'>"}}, Name: "s", Arg: "/x/y/"}},
+		{text: ".+2,$-1d", want: ExLine{Range: []ExAddress{{Base: ".", Offset: 2}, {Base: "$", Offset: -1}}, Name: "d"}},
+		{text: "-,+d", want: ExLine{Range: []ExAddress{{Base: ".", Offset: -1}, {Base: ".", Offset: 1}}, Name: "d"}},
+		{text: "3++-d", want: ExLine{Range: []ExAddress{{Line: 3, Offset: 1}}, Name: "d"}},
+		{text: "1,d", err: true},
+		{text: "'a,'bd", err: true},
+		{text: "", want: ExLine{}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseExLine(test.text)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseExLine(%q) = %+v, want an error", test.text, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseExLine(%q) = %+v, %v, want %+v", test.text, got, err, test.want)
+		}
+	}
+}
+
+func TestExLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // Full name of the command found, empty when none is
+	}{
+		{"s", "substitute"},
+		{"su", "substitute"},
+		{"substitute", "substitute"},
+		{"substitutes", ""},
+		{"w", "write"},
+		{"wr", "write"},
+		{"wq", "wq"},
+		{"x", "xit"},
+		{"sa", ""},
+		{"sav", "saveas"},
+		{"e", "edit"},
+		{"ev", "events"},
+		{"event", "events"},
+		{"eventl", "eventlog"},
+		{"ea", "earlier"},
+		{"n", ""},
+		{"noh", "nohlsearch"},
+		{"nohl", "nohlsearch"},
+		{"nohx", ""},
+		{"re", ""},
+		{"red", "redo"},
+		{"t", ""},
+		{"tr", "trace"},
+	}
+
+	tg := newTestTG(t)
+	for _, test := range tests {
+		command, _ := tg.Ex.Lookup(test.name)
+		if command.Name != test.want {
+			t.Errorf("Lookup(%q) found %q, want %q", test.name, command.Name, test.want)
+		}
+	}
+}
+
+func TestExecuteRange(t *testing.T) {
+	tests := []struct {
+		line string
+		want ExArgs
+		err  bool
+	}{
+		// The buffer has five lines and the cursor is on the third
+		{line: "probe", want: ExArgs{Range: ExRange{Start: 2, End: 2}}},
+		{line: "%probe", want: ExArgs{Range: ExRange{Start: 0, End: 4, Given: true}}},
+		{line: "2,4probe", want: ExArgs{Range: ExRange{Start: 1, End: 3, Given: true}}},
+		{line: "4,2probe", want: ExArgs{Range: ExRange{Start: 1, End: 3, Given: true}}},
+		{line: "5probe", want: ExArgs{Range: ExRange{Start: 4, End: 4, Given: true}}},
+		{line: ".,$probe", want: ExArgs{Range: ExRange{Start: 2, End: 4, Given: true}}},
+		{line: "-,+probe", want: ExArgs{Range: ExRange{Start: 1, End: 3, Given: true}}},
+		{line: ".-2,$-1probe", want: ExArgs{Range: ExRange{Start: 0, End: 3, Given: true}}},
+		{line: "'<,'>probe", want: ExArgs{Range: ExRange{Start: 1, End: 3, Given: true}}},
+		{line: "pro! a  b", want: ExArgs{Range: ExRange{Start: 2, End: 2}, Bang: true, Arg: "a  b", Args: []string{"a", "b"}}},
+		{line: "6probe", err: true},
+		{line: ".+3probe", err: true},
+		{line: "-3probe", err: true},
+		{line: "0probe", err: true},
+		{line: "p", err: true},
+		{line: "2quit", err: true},
+		{line: "quit!"},
+		{line: "noh!", err: true},
+		{line: "noh x", err: true},
+		{line: "sav", err: true},
+		{line: "e a b", err: true},
+		{line: "bogus", err: true},
+	}
+
+	for _, test := range tests {
+		tg := newTestTG(t)
+		buffer := tg.Buffer.Create("test", "one\ntwo\nthree\nfour\nfive\n")
+		tg.Buffer.SetActive(buffer)
+		buffer.MoveCursor(buffer.LineStart(2))
+		buffer.visual = [2]int{buffer.LineStart(1), buffer.LineStart(3)}
+
+		var got ExArgs
+		called := false
+		tg.Api.RegisterCommand("PROBE", func(tg *TG, args ExArgs) any {
+			got, called = args, true
+			return nil
+		})
+		tg.Api.RegisterCommand("quit", func(tg *TG, data any) any { return nil })
+		tg.Ex.RegisterCommand(ExCommand{Name: "probe", Short: "pro", Command: "PROBE", Range: true, Bang: true})
+
+		err := tg.Ex.Execute(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if !called {
+			continue
+		}
+		got.Name, got.Buffer = "", nil
+		if len(got.Args) == 0 {
+			got.Args = nil
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
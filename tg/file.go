@@ -0,0 +1,216 @@
+package TG
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileState remembers what the file looked like on disk when it was last loaded or written
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    fs.FileMode
+	exists  bool
+}
+
+func statFile(path string) (fileState, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileState{mode: 0644}, nil
+	}
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		mode:    info.Mode().Perm(),
+		exists:  true,
+	}, nil
+}
+
+// Open loads a file into a buffer, reusing the buffer if the file is already open.
+// A missing file yields an empty buffer that will create the file on first write.
+func (bm *BufferManager) Open(path string) (*Buffer, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, buffer := range bm.List() {
+		if buffer.Path() == absPath {
+			return buffer, nil
+		}
+	}
+
+	state, err := statFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	content := ""
+	if state.exists {
+		data, err := os.ReadFile(absPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		content = string(data)
+	}
+
+	// The buffer is not shared before add, buffer.created handlers see its file
+	buffer := NewBuffer(filepath.Base(absPath), content)
+	buffer.path = absPath
+	buffer.file = state
+	bm.add(buffer)
+
+	bm.tg.Event.Dispatch("buffer.loaded", buffer)
+	return buffer, nil
+}
+
+// ChangedOnDisk reports whether the file was modified by someone else since it was loaded or written
+func (bm *BufferManager) ChangedOnDisk(buffer *Buffer) bool {
+	path := buffer.Path()
+	if path == "" {
+		return false
+	}
+	state, err := statFile(path)
+	if err != nil {
+		return false
+	}
+
+	buffer.mu.RLock()
+	defer buffer.mu.RUnlock()
+	return state.exists != buffer.file.exists ||
+		state.size != buffer.file.size ||
+		!state.modTime.Equal(buffer.file.modTime)
+}
+
+// Write saves the buffer to path through a temporary file and a rename so a crash never leaves a
+// half-written file behind. An empty path writes back to the buffer's own file.
+func (bm *BufferManager) Write(buffer *Buffer, path string, force bool) error {
+	samePath := path == ""
+	if samePath {
+		path = buffer.Path()
+	}
+	if path == "" {
+		return fmt.Errorf("no file name for buffer %s", buffer.Name())
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	samePath = samePath || absPath == buffer.Path()
+
+	if samePath && !force && bm.ChangedOnDisk(buffer) {
+		return fmt.Errorf("%s changed on disk since it was loaded (add ! to override)", buffer.Name())
+	}
+
+	state, err := statFile(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if state.exists && !samePath && !force {
+		return fmt.Errorf("%s already exists (add ! to override)", path)
+	}
+
+	snapshot := buffer.Snapshot()
+	if err := WriteAtomic(absPath, []byte(snapshot.String()), state.mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	written, err := statFile(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	buffer.mu.Lock()
+	buffer.path = absPath
+	buffer.name = filepath.Base(absPath)
+	buffer.file = written
+	buffer.saved = snapshot.Version
+	buffer.mu.Unlock()
+
+	bm.tg.Event.Dispatch("buffer.written", buffer)
+	return nil
+}
+
+// Reload replaces the buffer content with the file on disk, refusing to drop unsaved edits unless forced
+func (bm *BufferManager) Reload(buffer *Buffer, force bool) error {
+	path := buffer.Path()
+	if path == "" {
+		return fmt.Errorf("buffer %s has no file to reload", buffer.Name())
+	}
+	if buffer.Modified() && !force {
+		return fmt.Errorf("%s has unsaved changes (add ! to override)", buffer.Name())
+	}
+
+	state, err := statFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	// Emptying the buffer and calling it saved would lose the text without a warning
+	if !state.exists {
+		return fmt.Errorf("%s no longer exists", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if err := buffer.Replace(0, buffer.Len(), string(data)); err != nil {
+		return err
+	}
+
+	buffer.mu.Lock()
+	buffer.file = state
+	buffer.saved = buffer.version
+	buffer.mu.Unlock()
+
+	bm.tg.Event.Dispatch("buffer.loaded", buffer)
+	return nil
+}
+
+// WriteAtomic replaces path with data through a temporary file renamed over it, so readers and a
+// crash never see a partly written file. A symlink is followed so the file it points to is replaced,
+// not the link.
+func WriteAtomic(path string, data []byte, mode fs.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if link, err := os.Readlink(path); err == nil {
+		// A link to a file that does not exist yet creates that file
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the rename succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
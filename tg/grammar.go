@@ -0,0 +1,371 @@
+package TG
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// KeyArgs is passed to commands run from a key binding when a count was typed before the keys
+type KeyArgs struct {
+	Count int
+}
+
+// OperatorArgs is what an operator command receives: the range its motion, text object or
+// visual selection covers
+type OperatorArgs struct {
+	Buffer   *Buffer
+	Start    int // Byte offset of the first character in the range
+	End      int // Byte offset just after the range
+	Linewise bool
+	Count    int    // Product of the counts typed before and after the operator
+	Operator string // Keys of the operator, e.g. "d" or "gU"
+	Motion   string // Keys of the motion or text object, empty for visual selections
+}
+
+type grammarState int
+
+const (
+	grammarInvalid grammarState = iota
+	grammarPending
+	grammarDone
+)
+
+// RegisterOperator binds keys to an operator command that receives OperatorArgs. Operators compose
+// with every registered motion and text object and are applied to the selection in visual mode.
+func (km *KeyManager) RegisterOperator(keys string, command string) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.operators[keys] = command
+}
+
+// RegisterMotion binds the motion's keys in normal and visual mode, makes it usable after any
+// operator and exposes it as a command taking an optional count
+func (km *KeyManager) RegisterMotion(motion Motion) {
+	km.tg.Api.Register(CommandInfo{
+		Name:        motion.Name,
+		Description: motion.Description,
+		Params:      []CommandParam{{Name: "count", Description: "Number of times to move", Optional: true}},
+	}, func(tg *TG, data any) any {
+		if buffer := tg.Buffer.Active(); buffer != nil {
+			tg.Buffer.applyMotion(buffer, motion, countArg(data))
+		}
+		return nil
+	})
+
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	for _, keys := range motion.Keys {
+		km.motions[keys] = motion
+	}
+}
+
+// handleGrammar resolves normal and visual mode keys: [count] then a binding, a motion, a text object
+// in visual mode, or an operator followed by [count] and a motion, a text object or the operator again
+// for whole lines
+func (km *KeyManager) handleGrammar(mode string, sequence []string) grammarState {
+	count, rest := parseCount(sequence)
+	if len(rest) == 0 {
+		return grammarPending
+	}
+	keys := strings.Join(rest, "")
+
+	km.lock.RLock()
+	binding := km.bindings(mode)[keys]
+	motion, isMotion := km.motions[keys]
+	object, isObject := km.textObjects[keys]
+	operatorKeys, operator, operatorLength := km.matchOperator(rest)
+	isOperator := operatorLength > 0
+	km.lock.RUnlock()
+
+	switch {
+	case binding != "":
+		km.done(sequence)
+		km.runWithCount(binding, count)
+		return grammarDone
+
+	case isMotion:
+		km.done(sequence)
+		km.tg.Api.Call(motion.Name, KeyArgs{Count: max(count, 1)})
+		return grammarDone
+
+	case isObject && mode == ModeVisual:
+		km.done(sequence)
+		km.selectTextObject(object, count)
+		return grammarDone
+
+	case isOperator && mode == ModeVisual:
+		km.done(sequence)
+		km.applyToSelection(operatorKeys, operator, count)
+		return grammarDone
+
+	case isOperator:
+		return km.handleOperator(sequence, operatorKeys, operator, count, rest[operatorLength:])
+	}
+
+	if km.isGrammarPrefix(mode, keys) {
+		return grammarPending
+	}
+	return grammarInvalid
+}
+
+// handleOperator resolves what follows an operator once its keys are complete
+func (km *KeyManager) handleOperator(sequence []string, operatorKeys string, operator string, count int, after []string) grammarState {
+	opCount, rest := parseCount(after)
+	if len(rest) == 0 {
+		return grammarPending
+	}
+	keys := strings.Join(rest, "")
+	total := max(count, 1) * max(opCount, 1)
+
+	buffer := km.tg.Buffer.Active()
+	if buffer == nil {
+		km.done(sequence)
+		return grammarDone
+	}
+
+	// Doubling the operator, or repeating its last key as in "gUU", acts on whole lines
+	if keys == operatorKeys || keys == operatorKeys[len(operatorKeys)-1:] && len(operatorKeys) > 1 {
+		km.done(sequence)
+		line, _ := buffer.Cursor()
+		km.callOperator(operator, OperatorArgs{
+			Buffer:   buffer,
+			Start:    buffer.LineStart(line),
+			End:      buffer.LineStart(line + total),
+			Linewise: true,
+			Count:    total,
+			Operator: operatorKeys,
+			Motion:   keys,
+		})
+		return grammarDone
+	}
+
+	km.lock.RLock()
+	motion, isMotion := km.motions[keys]
+	object, isObject := km.textObjects[keys]
+	km.lock.RUnlock()
+
+	if isMotion {
+		km.done(sequence)
+		start, end, linewise := km.motionRange(buffer, motion, total, operatorKeys)
+		km.callOperator(operator, OperatorArgs{
+			Buffer:   buffer,
+			Start:    start,
+			End:      end,
+			Linewise: linewise,
+			Count:    total,
+			Operator: operatorKeys,
+			Motion:   keys,
+		})
+		return grammarDone
+	}
+
+	if isObject {
+		km.done(sequence)
+		if start, end, linewise, ok := object(buffer, buffer.Point(), total); ok {
+			km.callOperator(operator, OperatorArgs{
+				Buffer:   buffer,
+				Start:    start,
+				End:      end,
+				Linewise: linewise,
+				Count:    total,
+				Operator: operatorKeys,
+				Motion:   keys,
+			})
+		}
+		return grammarDone
+	}
+
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+	if strings.HasPrefix(operatorKeys, keys) {
+		return grammarPending
+	}
+	for motionKeys := range km.motions {
+		if strings.HasPrefix(motionKeys, keys) {
+			return grammarPending
+		}
+	}
+	for objectKeys := range km.textObjects {
+		if strings.HasPrefix(objectKeys, keys) {
+			return grammarPending
+		}
+	}
+	return grammarInvalid
+}
+
+// motionRange turns a motion from the cursor into the range an operator acts on
+func (km *KeyManager) motionRange(buffer *Buffer, motion Motion, count int, operatorKeys string) (int, int, bool) {
+	from := buffer.Point()
+	to := motion.Fn(buffer, from, count)
+	inclusive := motion.Inclusive
+
+	fromLine, _ := buffer.OffsetToPosition(from)
+	toLine, _ := buffer.OffsetToPosition(to)
+
+	if motion.Name == "WORD_FORWARD" {
+		text := buffer.String()
+		if operatorKeys == "c" && from < len(text) && !unicode.IsSpace(firstRune(text[from:])) {
+			// "cw" changes to the end of the word like "ce", leaving the following space alone
+			to = currentWordEnd(text, from)
+			if count > 1 {
+				to = motionWordEnd(buffer, to, count-1)
+			}
+			toLine, _ = buffer.OffsetToPosition(to)
+			inclusive = true
+		} else if toLine > fromLine {
+			// A word motion never drags the line break of the last word into the range
+			to = buffer.LineEnd(fromLine)
+			toLine = fromLine
+		}
+	}
+
+	start, end := min(from, to), max(from, to)
+	if motion.Linewise {
+		startLine, endLine := min(fromLine, toLine), max(fromLine, toLine)
+		return buffer.LineStart(startLine), buffer.LineStart(endLine + 1), true
+	}
+	if inclusive {
+		line, col := buffer.OffsetToPosition(end)
+		end = buffer.LineStart(line) + nextGrapheme(buffer.Line(line), col)
+	}
+	return start, end, false
+}
+
+// applyToSelection runs an operator over the visual selection and leaves visual mode
+func (km *KeyManager) applyToSelection(operatorKeys string, operator string, count int) {
+	buffer := km.tg.Buffer.Active()
+	if buffer == nil {
+		return
+	}
+	start, end := buffer.Selection()
+	km.SetMode(ModeNormal)
+	km.callOperator(operator, OperatorArgs{
+		Buffer:   buffer,
+		Start:    start,
+		End:      end,
+		Count:    max(count, 1),
+		Operator: operatorKeys,
+	})
+}
+
+func (km *KeyManager) callOperator(command string, args OperatorArgs) {
+	km.tg.Api.Call(command, args)
+}
+
+// matchOperator finds the operator whose keys the sequence starts with, preferring the longest one,
+// and returns how many key presses it took. Caller must hold the lock.
+func (km *KeyManager) matchOperator(sequence []string) (string, string, int) {
+	best, bestCommand, bestLength := "", "", 0
+	for keys, command := range km.operators {
+		joined := ""
+		for i, key := range sequence {
+			joined += key
+			if joined == keys && len(keys) > len(best) {
+				best, bestCommand, bestLength = keys, command, i+1
+			}
+			if len(joined) >= len(keys) {
+				break
+			}
+		}
+	}
+	return best, bestCommand, bestLength
+}
+
+// isGrammarPrefix reports whether more keys could still complete a binding, motion or operator
+func (km *KeyManager) isGrammarPrefix(mode string, keys string) bool {
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+	for binding := range km.bindings(mode) {
+		if strings.HasPrefix(binding, keys) {
+			return true
+		}
+	}
+	for motion := range km.motions {
+		if strings.HasPrefix(motion, keys) {
+			return true
+		}
+	}
+	for operator := range km.operators {
+		if strings.HasPrefix(operator, keys) {
+			return true
+		}
+	}
+	if mode == ModeVisual {
+		for object := range km.textObjects {
+			if strings.HasPrefix(object, keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (km *KeyManager) done(sequence []string) {
+	km.tg.Event.Dispatch("key.sequence.found", strings.Join(sequence, " "))
+	km.resetSequence()
+}
+
+// runWithCount calls a binding, passing the typed count to bindings that carry no argument of their own
+func (km *KeyManager) runWithCount(binding string, count int) {
+	command, argument, hasArgument := strings.Cut(binding, " ")
+	switch {
+	case hasArgument:
+		km.tg.Api.Call(command, argument)
+	case count > 0:
+		km.tg.Api.Call(command, KeyArgs{Count: count})
+	default:
+		km.tg.Api.Call(command)
+	}
+}
+
+// countArg reads an optional repeat count from command data: a plain int, KeyArgs or the argument of ExArgs
+func countArg(data any) int {
+	switch value := data.(type) {
+	case int:
+		if value > 0 {
+			return value
+		}
+	case KeyArgs:
+		if value.Count > 0 {
+			return value.Count
+		}
+	case ExArgs:
+		if count, err := strconv.Atoi(value.Arg); err == nil && count > 0 {
+			return count
+		}
+	}
+	return 1
+}
+
+// currentWordEnd returns the offset of the last character of the word or punctuation run at offset
+func currentWordEnd(text string, offset int) int {
+	class := charClass(firstRune(text[offset:]))
+	for {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		if offset+size >= len(text) || charClass(firstRune(text[offset+size:])) != class {
+			return offset
+		}
+		offset += size
+	}
+}
+
+func firstRune(text string) rune {
+	r, _ := utf8.DecodeRuneInString(text)
+	return r
+}
+
+// parseCount splits a leading count off a key sequence. A lone "0" is not a count, it is a motion.
+func parseCount(sequence []string) (int, []string) {
+	count := 0
+	i := 0
+	for ; i < len(sequence); i++ {
+		key := sequence[i]
+		if len(key) != 1 || key[0] < '0' || key[0] > '9' || (key == "0" && count == 0) {
+			break
+		}
+		count = count*10 + int(key[0]-'0')
+	}
+	return count, sequence[i:]
+}
@@ -0,0 +1,65 @@
+package TG
+
+import (
+	"strings"
+	"testing"
+)
+
+// typeKeys opens text in a buffer with the cursor on the "|" in it, types keys in normal mode
+// and returns the buffer with a "|" where the cursor ended up
+func typeKeys(t *testing.T, text string, keys string) string {
+	t.Helper()
+	tg := newTestTG(t)
+	cursor := strings.Index(text, "|")
+	buffer := tg.Buffer.Create("test", strings.Replace(text, "|", "", 1))
+	tg.Buffer.SetActive(buffer)
+	buffer.MoveCursor(cursor)
+	if err, _ := tg.Api.Call("FEED_KEYS", keys).(error); err != nil {
+		t.Fatalf("%s: %v", keys, err)
+	}
+	content, point := buffer.String(), buffer.Point()
+	return content[:point] + "|" + content[point:]
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		text string
+		keys string
+		want string
+	}{
+		{text: "|one two three", keys: "dw", want: "|two three"},
+		{text: "|one two three", keys: "2dw", want: "|three"},
+		{text: "|one two three", keys: "d2w", want: "|three"},
+		{text: "|a b c d e f", keys: "2d2w", want: "|e f"},
+		{text: "one t|wo three", keys: "de", want: "one t| three"},
+		{text: "one t|wo three", keys: "db", want: "one |wo three"},
+		{text: "one t|wo three", keys: "d$", want: "one |t"},
+		{text: "one t|wo three", keys: "d0", want: "|wo three"},
+		{text: "one t|wo three", keys: "3x", want: "one t|three"},
+		{text: "|(a b) c", keys: "d%", want: "| c"},
+		{text: "one\n|two\nthree", keys: "dd", want: "one\n|three"},
+		{text: "one\ntwo\n|three", keys: "dd", want: "one\n|two"},
+		{text: "|one\ntwo\nthree\nfour", keys: "2dd", want: "|three\nfour"},
+		{text: "|one\ntwo\nthree\nfour", keys: "dj", want: "|three\nfour"},
+		{text: "one\ntwo\n|three\nfour", keys: "dk", want: "one\n|four"},
+		{text: "one\n|two\nthree", keys: "dG", want: "|one"},
+		{text: "one\n|two\nthree", keys: "dgg", want: "|three"},
+		{text: "|one two", keys: "d<Esc>x", want: "|ne two"},
+		{text: "|one two", keys: "cwX", want: "X| two"},
+		{text: "one\n  |two\nthree", keys: "ccX<Esc>", want: "one\n|X\nthree"},
+		{text: "|ab cd", keys: "gUw", want: "|AB cd"},
+		{text: "|AB CD", keys: "gu$", want: "|ab cd"},
+		{text: "|a\nb", keys: ">j", want: "\t|a\n\tb"},
+		{text: "\t|a\n\tb", keys: "<<", want: "|a\n\tb"},
+		{text: "|one two", keys: "ywP", want: "one| one two"},
+		{text: "|one\ntwo", keys: "yyp", want: "one\n|one\ntwo"},
+		{text: "|one\ntwo", keys: "ddp", want: "two\n|one"},
+		{text: "|one\ntwo", keys: "dwu", want: "|one\ntwo"},
+	}
+
+	for _, test := range tests {
+		if got := typeKeys(t, test.text, test.keys); got != test.want {
+			t.Errorf("%s on %q: got %q, want %q", test.keys, test.text, got, test.want)
+		}
+	}
+}
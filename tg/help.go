@@ -0,0 +1,126 @@
+package TG
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+func (em *ExManager) registerHelp() {
+	em.RegisterCommand(ExCommand{Name: "help", Short: "h", Command: "HELP", Usage: ":h[elp] [command]", Nargs: "?", Complete: "command"})
+
+	em.tg.Api.Register(CommandInfo{
+		Name:        "HELP",
+		Description: "Show the commands in a help buffer, or everything known about one of them",
+		Params:      []CommandParam{{Name: "command", Description: "Ex or ApiBridge command name, or ExArgs", Optional: true}},
+		Returns:     "*TG.Buffer",
+	}, func(tg *TG, data any) any {
+		name, _ := data.(string)
+		if args, ok := data.(ExArgs); ok {
+			name = args.Arg
+		}
+
+		text, err := em.helpText(strings.TrimPrefix(name, ":"))
+		if err != nil {
+			tg.Api.Call("AddMessage", "ERROR", err.Error())
+			return nil
+		}
+
+		return tg.Buffer.ShowScratch("[help]", "Help", text)
+	})
+}
+
+// helpText lists every command when name is empty, otherwise it describes the ex command or ApiBridge
+// command called name
+func (em *ExManager) helpText(name string) (string, error) {
+	var out strings.Builder
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+
+	if name == "" {
+		fmt.Fprintf(&out, "Commands, \":help {command}\" describes one of them\n\nEx commands\n")
+		for _, command := range em.Commands() {
+			info, _ := em.tg.Api.DescribeCommand(command.Command)
+			fmt.Fprintf(w, "  %s\t%s\n", command.Usage, info.Description)
+		}
+		w.Flush()
+
+		fmt.Fprintf(&out, "\nApiBridge commands\n")
+		for _, info := range em.tg.Api.ListCommands() {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", info.Name, formatKeys(info.Keys, 3), info.Description)
+		}
+		w.Flush()
+		return out.String(), nil
+	}
+
+	command, isEx := em.Lookup(name)
+	info, exists := em.tg.Api.DescribeCommand(name)
+	if !exists && isEx {
+		info, exists = em.tg.Api.DescribeCommand(command.Command)
+	}
+	if !exists && !isEx {
+		return "", fmt.Errorf("No help for %s", name)
+	}
+
+	if isEx {
+		fmt.Fprintf(&out, "%s\n", command.Usage)
+	} else {
+		fmt.Fprintf(&out, "%s\n", info.Name)
+	}
+	if info.Description != "" {
+		fmt.Fprintf(&out, "    %s\n", info.Description)
+	}
+	out.WriteString("\n")
+
+	if isEx {
+		fmt.Fprintf(w, "Ex command\t:%s, runs %s\n", command.Name, command.Command)
+	}
+	if exists {
+		fmt.Fprintf(w, "Usage\t%s\n", info.Usage())
+		if info.Returns != "" {
+			fmt.Fprintf(w, "Returns\t%s\n", info.Returns)
+		}
+		plugin := info.Plugin
+		if plugin == "" {
+			plugin = "core"
+		}
+		fmt.Fprintf(w, "Defined by\t%s\n", plugin)
+		if len(info.Keys) > 0 {
+			fmt.Fprintf(w, "Keys\t%s\n", formatKeys(info.Keys, 0))
+		}
+	}
+	w.Flush()
+
+	if exists && len(info.Params) > 0 {
+		out.WriteString("\nParameters\n")
+		for _, param := range info.Params {
+			optional := ""
+			if param.Optional {
+				optional = "optional"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", param.Name, param.Type, optional, param.Description)
+		}
+		w.Flush()
+	}
+	return out.String(), nil
+}
+
+// formatKeys lists key bindings, naming the mode of those outside normal mode. A limit above zero
+// keeps only that many.
+func formatKeys(bindings []KeyBinding, limit int) string {
+	var keys []string
+	for i, binding := range bindings {
+		if limit > 0 && i == limit {
+			keys = append(keys, "...")
+			break
+		}
+		key := binding.Keys
+		if binding.Mode != ModeNormal {
+			key = binding.Mode + ":" + key
+		}
+		if binding.Args != "" {
+			key += " (" + binding.Args + ")"
+		}
+		keys = append(keys, key)
+	}
+	return strings.Join(keys, " ")
+}
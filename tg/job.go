@@ -0,0 +1,427 @@
+package TG
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobFunc is the work of a job, it should return soon after ctx is cancelled
+type JobFunc func(ctx context.Context) (any, error)
+
+// Job is work running in the background. Its events and the callbacks given to Then run on the
+// main thread, see JobManager.Post.
+type Job struct {
+	ID      int
+	Name    string
+	Started time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	jobs   *JobManager
+
+	lock     sync.Mutex
+	state    string
+	result   any
+	err      error
+	progress float64 // Between 0 and 1, negative while unknown
+	message  string
+	then     []func(result any, err error)
+}
+
+// JobProgress is the payload of job.progress
+type JobProgress struct {
+	Job      *Job
+	Fraction float64
+	Message  string
+}
+
+type jobKey struct{}
+
+// JobFromContext returns the job a context belongs to, commands run by CallAsync use it to report progress
+func JobFromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobKey{}).(*Job)
+	return job
+}
+
+// Context is cancelled when the job is cancelled
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+func (j *Job) Cancel() {
+	j.cancel()
+}
+
+// Done is closed when the job has finished
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait blocks until the job has finished and returns what it returned. Waiting on the main thread
+// blocks the callbacks the job posts there.
+func (j *Job) Wait() (any, error) {
+	<-j.done
+	return j.Result()
+}
+
+// Result returns what the job returned, nil and nil while it is running
+func (j *Job) Result() (any, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.result, j.err
+}
+
+func (j *Job) State() string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.state
+}
+
+// Progress returns the last reported fraction, negative while unknown, and message
+func (j *Job) Progress() (float64, string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.progress, j.message
+}
+
+// ReportProgress records how far the job got and dispatches job.progress on the main thread. It is
+// safe to call from the job's goroutine.
+func (j *Job) ReportProgress(fraction float64, message string) {
+	j.lock.Lock()
+	j.progress, j.message = fraction, message
+	j.lock.Unlock()
+
+	j.jobs.tg.Event.DispatchAsync("job.progress", JobProgress{Job: j, Fraction: fraction, Message: message})
+}
+
+// Then runs fn on the main thread once the job has finished, right away if it already has
+func (j *Job) Then(fn func(result any, err error)) *Job {
+	j.lock.Lock()
+	if j.state == JobRunning {
+		j.then = append(j.then, fn)
+		j.lock.Unlock()
+		return j
+	}
+	result, err := j.result, j.err
+	j.lock.Unlock()
+
+	j.jobs.Post(func() { fn(result, err) })
+	return j
+}
+
+type JobManager struct {
+	jobs    map[int]*Job
+	counter int
+	lock    sync.Mutex
+	tg      *TG
+
+	mainThread uint64 // Goroutine that made the manager, see OnMainThread
+	posted     []func()
+	stopped    bool // Stop was called, functions posted since are dropped
+	postLock   sync.Mutex
+	wakeup     func()
+	wakeupLock sync.Mutex
+}
+
+// NewJobManager is called on the main thread, NewTG runs there
+func NewJobManager() *JobManager {
+	return &JobManager{
+		jobs:       make(map[int]*Job),
+		mainThread: goroutineID(),
+	}
+}
+
+func (jm *JobManager) Load(tg *TG) {
+	jm.tg = tg
+
+	tg.Event.Declare(EventInfo{Name: "job.started", Description: "A background job started", Payload: "*TG.Job", Aliases: []string{"JOB_STARTED"}})
+	tg.Event.Declare(EventInfo{Name: "job.progress", Description: "A job reported how far it got", Payload: "TG.JobProgress", Aliases: []string{"JOB_PROGRESS"}})
+	tg.Event.Declare(EventInfo{Name: "job.finished", Description: "A job finished, failed or was cancelled", Payload: "*TG.Job", Aliases: []string{"JOB_FINISHED"}})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "LIST_JOBS",
+		Description: "Return the running jobs and those that finished recently",
+		Returns:     "[]*TG.Job",
+	}, func(tg *TG, data any) any {
+		return jm.List()
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "CANCEL_JOB",
+		Description: "Cancel a job by id, or every running job",
+		Params:      []CommandParam{{Name: "id", Description: "Job id, *Job or ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		jm.cancel(data)
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "JOBS",
+		Description: "Show the jobs in a buffer, with force cancel them instead",
+		Params:      []CommandParam{{Name: "args", Description: "ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		if args, ok := data.(ExArgs); ok && args.Bang {
+			jm.cancel(args)
+			return nil
+		}
+		return tg.Buffer.ShowScratch("[jobs]", "Jobs", jobsText(jm.List()))
+	})
+}
+
+// Start runs fn in a new goroutine and dispatches job.started, job.progress and job.finished for it
+func (jm *JobManager) Start(name string, fn JobFunc) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	jm.lock.Lock()
+	jm.counter++
+	job := &Job{
+		ID:       jm.counter,
+		Name:     name,
+		Started:  time.Now(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		jobs:     jm,
+		state:    JobRunning,
+		progress: -1,
+	}
+	job.ctx = context.WithValue(ctx, jobKey{}, job)
+	jm.jobs[job.ID] = job
+	jm.lock.Unlock()
+
+	// Posted like the other job events, so job.started always comes before job.finished
+	jm.tg.Event.DispatchAsync("job.started", job)
+	go jm.run(job, fn)
+	return job
+}
+
+func (jm *JobManager) run(job *Job, fn JobFunc) {
+	result, err := func() (result any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job %s panicked: %v", job.Name, r)
+			}
+		}()
+		return fn(job.ctx)
+	}()
+
+	job.lock.Lock()
+	job.result, job.err = result, err
+	switch {
+	case job.ctx.Err() != nil:
+		job.state = JobCancelled
+	case err != nil:
+		job.state = JobFailed
+	default:
+		job.state = JobDone
+	}
+	then := job.then
+	job.then = nil
+	job.lock.Unlock()
+
+	job.cancel()
+	close(job.done)
+	jm.forgetFinished()
+
+	jm.Post(func() {
+		if job.State() == JobFailed {
+			jm.tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Job %s failed: %v", job.Name, err))
+		}
+		jm.tg.Event.Dispatch("job.finished", job)
+		for _, fn := range then {
+			fn(result, err)
+		}
+	})
+}
+
+// Number of finished jobs kept for LIST_JOBS
+const finishedJobs = 20
+
+// forgetFinished drops the oldest finished jobs beyond those kept for LIST_JOBS
+func (jm *JobManager) forgetFinished() {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+
+	var finished []int
+	for id, job := range jm.jobs {
+		if job.State() != JobRunning {
+			finished = append(finished, id)
+		}
+	}
+	sort.Ints(finished)
+	for len(finished) > finishedJobs {
+		delete(jm.jobs, finished[0])
+		finished = finished[1:]
+	}
+}
+
+// List returns the running jobs and those that finished recently, oldest first
+func (jm *JobManager) List() []*Job {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	jobs := make([]*Job, 0, len(jm.jobs))
+	for _, job := range jm.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// cancel cancels the job data names, every running job when it names none
+func (jm *JobManager) cancel(data any) {
+	id := 0
+	switch value := data.(type) {
+	case int:
+		id = value
+	case *Job:
+		id = value.ID
+	case string:
+		id, _ = strconv.Atoi(value)
+	case ExArgs:
+		id, _ = strconv.Atoi(value.Arg)
+	}
+
+	for _, job := range jm.List() {
+		if id == 0 || job.ID == id {
+			job.Cancel()
+		}
+	}
+}
+
+// Post queues fn to run on the main thread, the goroutine handling keys and drawing. It is the safe
+// way for jobs and other goroutines to touch buffers, windows and events. Post reports false, and
+// fn never runs, once the main thread has stopped.
+func (jm *JobManager) Post(fn func()) bool {
+	jm.postLock.Lock()
+	if jm.stopped {
+		jm.postLock.Unlock()
+		log.Printf("[WARNING] Work posted after the main thread stopped is dropped")
+		return false
+	}
+	jm.posted = append(jm.posted, fn)
+	jm.postLock.Unlock()
+
+	jm.wakeupLock.Lock()
+	wakeup := jm.wakeup
+	jm.wakeupLock.Unlock()
+	if wakeup != nil {
+		wakeup()
+	}
+	return true
+}
+
+// OnMainThread reports whether the caller runs on the main thread
+func (jm *JobManager) OnMainThread() bool {
+	return goroutineID() == jm.mainThread
+}
+
+// OnMain runs fn on the main thread and returns its result: right away when called there, otherwise
+// fn is posted and OnMain waits for it. Nil is returned without running fn once the main thread has
+// stopped. Waiting blocks the goroutine, the main thread must not be waiting on it in turn.
+func (jm *JobManager) OnMain(fn func() any) any {
+	if jm.OnMainThread() {
+		return fn()
+	}
+	result := make(chan any, 1)
+	if !jm.Post(func() { result <- fn() }) {
+		return nil
+	}
+	return <-result
+}
+
+// SetWakeup sets how Post wakes the main thread up to call RunPosted, the UI sets it when it starts.
+// Work posted before that is run on the first wakeup.
+func (jm *JobManager) SetWakeup(wakeup func()) {
+	jm.wakeupLock.Lock()
+	jm.wakeup = wakeup
+	jm.wakeupLock.Unlock()
+
+	jm.postLock.Lock()
+	pending := len(jm.posted) > 0
+	jm.postLock.Unlock()
+	if wakeup != nil && pending {
+		wakeup()
+	}
+}
+
+// RunPosted runs the functions posted so far, the main thread calls it whenever it wakes up
+func (jm *JobManager) RunPosted() {
+	for {
+		jm.postLock.Lock()
+		posted := jm.posted
+		jm.posted = nil
+		jm.postLock.Unlock()
+
+		if len(posted) == 0 {
+			return
+		}
+		for _, fn := range posted {
+			fn()
+		}
+	}
+}
+
+// Stop runs the functions posted so far and drops those posted from then on, the main thread calls
+// it when it stops calling RunPosted so nothing waits on OnMain for ever
+func (jm *JobManager) Stop() {
+	jm.SetWakeup(nil)
+	for {
+		jm.postLock.Lock()
+		posted := jm.posted
+		jm.posted = nil
+		jm.stopped = len(posted) == 0
+		jm.postLock.Unlock()
+
+		if len(posted) == 0 {
+			return
+		}
+		for _, fn := range posted {
+			fn()
+		}
+	}
+}
+
+// goroutineID returns the id of the calling goroutine, which the first line of its stack gives as
+// "goroutine 1 [running]:". Go has no other way to tell goroutines apart.
+func goroutineID() uint64 {
+	var buf [64]byte
+	line := buf[:runtime.Stack(buf[:], false)]
+	line = bytes.TrimPrefix(line, []byte("goroutine "))
+	if end := bytes.IndexByte(line, ' '); end > 0 {
+		line = line[:end]
+	}
+	id, _ := strconv.ParseUint(string(line), 10, 64)
+	return id
+}
+
+// jobsText lists jobs for the :jobs buffer
+func jobsText(jobs []*Job) string {
+	if len(jobs) == 0 {
+		return "No jobs\n"
+	}
+	var out strings.Builder
+	for _, job := range jobs {
+		state := job.State()
+		fraction, message := job.Progress()
+		if state == JobRunning && fraction >= 0 {
+			state = fmt.Sprintf("%s %d%%", state, int(fraction*100))
+		}
+		fmt.Fprintf(&out, "%3d  %-14s %-10s %8s  %s\n", job.ID, state, job.Name, time.Since(job.Started).Round(time.Second), message)
+	}
+	return out.String()
+}
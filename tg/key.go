@@ -1,43 +1,156 @@
 package TG
 
 import (
+	"sort"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+const (
+	ModeNormal  = "normal"
+	ModeInsert  = "insert"
+	ModeVisual  = "visual"
+	ModeCommand = "command"
+	ModeConfirm = "confirm" // Answering y/n/a/q/l for each match of a confirmed substitute
+)
+
+// ModeChange is the payload of mode.changed
+type ModeChange struct {
+	Old string
+	New string
+}
+
 type KeyManager struct {
 	currentSequence []string // Tracks the current sequence of keys pressed
 	tg              *TG
 	recording       bool
+	mode            string
+	keymaps         map[string]map[string]string // Mode -> key sequence -> command, the bindings in effect
+	builtin         map[string]map[string]string // Bindings of the core and the plugins, before the user's mappings
+	builtinSources  map[string]map[string]string // Mode -> key sequence -> who made the built in binding
+	sources         map[string]map[string]string // Mode -> key sequence -> where the binding in effect comes from
+	fileMappings    []KeyMapping                 // Read from the keymap file
+	mappings        []KeyMapping                 // Made with :map and the like while the editor runs
+	keymapProblems  []string                     // What was wrong with the keymap file, reported once plugins are loaded
+	noremap         int                          // Above 0 while FEED_KEYS types keys, they only see the built in bindings
+	motions         map[string]Motion            // Keys -> motion, usable alone or after an operator
+	operators       map[string]string            // Keys -> operator command
+	textObjects     map[string]TextObjectFunc    // Keys -> text object, usable after an operator or in visual mode
+	lock            sync.RWMutex
 }
 
 // Initialize the key manager and set default key combinations
 func NewKeyManager() *KeyManager {
 
-	return &KeyManager{
+	builtin := make(map[string]map[string]string)
+	builtinSources := make(map[string]map[string]string)
+	for mode, keys := range defaultKeys {
+		builtin[mode] = make(map[string]string)
+		builtinSources[mode] = make(map[string]string)
+		for sequence, command := range keys {
+			builtin[mode][sequence] = command
+			builtinSources[mode][sequence] = KeySourceDefault
+		}
+	}
+
+	km := &KeyManager{
 		currentSequence: []string{},
+		mode:            ModeNormal,
+		builtin:         builtin,
+		builtinSources:  builtinSources,
+		motions:         make(map[string]Motion),
+		operators:       make(map[string]string),
+		textObjects:     make(map[string]TextObjectFunc),
 	}
+	km.rebuild()
+	return km
 }
 
 func (km *KeyManager) Load(tg *TG) {
 	km.tg = tg
 	km.recording = true
 
-	km.tg.Event.Register("ON_KEY_COMBINATION_FOUND")
-	km.tg.Event.Register("ON_KEY_COMBINATION_PROCCESSING")
+	tg.Event.Declare(EventInfo{
+		Name:        "key.pressed",
+		Description: "A key was pressed, the UI dispatches it and the KeyManager handles it",
+		Payload:     `string, the key as "a", "Ctrl+R" or "Enter"`,
+		Aliases:     []string{"ON_KEY"},
+		External:    true,
+	})
+	tg.Event.Declare(EventInfo{
+		Name:        "key.sequence.pending",
+		Description: "The keys typed so far start a binding",
+		Payload:     "string, the keys separated by spaces",
+		Aliases:     []string{"ON_KEY_COMBINATION_PROCCESSING"},
+	})
+	tg.Event.Declare(EventInfo{
+		Name:        "key.sequence.found",
+		Description: "The keys typed so far ran a binding or matched none",
+		Payload:     "string, the keys separated by spaces, or nil when they matched none",
+		Aliases:     []string{"ON_KEY_COMBINATION_FOUND"},
+	})
+	tg.Event.Declare(EventInfo{
+		Name:        "mode.changed",
+		Description: "The mode changed",
+		Payload:     "TG.ModeChange",
+		Aliases:     []string{"ON_MODE_CHANGED"},
+	})
 
-	tg.Api.RegisterCommand("RECORD_KEYS", func(tg *TG, data any) {
+	tg.Api.Register(CommandInfo{Name: "RECORD_KEYS", Description: "Start handling key presses"}, func(tg *TG, data any) {
 		km.recording = true
 	})
 
-	tg.Api.RegisterCommand("DONT_RECORD_KEYS", func(tg *TG, data any) {
+	tg.Api.Register(CommandInfo{Name: "DONT_RECORD_KEYS", Description: "Stop handling key presses"}, func(tg *TG, data any) {
 		km.recording = false
 	})
 
-	km.tg.Event.Subscribe("ON_KEY", func(tg *TG, data any) {
+	tg.Api.Register(CommandInfo{
+		Name:        "SET_MODE",
+		Description: "Switch to a mode: normal, insert, visual, command or confirm",
+		Params:      []CommandParam{{Name: "mode"}},
+	}, func(tg *TG, data any) {
+		mode, ok := data.(string)
+		if !ok || mode == "" {
+			tg.Api.Call("AddMessage", "ERROR", "Invalid mode for SET_MODE")
+			return
+		}
+		km.SetMode(mode)
+	})
+
+	tg.Api.Register(CommandInfo{Name: "GET_MODE", Description: "Return the current mode"}, func(tg *TG, data any) any {
+		return km.Mode()
+	})
+
+	km.tg.Event.Subscribe("key.pressed", func(tg *TG, data any) {
 		if km.recording {
 			km.handleKeyEvent(data)
 		}
 	})
+
+	km.loadKeymaps(tg)
+}
+
+func (km *KeyManager) Mode() string {
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+	return km.mode
+}
+
+// SetMode switches the active keymap, dropping any half-typed sequence
+func (km *KeyManager) SetMode(mode string) {
+	km.lock.Lock()
+	old := km.mode
+	km.mode = mode
+	km.currentSequence = []string{}
+	if _, exists := km.keymaps[mode]; !exists {
+		km.keymaps[mode] = make(map[string]string)
+	}
+	km.lock.Unlock()
+
+	if old != mode {
+		km.tg.Event.Dispatch("mode.changed", ModeChange{Old: old, New: mode})
+	}
 }
 
 // Handle a key event: check if it matches a key sequence
@@ -49,57 +162,184 @@ func (km *KeyManager) handleKeyEvent(data any) {
 		return
 	}
 
+	km.lock.Lock()
 	km.currentSequence = append(km.currentSequence, key)
-	if command, exists := km.matchSequence(); exists {
+	sequence := append([]string{}, km.currentSequence...)
+	mode := km.mode
+	km.lock.Unlock()
+
+	// Normal and visual mode understand counts, operators and motions
+	if mode == ModeNormal || mode == ModeVisual {
+		switch km.handleGrammar(mode, sequence) {
+		case grammarPending:
+			km.tg.Event.Dispatch("key.sequence.pending", strings.Join(sequence, " "))
+		case grammarInvalid:
+			km.tg.Event.Dispatch("key.sequence.found", nil)
+			km.resetSequence()
+		}
+		return
+	}
+
+	if command, exists := km.matchSequence(mode, sequence); exists {
 
-		km.tg.Event.Dispatch("ON_KEY_COMBINATION_FOUND", strings.Join(km.currentSequence, " "))
+		km.tg.Event.Dispatch("key.sequence.found", strings.Join(sequence, " "))
 
-		km.tg.Api.Call(command)
+		km.resetSequence()
+		km.run(command)
+	} else if km.isPrefix(mode, sequence) {
 
-		km.currentSequence = []string{}
+		km.tg.Event.Dispatch("key.sequence.pending", strings.Join(sequence, " "))
 	} else {
 
-		matched := false
-		for key := range defaultKeys {
-			if strings.HasPrefix(key, strings.Join(km.currentSequence, "")) {
-				matched = true
-				km.tg.Event.Dispatch("ON_KEY_COMBINATION_PROCCESSING", strings.Join(km.currentSequence, " "))
-				break
-			}
-		}
-		if !matched {
+		km.tg.Event.Dispatch("key.sequence.found", nil)
 
-			km.tg.Event.Dispatch("ON_KEY_COMBINATION_FOUND", nil)
+		km.resetSequence()
 
-			km.currentSequence = []string{}
+		// Keys that are not bound in insert mode are typed into the active buffer, in command mode
+		// they go to whoever owns the command line
+		for _, pending := range sequence {
+			switch mode {
+			case ModeInsert:
+				km.insertKey(pending)
+			case ModeCommand:
+				km.tg.Api.Call("COMMAND_LINE_KEY", pending)
+			}
 		}
 	}
 
 }
 
-func (km *KeyManager) matchSequence() (string, bool) {
+func (km *KeyManager) matchSequence(mode string, sequence []string) (string, bool) {
 
-	var cleanedSeq []string
+	km.lock.RLock()
+	defer km.lock.RUnlock()
 
-	cleanedSeq = append(cleanedSeq, km.currentSequence...)
-
-	seqStr := strings.Join(cleanedSeq, "")
+	seqStr := strings.Join(sequence, "")
 
 	// Check for a direct match
-	if command, exists := defaultKeys[seqStr]; exists && command != "" {
+	if command, exists := km.bindings(mode)[seqStr]; exists && command != "" {
 		return command, true
 	}
 
 	// If it's a group key (e.g., "g" with ""), continue waiting
-	if _, exists := defaultKeys[seqStr]; exists {
-		return "", false
+	return "", false
+}
+
+// isPrefix reports whether the sequence could still grow into a binding of the mode
+func (km *KeyManager) isPrefix(mode string, sequence []string) bool {
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+
+	seqStr := strings.Join(sequence, "")
+	for key := range km.bindings(mode) {
+		if strings.HasPrefix(key, seqStr) {
+			return true
+		}
 	}
+	return false
+}
 
-	return "", false
+func (km *KeyManager) resetSequence() {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.currentSequence = []string{}
+}
+
+// run calls a bound command, a binding may carry one argument after the command name ("SET_MODE insert")
+func (km *KeyManager) run(binding string) {
+	command, argument, hasArgument := strings.Cut(binding, " ")
+	if hasArgument {
+		km.tg.Api.Call(command, argument)
+		return
+	}
+	km.tg.Api.Call(command)
+}
+
+// insertKey turns an unbound insert mode key into an edit of the active buffer
+func (km *KeyManager) insertKey(key string) {
+	switch key {
+	case "Enter":
+		km.tg.Api.Call("INSERT_TEXT", "\n")
+	case "Tab":
+		km.tg.Api.Call("INSERT_TEXT", "\t")
+	case "Backspace", "Backspace2":
+		km.tg.Api.Call("DELETE_BACKWARD")
+	case "Delete":
+		km.tg.Api.Call("DELETE_FORWARD")
+	default:
+		if utf8.RuneCountInString(key) == 1 {
+			km.tg.Api.Call("INSERT_TEXT", key)
+		}
+	}
 }
 
 // RegisterKeyCombination allows plugins to register a key combination with a command
 func (km *KeyManager) RegisterKey(keyCombination string, command string) {
 
-	defaultKeys[keyCombination] = command
+	km.RegisterModeKey(ModeNormal, keyCombination, command)
+}
+
+// RegisterModeKey binds a key combination to a command in a single mode
+func (km *KeyManager) RegisterModeKey(mode string, keyCombination string, command string) {
+
+	source := KeySourceDefault
+	if km.tg != nil && km.tg.Api.Plugin() != "" {
+		source = km.tg.Api.Plugin()
+	}
+
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	if _, exists := km.builtin[mode]; !exists {
+		km.builtin[mode] = make(map[string]string)
+		km.builtinSources[mode] = make(map[string]string)
+	}
+	km.builtin[mode][keyCombination] = command
+	km.builtinSources[mode][keyCombination] = source
+	km.rebuild()
+}
+
+// KeySourceDefault is the source of the bindings the core makes, see KeyBinding
+const KeySourceDefault = "default"
+
+// KeyBinding is a key sequence bound to a command in a mode
+type KeyBinding struct {
+	Mode    string
+	Keys    string
+	Command string
+	Args    string // Argument the binding passes, as in "COMMAND /"
+	Source  string // KeySourceDefault, the plugin that bound the keys, or the keymap line or :map that did
+}
+
+// KeysFor lists the bindings that run a command, motions and operators included, sorted by mode and keys
+func (km *KeyManager) KeysFor(command string) []KeyBinding {
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+
+	var bindings []KeyBinding
+	for mode, keys := range km.keymaps {
+		for sequence, binding := range keys {
+			if name, args, _ := strings.Cut(binding, " "); name == command {
+				bindings = append(bindings, KeyBinding{Mode: mode, Keys: sequence, Command: name, Args: args, Source: km.sources[mode][sequence]})
+			}
+		}
+	}
+	for keys, motion := range km.motions {
+		if motion.Name == command {
+			bindings = append(bindings, KeyBinding{Mode: ModeNormal, Keys: keys, Command: command, Source: KeySourceDefault}, KeyBinding{Mode: ModeVisual, Keys: keys, Command: command, Source: KeySourceDefault})
+		}
+	}
+	for keys, operator := range km.operators {
+		if operator == command {
+			bindings = append(bindings, KeyBinding{Mode: ModeNormal, Keys: keys, Command: command, Source: KeySourceDefault}, KeyBinding{Mode: ModeVisual, Keys: keys, Command: command, Source: KeySourceDefault})
+		}
+	}
+
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Mode != bindings[j].Mode {
+			return bindings[i].Mode < bindings[j].Mode
+		}
+		return bindings[i].Keys < bindings[j].Keys
+	})
+	return bindings
 }
@@ -0,0 +1,480 @@
+package TG
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// Keymap files hold one mapping per line, written as the :map commands without the colon:
+//
+//	# A colon runs the rest as an ex command line
+//	nmap <Ctrl+S> :write
+//	# Anything else is a command and an optional argument
+//	nmap gb BUFFER_START
+//	# map binds in normal and visual mode, nmap, vmap, imap and cmap in one mode
+//	map <Space>f COMMAND /
+//	# noremap binds to other keys, which are read with the built in bindings only
+//	nnoremap Y y$
+//	# unmap removes a binding, a built in one too
+//	nunmap <Ctrl+F>
+//
+// Keys are written as they are typed, named keys in angle brackets: <Esc>, <Enter>, <Space>,
+// <Tab>, <lt> for "<", <Ctrl+R> or <C-r>, <Alt+x> or <M-x>. The mappings are applied over the
+// bindings of the core and the plugins in the order they are read, :map ones after the file's.
+
+// KeyMapping is a line of the keymap file or a :map command
+type KeyMapping struct {
+	Modes   []string
+	Keys    string // The key names joined, as keymaps holds them
+	Binding string // Command and argument, empty for unmap
+	Unmap   bool
+	Source  string // The keymap file and line, or the ex command, that made it
+}
+
+// Mode of each prefix of the map commands, no prefix is normal and visual mode like Vim's
+var mapModes = map[string][]string{
+	"":  {ModeNormal, ModeVisual},
+	"n": {ModeNormal},
+	"v": {ModeVisual},
+	"i": {ModeInsert},
+	"c": {ModeCommand},
+}
+
+// Ex commands and their shortest abbreviations for every mode prefix of map, noremap and unmap
+var mapExCommands = []struct{ name, short string }{
+	{"map", "map"}, {"nmap", "nm"}, {"vmap", "vm"}, {"imap", "im"}, {"cmap", "cm"},
+	{"noremap", "no"}, {"nnoremap", "nn"}, {"vnoremap", "vn"}, {"inoremap", "ino"}, {"cnoremap", "cno"},
+	{"unmap", "unm"}, {"nunmap", "nun"}, {"vunmap", "vu"}, {"iunmap", "iu"}, {"cunmap", "cu"},
+}
+
+// Named keys that are not written the way the UI names them
+var keyNames = map[string]string{
+	"space":  " ",
+	"lt":     "<",
+	"cr":     "Enter",
+	"return": "Enter",
+	"esc":    "Esc",
+	"tab":    "Tab",
+}
+
+// ParseKeys reads keys written as in keymap files, "d<Ctrl+W>" gives "d" and "Ctrl+W"
+func ParseKeys(text string) ([]string, error) {
+	var keys []string
+	for text != "" {
+		if strings.HasPrefix(text, "<") {
+			if end := strings.IndexByte(text, '>'); end > 1 {
+				keys = append(keys, keyName(text[1:end]))
+				text = text[end+1:]
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(text)
+		if r == utf8.RuneError && size == 1 {
+			return nil, fmt.Errorf("invalid UTF-8 in keys %q", text)
+		}
+		keys = append(keys, text[:size])
+		text = text[size:]
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+// keyName turns the name of a key between angle brackets into the name the UI gives it
+func keyName(name string) string {
+	if key, exists := keyNames[strings.ToLower(name)]; exists {
+		return key
+	}
+	if len(name) > 2 && name[1] == '-' {
+		switch strings.ToUpper(name[:1]) {
+		case "C":
+			return "Ctrl+" + strings.ToUpper(name[2:])
+		case "M", "A":
+			return "Alt+" + name[2:]
+		}
+	}
+	return name
+}
+
+// parseMapping reads a map command, name is the full name of the command such as "nnoremap"
+func parseMapping(name string, arg string) (KeyMapping, error) {
+	prefix, kind := "", ""
+	for _, suffix := range []string{"noremap", "unmap", "map"} {
+		if before, found := strings.CutSuffix(name, suffix); found {
+			prefix, kind = before, suffix
+			break
+		}
+	}
+	modes, exists := mapModes[prefix]
+	if kind == "" || !exists {
+		return KeyMapping{}, fmt.Errorf("Unknown map command %s", name)
+	}
+	mapping := KeyMapping{Modes: modes, Unmap: kind == "unmap"}
+
+	lhs, rhs := cutField(arg)
+	keys, err := ParseKeys(lhs)
+	if err != nil {
+		return KeyMapping{}, fmt.Errorf("%s: %v", name, err)
+	}
+	mapping.Keys = strings.Join(keys, "")
+
+	switch {
+	case mapping.Unmap:
+		if rhs != "" {
+			return KeyMapping{}, fmt.Errorf("%s takes only the keys, got %s", name, rhs)
+		}
+	case rhs == "":
+		return KeyMapping{}, fmt.Errorf("%s %s: missing what to map the keys to", name, lhs)
+	case kind == "noremap":
+		if _, err := ParseKeys(rhs); err != nil {
+			return KeyMapping{}, fmt.Errorf("%s %s: %v", name, lhs, err)
+		}
+		mapping.Binding = "FEED_KEYS " + rhs
+	case strings.HasPrefix(rhs, ":"):
+		mapping.Binding = "EX " + strings.TrimSpace(rhs[1:])
+	default:
+		mapping.Binding = rhs
+	}
+	return mapping, nil
+}
+
+// cutField splits text at the first run of spaces or tabs, both parts trimmed
+func cutField(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if end := strings.IndexAny(text, " \t"); end >= 0 {
+		return text[:end], strings.TrimSpace(text[end:])
+	}
+	return text, ""
+}
+
+// readKeymap reads a keymap file, the lines that cannot be read are skipped and described
+func readKeymap(path string) ([]KeyMapping, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mappings []KeyMapping
+	var problems []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mapping, err := parseMapping(cutField(line))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %v", path, i+1, err))
+			continue
+		}
+		mapping.Source = fmt.Sprintf("%s:%d", path, i+1)
+		mappings = append(mappings, mapping)
+	}
+	return mappings, problems, nil
+}
+
+// keymapPath is the keymap option, tg-edit/keymap in the user config directory when it is empty
+func (km *KeyManager) keymapPath() string {
+	if path, _ := km.tg.Config.Get("keymap"); path != "" {
+		return path
+	}
+	if path := userConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "keymap")
+	}
+	return ""
+}
+
+// loadKeymap reads the keymap file again and applies its mappings in place of the old ones
+func (km *KeyManager) loadKeymap() []string {
+	path := km.keymapPath()
+	var mappings []KeyMapping
+	var problems []string
+	if path != "" {
+		var err error
+		mappings, problems, err = readKeymap(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, fmt.Sprintf("Reading the keymap: %v", err))
+		}
+	}
+
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.fileMappings = mappings
+	km.rebuild()
+	return problems
+}
+
+// checkMappings describes the mappings that bind keys to a command nobody registered
+func (km *KeyManager) checkMappings() []string {
+	km.lock.RLock()
+	mappings := append(append([]KeyMapping(nil), km.fileMappings...), km.mappings...)
+	km.lock.RUnlock()
+
+	var problems []string
+	for _, mapping := range mappings {
+		command, _, _ := strings.Cut(mapping.Binding, " ")
+		if command != "" && !km.tg.Api.Exists(command) {
+			problems = append(problems, fmt.Sprintf("%s: unknown command %s", mapping.Source, command))
+		}
+	}
+	return problems
+}
+
+// Map applies a map, noremap or unmap command made while the editor runs
+func (km *KeyManager) Map(name string, arg string) error {
+	mapping, err := parseMapping(name, arg)
+	if err != nil {
+		return err
+	}
+	mapping.Source = ":" + name
+
+	if command, _, _ := strings.Cut(mapping.Binding, " "); command != "" && !km.tg.Api.Exists(command) {
+		return fmt.Errorf("Unknown command %s", command)
+	}
+
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	if mapping.Unmap {
+		found := false
+		for _, mode := range mapping.Modes {
+			_, exists := km.keymaps[mode][mapping.Keys]
+			found = found || exists
+		}
+		if !found {
+			return fmt.Errorf("No such mapping: %s", strings.TrimSpace(arg))
+		}
+	}
+	km.mappings = append(km.mappings, mapping)
+	km.rebuild()
+	return nil
+}
+
+// rebuild puts the user's mappings over the built in bindings, the caller holds the lock
+func (km *KeyManager) rebuild() {
+	keymaps := make(map[string]map[string]string)
+	sources := make(map[string]map[string]string)
+	for mode, keys := range km.builtin {
+		keymaps[mode] = make(map[string]string)
+		sources[mode] = make(map[string]string)
+		for sequence, binding := range keys {
+			keymaps[mode][sequence] = binding
+			sources[mode][sequence] = km.builtinSources[mode][sequence]
+		}
+	}
+
+	for _, mapping := range append(append([]KeyMapping(nil), km.fileMappings...), km.mappings...) {
+		for _, mode := range mapping.Modes {
+			if _, exists := keymaps[mode]; !exists {
+				keymaps[mode] = make(map[string]string)
+				sources[mode] = make(map[string]string)
+			}
+			if mapping.Unmap {
+				delete(keymaps[mode], mapping.Keys)
+				delete(sources[mode], mapping.Keys)
+				continue
+			}
+			keymaps[mode][mapping.Keys] = mapping.Binding
+			sources[mode][mapping.Keys] = mapping.Source
+		}
+	}
+
+	// Modes switched to before any binding was made for them
+	for mode := range km.keymaps {
+		if _, exists := keymaps[mode]; !exists {
+			keymaps[mode] = make(map[string]string)
+		}
+	}
+	km.keymaps = keymaps
+	km.sources = sources
+}
+
+// bindings returns the bindings keys are looked up in, the caller holds the lock
+func (km *KeyManager) bindings(mode string) map[string]string {
+	if km.noremap > 0 {
+		return km.builtin[mode]
+	}
+	return km.keymaps[mode]
+}
+
+// Bindings lists the bindings in effect in a mode, every mode when it is empty, sorted by mode and keys
+func (km *KeyManager) Bindings(mode string) []KeyBinding {
+	km.lock.RLock()
+	defer km.lock.RUnlock()
+
+	var bindings []KeyBinding
+	for bindingMode, keys := range km.keymaps {
+		if mode != "" && bindingMode != mode {
+			continue
+		}
+		for sequence, binding := range keys {
+			if binding == "" {
+				continue // Only waits for the keys that follow, as "g" does
+			}
+			command, args, _ := strings.Cut(binding, " ")
+			bindings = append(bindings, KeyBinding{Mode: bindingMode, Keys: sequence, Command: command, Args: args, Source: km.sources[bindingMode][sequence]})
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Mode != bindings[j].Mode {
+			return bindings[i].Mode < bindings[j].Mode
+		}
+		return bindings[i].Keys < bindings[j].Keys
+	})
+	return bindings
+}
+
+// FeedKeys handles keys as if they were pressed, looking them up in the built in bindings only
+func (km *KeyManager) FeedKeys(keys []string) {
+	km.lock.Lock()
+	km.noremap++
+	km.lock.Unlock()
+
+	defer func() {
+		km.lock.Lock()
+		km.noremap--
+		km.lock.Unlock()
+	}()
+	for _, key := range keys {
+		km.handleKeyEvent(key)
+	}
+}
+
+// loadKeymaps reads the keymap file, reads it again when it or the keymap option changes and
+// registers the commands behind :map and the like
+func (km *KeyManager) loadKeymaps(tg *TG) {
+	tg.Config.Declare("keymap", OptionString, nil, "Keymap file, tg-edit/keymap in the user config directory when empty")
+
+	km.keymapProblems = km.loadKeymap()
+
+	// Mappings may bind commands of plugins, they are checked once the plugins are loaded
+	tg.Event.SubscribeWith("app.started", SubscribeOptions{Priority: PriorityLow}, func(tg *TG, e *EventContext) {
+		for _, problem := range append(km.keymapProblems, km.checkMappings()...) {
+			tg.Api.Call("AddMessage", "WARNING", problem)
+		}
+		km.keymapProblems = nil
+	})
+
+	reload := func() {
+		problems := append(km.loadKeymap(), km.checkMappings()...)
+		for _, problem := range problems {
+			tg.Api.Call("AddMessage", "WARNING", problem)
+		}
+	}
+	tg.Config.WatchFiles(func() []string {
+		if path := km.keymapPath(); path != "" {
+			return []string{path}
+		}
+		return nil
+	}, reload)
+	tg.Event.Subscribe("config.changed", func(tg *TG, data any) {
+		changes, _ := data.([]ConfigChange)
+		for _, change := range changes {
+			if change.Key == "keymap" {
+				reload()
+			}
+		}
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "FEED_KEYS",
+		Description: "Handle keys as if they were pressed, with the built in bindings only",
+		Params:      []CommandParam{{Name: "keys", Description: `Keys as in keymap files, e.g. "y$" or "<Esc>"`}},
+	}, func(tg *TG, data any) any {
+		text, _ := data.(string)
+		keys, err := ParseKeys(text)
+		if err != nil {
+			tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("FEED_KEYS: %v", err))
+			return nil
+		}
+		km.FeedKeys(keys)
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "LIST_KEYS",
+		Description: "Return the key bindings in effect and where they come from",
+		Params:      []CommandParam{{Name: "mode", Description: "Only the bindings of this mode", Optional: true}},
+		Returns:     "[]TG.KeyBinding",
+	}, func(tg *TG, data any) any {
+		mode, _ := data.(string)
+		return km.Bindings(mode)
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "MAP",
+		Description: "Map keys to a command or other keys, or unmap them, without keys list the bindings",
+		Params:      []CommandParam{{Name: "args", Description: `ExArgs, or a map command line such as "nmap gb BUFFER_START"`}},
+	}, func(tg *TG, data any) any {
+		var name, arg string
+		switch args := data.(type) {
+		case ExArgs:
+			name, arg = args.Name, args.Arg
+		case string:
+			name, arg = cutField(args)
+		}
+
+		// Without keys, or with keys and nothing to map them to, show the bindings
+		lhs, rhs := cutField(arg)
+		if !strings.HasSuffix(name, "unmap") && rhs == "" {
+			return tg.Buffer.ShowScratch("[keymap]", "Keymap", km.keymapText(name, lhs))
+		}
+
+		if err := km.Map(name, arg); err != nil {
+			tg.Api.Call("AddMessage", "ERROR", err.Error())
+		}
+		return nil
+	})
+}
+
+// keymapText lists the bindings of the modes a map command works in, those starting with lhs when
+// it is not empty
+func (km *KeyManager) keymapText(name string, lhs string) string {
+	modePrefix := strings.TrimSuffix(strings.TrimSuffix(name, "noremap"), "map")
+	modes := mapModes[modePrefix]
+	if modes == nil {
+		modes = mapModes[""]
+	}
+	var prefix string
+	if lhs != "" {
+		if parsed, err := ParseKeys(lhs); err == nil {
+			prefix = strings.Join(parsed, "")
+		}
+	}
+
+	var out strings.Builder
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Mode\tKeys\tCommand\tSource\n")
+	for _, mode := range modes {
+		for _, binding := range km.Bindings(mode) {
+			if !strings.HasPrefix(binding.Keys, prefix) {
+				continue
+			}
+			command := strings.TrimSpace(binding.Command + " " + binding.Args)
+			keys := strings.ReplaceAll(binding.Keys, " ", "<Space>")
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", binding.Mode, keys, command, binding.Source)
+		}
+	}
+	w.Flush()
+	return out.String()
+}
+
+func (em *ExManager) registerMap() {
+	for _, command := range mapExCommands {
+		usage := fmt.Sprintf(":%s[%s] [{keys} [{command} | :{ex command}]]", command.short, strings.TrimPrefix(command.name, command.short))
+		if strings.HasSuffix(command.name, "noremap") {
+			usage = fmt.Sprintf(":%s[%s] [{keys} [{keys}]]", command.short, strings.TrimPrefix(command.name, command.short))
+		}
+		if strings.HasSuffix(command.name, "unmap") {
+			usage = fmt.Sprintf(":%s[%s] {keys}", command.short, strings.TrimPrefix(command.name, command.short))
+		}
+		usage = strings.Replace(usage, "[]", "", 1)
+		em.RegisterCommand(ExCommand{Name: command.name, Short: command.short, Command: "MAP", Usage: usage, Nargs: "*"})
+	}
+}
@@ -0,0 +1,109 @@
+package TG
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+		err  bool
+	}{
+		{text: "dd", want: []string{"d", "d"}},
+		{text: "d<Ctrl+W>", want: []string{"d", "Ctrl+W"}},
+		{text: "<C-r>", want: []string{"Ctrl+R"}},
+		{text: "<M-x><A-y>", want: []string{"Alt+x", "Alt+y"}},
+		{text: "<Esc><esc><CR><Return><Tab>", want: []string{"Esc", "Esc", "Enter", "Enter", "Tab"}},
+		{text: "<lt>", want: []string{"<"}},
+		{text: "<Space>f", want: []string{" ", "f"}},
+		{text: "<>", want: []string{"<", ">"}},
+		{text: "<x", want: []string{"<", "x"}},
+		{text: "é<F1>", want: []string{"é", "F1"}},
+		{text: "", err: true},
+		{text: "a\xff", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseKeys(test.text)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseKeys(%q) = %q, want an error", test.text, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseKeys(%q) = %q, %v, want %q", test.text, got, err, test.want)
+		}
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want KeyMapping
+		err  bool
+	}{
+		{
+			name: "nmap",
+			arg:  "gb BUFFER_START",
+			want: KeyMapping{Modes: []string{ModeNormal}, Keys: "gb", Binding: "BUFFER_START"},
+		},
+		{
+			name: "map",
+			arg:  "<Space>f  COMMAND /",
+			want: KeyMapping{Modes: []string{ModeNormal, ModeVisual}, Keys: " f", Binding: "COMMAND /"},
+		},
+		{
+			name: "imap",
+			arg:  "<C-s> :write",
+			want: KeyMapping{Modes: []string{ModeInsert}, Keys: "Ctrl+S", Binding: "EX write"},
+		},
+		{
+			name: "cmap",
+			arg:  "<C-a> :  s/a/b/g",
+			want: KeyMapping{Modes: []string{ModeCommand}, Keys: "Ctrl+A", Binding: "EX s/a/b/g"},
+		},
+		{
+			name: "nnoremap",
+			arg:  "Y y$",
+			want: KeyMapping{Modes: []string{ModeNormal}, Keys: "Y", Binding: "FEED_KEYS y$"},
+		},
+		{
+			name: "vnoremap",
+			arg:  "<Tab> <Esc>",
+			want: KeyMapping{Modes: []string{ModeVisual}, Keys: "Tab", Binding: "FEED_KEYS <Esc>"},
+		},
+		{
+			name: "nunmap",
+			arg:  "<Ctrl+F>",
+			want: KeyMapping{Modes: []string{ModeNormal}, Keys: "Ctrl+F", Unmap: true},
+		},
+		{
+			name: "unmap",
+			arg:  "  x  ",
+			want: KeyMapping{Modes: []string{ModeNormal, ModeVisual}, Keys: "x", Unmap: true},
+		},
+		{name: "nunmap", arg: "x y", err: true},
+		{name: "nmap", arg: "x", err: true},
+		{name: "nmap", arg: "", err: true},
+		{name: "nnoremap", arg: "x \xff", err: true},
+		{name: "xmap", arg: "x y", err: true},
+		{name: "nmapping", arg: "x y", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseMapping(test.name, test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseMapping(%q, %q) = %+v, want an error", test.name, test.arg, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMapping(%q, %q) = %+v, %v, want %+v", test.name, test.arg, got, err, test.want)
+		}
+	}
+}
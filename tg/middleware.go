@@ -0,0 +1,295 @@
+package TG
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of calls the tracer keeps when the "tracesize" option is not set
+const defaultTraceSize = 500
+
+// Commands the tracer leaves out when the "traceignore" option is not set, drawing calls them for
+// every frame and they would push every other call out
+var defaultTraceIgnore = []string{"GET_STYLES", "SEARCH_MATCHES"}
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// CallContext is a call on its way through the middleware
+type CallContext struct {
+	Command string
+	Args    []any           // Arguments after *TG, middleware may change them
+	Caller  string          // Plugin owning the command that made the call, empty for the core
+	Depth   int             // Number of commands running when the call was made
+	Seq     uint64          // Increases with every call
+	Context context.Context // Passed to commands taking a context.Context the caller left out
+}
+
+// CallHandler runs a call, the last one in the chain runs the command itself
+type CallHandler func(call *CallContext) (any, error)
+
+// Middleware wraps every call. It may look at or change the call, answer it without calling next,
+// or change what next returned.
+type Middleware func(call *CallContext, next CallHandler) (any, error)
+
+type namedMiddleware struct {
+	name string
+	fn   Middleware
+}
+
+// Use adds a middleware after those already added, so it runs closer to the command. Using a name
+// again replaces that middleware in place.
+func (api *ApiBridge) Use(name string, middleware Middleware) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for i := range api.middleware {
+		if api.middleware[i].name == name {
+			api.middleware[i].fn = middleware
+			return
+		}
+	}
+	api.middleware = append(api.middleware, namedMiddleware{name, middleware})
+}
+
+// RemoveMiddleware removes a middleware added with Use
+func (api *ApiBridge) RemoveMiddleware(name string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for i := range api.middleware {
+		if api.middleware[i].name == name {
+			api.middleware = append(api.middleware[:i], api.middleware[i+1:]...)
+			return
+		}
+	}
+}
+
+// chain wraps the handler in every middleware, the first added ends up outermost
+func (api *ApiBridge) chain(handler CallHandler) CallHandler {
+	api.mu.RLock()
+	middleware := append([]namedMiddleware{}, api.middleware...)
+	api.mu.RUnlock()
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		fn, next := middleware[i].fn, handler
+		handler = func(call *CallContext) (any, error) {
+			return fn(call, next)
+		}
+	}
+	return handler
+}
+
+// LogCalls writes every call and how it ended to the log
+func LogCalls() Middleware {
+	return func(call *CallContext, next CallHandler) (any, error) {
+		log.Printf("Calling function: %s", call.Command)
+		result, err := next(call)
+		if err == nil {
+			log.Printf("Function %s executed successfully", call.Command)
+		}
+		return result, err
+	}
+}
+
+// LogArguments writes the arguments of every call to the log
+func LogArguments() Middleware {
+	return func(call *CallContext, next CallHandler) (any, error) {
+		log.Printf("Arguments of %s: %s", call.Command, summarizeArgs(call.Args))
+		return next(call)
+	}
+}
+
+// Permissions refuses calls check returns an error for, the call fails with ErrPermissionDenied
+func Permissions(check func(call *CallContext) error) Middleware {
+	return func(call *CallContext, next CallHandler) (any, error) {
+		if err := check(call); err != nil {
+			return nil, &CallError{Command: call.Command, Err: ErrPermissionDenied, Detail: err.Error()}
+		}
+		return next(call)
+	}
+}
+
+// DryRun skips the commands match selects and logs what would have run, the calls return nil
+func DryRun(match func(call *CallContext) bool) Middleware {
+	return func(call *CallContext, next CallHandler) (any, error) {
+		if match(call) {
+			log.Printf("Dry run: %s %s", call.Command, summarizeArgs(call.Args))
+			return nil, nil
+		}
+		return next(call)
+	}
+}
+
+// TraceEntry is a call the tracer recorded. Arguments and result are kept as short text, not the
+// values, so the trace does not hold on to buffers and their contents.
+type TraceEntry struct {
+	Seq      uint64
+	Time     time.Time
+	Command  string
+	Caller   string
+	Depth    int
+	Args     string
+	Result   string
+	Err      error
+	Duration time.Duration
+}
+
+// Tracer keeps the most recent calls in a ring buffer
+type Tracer struct {
+	entries []TraceEntry
+	next    int
+	full    bool
+	ignored map[string]bool // Commands not recorded
+	lock    sync.Mutex
+}
+
+func NewTracer(size int) *Tracer {
+	return &Tracer{entries: make([]TraceEntry, max(size, 1))}
+}
+
+// Ignore sets the commands the tracer does not record, replacing those set before
+func (t *Tracer) Ignore(commands []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ignored = make(map[string]bool, len(commands))
+	for _, command := range commands {
+		t.ignored[command] = true
+	}
+}
+
+// Middleware records every call passing through it but the ignored ones
+func (t *Tracer) Middleware() Middleware {
+	return func(call *CallContext, next CallHandler) (any, error) {
+		t.lock.Lock()
+		ignored := t.ignored[call.Command]
+		t.lock.Unlock()
+		if ignored {
+			return next(call)
+		}
+
+		start := time.Now()
+		args := summarizeArgs(call.Args) // Before the command can change them
+		result, err := next(call)
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.entries[t.next] = TraceEntry{
+			Seq:      call.Seq,
+			Time:     start,
+			Command:  call.Command,
+			Caller:   call.Caller,
+			Depth:    call.Depth,
+			Args:     args,
+			Result:   summarize(result),
+			Err:      err,
+			Duration: time.Since(start),
+		}
+		t.next = (t.next + 1) % len(t.entries)
+		t.full = t.full || t.next == 0
+		return result, err
+	}
+}
+
+// Entries returns the recorded calls in the order they were made, calls made by a command follow it
+func (t *Tracer) Entries() []TraceEntry {
+	t.lock.Lock()
+	entries := append([]TraceEntry{}, t.entries[:t.next]...)
+	if t.full {
+		entries = append(append([]TraceEntry{}, t.entries[t.next:]...), entries...)
+	}
+	t.lock.Unlock()
+
+	// Entries are recorded when calls return, so nested calls come before their caller
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+func (t *Tracer) Clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.next, t.full = 0, false
+	clear(t.entries)
+}
+
+// traceSize is the "tracesize" option, the number of calls the tracer keeps
+func traceSize(tg *TG) int {
+	if size, ok := tg.Config.GetInt("tracesize"); ok && size > 0 {
+		return size
+	}
+	return defaultTraceSize
+}
+
+// traceIgnore is the "traceignore" option, the commands the tracer does not record
+func traceIgnore(tg *TG) []string {
+	commands, _ := tg.Config.GetStringList("traceignore")
+	return commands
+}
+
+// traceText formats the recorded calls whose command contains filter, nested calls are indented
+func traceText(entries []TraceEntry, filter string) string {
+	var out strings.Builder
+	for _, entry := range entries {
+		if filter != "" && !strings.Contains(strings.ToLower(entry.Command), strings.ToLower(filter)) {
+			continue
+		}
+		caller := entry.Caller
+		if caller == "" {
+			caller = "core"
+		}
+		outcome := "-> " + entry.Result
+		if entry.Err != nil {
+			outcome = "!! " + entry.Err.Error()
+		}
+		fmt.Fprintf(&out, "%s %8s %-14s %s%s %s %s\n",
+			entry.Time.Format("15:04:05.000"),
+			entry.Duration.Round(time.Microsecond),
+			caller,
+			strings.Repeat("  ", entry.Depth),
+			entry.Command,
+			entry.Args,
+			outcome,
+		)
+	}
+	if out.Len() == 0 {
+		return "No calls recorded\n"
+	}
+	return out.String()
+}
+
+func summarizeArgs(args []any) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = summarize(arg)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// summarize shortens a value for the trace, buffers are named instead of printing their text
+func summarize(value any) string {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case *Buffer:
+		return fmt.Sprintf("buffer %d %q", v.ID, v.Name())
+	case string:
+		text = strconv.Quote(v)
+	case ExArgs:
+		text = fmt.Sprintf("ExArgs{%s %q}", v.Name, v.Arg)
+	case OperatorArgs:
+		text = fmt.Sprintf("OperatorArgs{%d-%d}", v.Start, v.End)
+	default:
+		text = strings.ReplaceAll(fmt.Sprintf("%v", v), "\n", `\n`)
+	}
+
+	const limit = 60
+	if runes := []rune(text); len(runes) > limit {
+		text = string(runes[:limit]) + "..."
+	}
+	return text
+}
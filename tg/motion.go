@@ -0,0 +1,346 @@
+package TG
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MotionFunc returns where the cursor ends up after moving count times from offset
+type MotionFunc func(b *Buffer, offset int, count int) int
+
+// Motion is a cursor movement exposed as a command and usable after operators
+type Motion struct {
+	Name        string
+	Description string
+	Keys        []string
+	Fn          MotionFunc
+	Vertical    bool // Keeps the display column of the cursor, like j and k
+	Linewise    bool // Operators act on whole lines
+	Inclusive   bool // Operators include the character the motion lands on
+}
+
+var defaultMotions = []Motion{
+	{Name: "MOVE_LEFT", Description: "Move left", Keys: []string{"h", "Left"}, Fn: motionLeft},
+	{Name: "MOVE_RIGHT", Description: "Move right", Keys: []string{"l", "Right"}, Fn: motionRight},
+	{Name: "MOVE_UP", Description: "Move up a line", Keys: []string{"k", "Up"}, Fn: motionUp, Vertical: true, Linewise: true},
+	{Name: "MOVE_DOWN", Description: "Move down a line", Keys: []string{"j", "Down"}, Fn: motionDown, Vertical: true, Linewise: true},
+	{Name: "WORD_FORWARD", Description: "Move to the start of the next word", Keys: []string{"w"}, Fn: motionWordForward},
+	{Name: "WORD_BACKWARD", Description: "Move to the start of the previous word", Keys: []string{"b"}, Fn: motionWordBackward},
+	{Name: "WORD_END", Description: "Move to the end of the word", Keys: []string{"e"}, Fn: motionWordEnd, Inclusive: true},
+	{Name: "LINE_START", Description: "Move to the start of the line", Keys: []string{"0", "Home"}, Fn: motionLineStart},
+	{Name: "LINE_FIRST_NON_BLANK", Description: "Move to the first non-blank character of the line", Keys: []string{"^"}, Fn: motionFirstNonBlank},
+	{Name: "LINE_END", Description: "Move to the end of the line", Keys: []string{"$", "End"}, Fn: motionLineEnd},
+	{Name: "BUFFER_START", Description: "Move to the first line, or to line count", Keys: []string{"gg"}, Fn: motionBufferStart, Linewise: true},
+	{Name: "BUFFER_END", Description: "Move to the last line, or to line count", Keys: []string{"G"}, Fn: motionBufferEnd, Linewise: true},
+	{Name: "MATCH_BRACKET", Description: "Move to the bracket matching the one under the cursor", Keys: []string{"%"}, Fn: motionMatchBracket, Inclusive: true},
+	{Name: "PAGE_DOWN", Description: "Move down a page, the height of the window less two lines", Keys: []string{"Ctrl+F", "PgDn"}, Fn: motionPageDown, Vertical: true, Linewise: true},
+	{Name: "PAGE_UP", Description: "Move up a page, the height of the window less two lines", Keys: []string{"Ctrl+B", "PgUp"}, Fn: motionPageUp, Vertical: true, Linewise: true},
+}
+
+// Lines a page has while no window showed the buffer, that of a terminal nobody resized
+const defaultViewHeight = 24
+
+// Keys that also move the cursor while typing
+var insertMotionKeys = map[string]string{
+	"Left":  "MOVE_LEFT",
+	"Right": "MOVE_RIGHT",
+	"Up":    "MOVE_UP",
+	"Down":  "MOVE_DOWN",
+	"Home":  "LINE_START",
+	"End":   "LINE_END",
+	"PgDn":  "PAGE_DOWN",
+	"PgUp":  "PAGE_UP",
+}
+
+func (bm *BufferManager) registerMotions() {
+	for _, motion := range defaultMotions {
+		bm.tg.Key.RegisterMotion(motion)
+	}
+	for key, command := range insertMotionKeys {
+		bm.tg.Key.RegisterModeKey(ModeInsert, key, command)
+	}
+
+	bm.tg.Api.Register(CommandInfo{
+		Name:        "GOTO_LINE",
+		Description: "Move the cursor to the first non-blank character of a line, counted from 1",
+		Params:      []CommandParam{{Name: "line", Description: "Line number counted from 1"}},
+	}, func(tg *TG, data any) any {
+		line, ok := data.(int)
+		buffer := bm.Active()
+		if !ok || buffer == nil {
+			return nil
+		}
+		buffer.MoveCursor(motionFirstNonBlank(buffer, buffer.LineStart(line-1), 1))
+		return nil
+	})
+
+	// Leaving insert mode puts the cursor back on a character, entering visual mode anchors the selection
+	// and leaving it sets the '< and '> marks
+	bm.tg.Event.Subscribe("mode.changed", func(tg *TG, data any) {
+		change, _ := data.(ModeChange)
+		buffer := bm.Active()
+		if buffer == nil {
+			return
+		}
+		if change.Old == ModeVisual {
+			buffer.rememberSelection()
+		}
+		if change.New != ModeInsert {
+			buffer.clampToLine()
+		}
+		if change.New == ModeVisual {
+			buffer.SetAnchor(buffer.Point())
+		}
+	})
+}
+
+func (bm *BufferManager) applyMotion(buffer *Buffer, motion Motion, count int) {
+	target := motion.Fn(buffer, buffer.Point(), count)
+	if motion.Vertical {
+		line, _ := buffer.OffsetToPosition(target)
+		buffer.moveVertically(line)
+	} else {
+		buffer.MoveCursor(target)
+	}
+	if bm.tg.Key.Mode() != ModeInsert {
+		buffer.clampToLine()
+	}
+}
+
+func motionLeft(b *Buffer, offset int, count int) int {
+	line, col := b.OffsetToPosition(offset)
+	text := b.Line(line)
+	for i := 0; i < count && col > 0; i++ {
+		col = prevGrapheme(text, col)
+	}
+	return b.LineStart(line) + col
+}
+
+func motionRight(b *Buffer, offset int, count int) int {
+	line, col := b.OffsetToPosition(offset)
+	text := b.Line(line)
+	for i := 0; i < count && col < len(text); i++ {
+		col = nextGrapheme(text, col)
+	}
+	return b.LineStart(line) + col
+}
+
+func motionUp(b *Buffer, offset int, count int) int {
+	line, _ := b.OffsetToPosition(offset)
+	return b.LineStart(line - count)
+}
+
+func motionDown(b *Buffer, offset int, count int) int {
+	line, _ := b.OffsetToPosition(offset)
+	return b.LineStart(min(line+count, b.LineCount()-1))
+}
+
+// pageLines is how far a page motion moves, two lines of context stay in view like other editors do
+func pageLines(b *Buffer) int {
+	height := b.ViewHeight()
+	if height <= 0 {
+		height = defaultViewHeight
+	}
+	return max(1, height-2)
+}
+
+func motionPageDown(b *Buffer, offset int, count int) int {
+	return motionDown(b, offset, count*pageLines(b))
+}
+
+func motionPageUp(b *Buffer, offset int, count int) int {
+	return motionUp(b, offset, count*pageLines(b))
+}
+
+func motionLineStart(b *Buffer, offset int, count int) int {
+	line, _ := b.OffsetToPosition(offset)
+	return b.LineStart(line)
+}
+
+func motionFirstNonBlank(b *Buffer, offset int, count int) int {
+	line, _ := b.OffsetToPosition(offset)
+	text := b.Line(line)
+	return b.LineStart(line) + len(text) - len(strings.TrimLeft(text, " \t"))
+}
+
+// motionLineEnd moves to the end of the line count-1 lines down
+func motionLineEnd(b *Buffer, offset int, count int) int {
+	line, _ := b.OffsetToPosition(offset)
+	return b.LineEnd(min(line+count-1, b.LineCount()-1))
+}
+
+// motionBufferStart goes to the first line, or to line count when a count was typed
+func motionBufferStart(b *Buffer, offset int, count int) int {
+	return motionFirstNonBlank(b, b.LineStart(count-1), 1)
+}
+
+// motionBufferEnd goes to the last line, or to line count when a count other than one was typed
+func motionBufferEnd(b *Buffer, offset int, count int) int {
+	line := b.LineCount() - 1
+	if count > 1 {
+		line = count - 1
+	}
+	return motionFirstNonBlank(b, b.LineStart(line), 1)
+}
+
+const (
+	classSpace = iota
+	classWord
+	classPunct
+)
+
+func charClass(r rune) int {
+	switch {
+	case unicode.IsSpace(r):
+		return classSpace
+	case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return classWord
+	default:
+		return classPunct
+	}
+}
+
+// isEmptyLine reports whether offset is the start of a line without any text, which words stop on
+func isEmptyLine(text string, offset int) bool {
+	return (offset == 0 || text[offset-1] == '\n') && (offset == len(text) || text[offset] == '\n')
+}
+
+func motionWordForward(b *Buffer, offset int, count int) int {
+	text := b.String()
+	pos := offset
+	for i := 0; i < count && pos < len(text); i++ {
+		r, size := utf8.DecodeRuneInString(text[pos:])
+		if class := charClass(r); class != classSpace {
+			for pos < len(text) {
+				r, size = utf8.DecodeRuneInString(text[pos:])
+				if charClass(r) != class {
+					break
+				}
+				pos += size
+			}
+		} else {
+			pos += size
+		}
+		for pos < len(text) && !isEmptyLine(text, pos) {
+			r, size = utf8.DecodeRuneInString(text[pos:])
+			if charClass(r) != classSpace {
+				break
+			}
+			pos += size
+		}
+	}
+	return pos
+}
+
+func motionWordBackward(b *Buffer, offset int, count int) int {
+	text := b.String()
+	pos := offset
+	for i := 0; i < count && pos > 0; i++ {
+		_, size := utf8.DecodeLastRuneInString(text[:pos])
+		pos -= size
+		for pos > 0 && !isEmptyLine(text, pos) {
+			r, size := utf8.DecodeRuneInString(text[pos:])
+			if charClass(r) != classSpace {
+				break
+			}
+			_, size = utf8.DecodeLastRuneInString(text[:pos])
+			pos -= size
+		}
+		r, _ := utf8.DecodeRuneInString(text[pos:])
+		class := charClass(r)
+		if class == classSpace {
+			continue
+		}
+		for pos > 0 {
+			prev, size := utf8.DecodeLastRuneInString(text[:pos])
+			if charClass(prev) != class {
+				break
+			}
+			pos -= size
+		}
+	}
+	return pos
+}
+
+func motionWordEnd(b *Buffer, offset int, count int) int {
+	text := b.String()
+	pos := offset
+	for i := 0; i < count && pos < len(text); i++ {
+		_, size := utf8.DecodeRuneInString(text[pos:])
+		pos += size
+		for pos < len(text) {
+			r, size := utf8.DecodeRuneInString(text[pos:])
+			if charClass(r) != classSpace {
+				break
+			}
+			pos += size
+		}
+		if pos >= len(text) {
+			break
+		}
+		r, size := utf8.DecodeRuneInString(text[pos:])
+		class := charClass(r)
+		for pos+size < len(text) {
+			next, nextSize := utf8.DecodeRuneInString(text[pos+size:])
+			if charClass(next) != class {
+				break
+			}
+			pos += size
+			size = nextSize
+		}
+	}
+	return min(pos, len(text))
+}
+
+var bracketPairs = map[byte]byte{
+	'(': ')', '[': ']', '{': '}',
+	')': '(', ']': '[', '}': '{',
+}
+
+// motionMatchBracket jumps from the first bracket at or after the cursor on its line to its partner
+func motionMatchBracket(b *Buffer, offset int, count int) int {
+	text := b.String()
+	line, _ := b.OffsetToPosition(offset)
+	end := b.LineEnd(line)
+
+	start := offset
+	for start < end {
+		if _, ok := bracketPairs[text[start]]; ok {
+			break
+		}
+		start++
+	}
+	if start >= end {
+		return offset
+	}
+
+	if match := matchBracket(text, start); match >= 0 {
+		return match
+	}
+	return offset
+}
+
+// matchBracket finds the bracket pairing with the one at pos, honoring nesting, or -1
+func matchBracket(text string, pos int) int {
+	open := text[pos]
+	partner := bracketPairs[open]
+	step := 1
+	if strings.IndexByte(")]}", open) >= 0 {
+		step = -1
+	}
+
+	depth := 0
+	for i := pos; i >= 0 && i < len(text); i += step {
+		switch text[i] {
+		case open:
+			depth++
+		case partner:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,237 @@
+package TG
+
+import (
+	"log"
+	"strings"
+)
+
+// Register holds yanked or deleted text
+type Register struct {
+	Text     string
+	Linewise bool
+}
+
+var defaultOperators = map[string]string{
+	"d":  "DELETE_OPERATOR",
+	"c":  "CHANGE_OPERATOR",
+	"y":  "YANK_OPERATOR",
+	">":  "INDENT_OPERATOR",
+	"<":  "DEDENT_OPERATOR",
+	"gu": "LOWERCASE_OPERATOR",
+	"gU": "UPPERCASE_OPERATOR",
+}
+
+func (bm *BufferManager) registerOperators() {
+	bm.registerOperator("DELETE_OPERATOR", "Delete the range into the unnamed register", bm.deleteOperator)
+	bm.registerOperator("CHANGE_OPERATOR", "Delete the range and start insert mode in its place", bm.changeOperator)
+	bm.registerOperator("YANK_OPERATOR", "Copy the range into the unnamed register", bm.yankOperator)
+	bm.registerOperator("INDENT_OPERATOR", "Indent the lines of the range by one tab", func(args OperatorArgs) { bm.shiftLines(args, 1) })
+	bm.registerOperator("DEDENT_OPERATOR", "Remove one level of indentation from the lines of the range", func(args OperatorArgs) { bm.shiftLines(args, -1) })
+	bm.registerOperator("LOWERCASE_OPERATOR", "Make the range lowercase", func(args OperatorArgs) { bm.mapText(args, strings.ToLower) })
+	bm.registerOperator("UPPERCASE_OPERATOR", "Make the range uppercase", func(args OperatorArgs) { bm.mapText(args, strings.ToUpper) })
+
+	for keys, command := range defaultOperators {
+		bm.tg.Key.RegisterOperator(keys, command)
+	}
+
+	bm.tg.Api.Register(CommandInfo{Name: "DELETE_CHAR", Description: "Delete count characters under and after the cursor"}, func(tg *TG, data any) any {
+		buffer := bm.Active()
+		if buffer == nil {
+			return nil
+		}
+		end := motionRight(buffer, buffer.Point(), countArg(data))
+		bm.deleteOperator(OperatorArgs{Buffer: buffer, Start: buffer.Point(), End: end, Count: 1})
+		return nil
+	})
+
+	bm.tg.Api.Register(CommandInfo{Name: "PASTE_AFTER", Description: "Put the unnamed register after the cursor, below the line for whole lines"}, func(tg *TG, data any) any {
+		bm.paste(true, countArg(data))
+		return nil
+	})
+
+	bm.tg.Api.Register(CommandInfo{Name: "PASTE_BEFORE", Description: "Put the unnamed register before the cursor, above the line for whole lines"}, func(tg *TG, data any) any {
+		bm.paste(false, countArg(data))
+		return nil
+	})
+
+	bm.tg.Key.RegisterKey("x", "DELETE_CHAR")
+	bm.tg.Key.RegisterKey("p", "PASTE_AFTER")
+	bm.tg.Key.RegisterKey("P", "PASTE_BEFORE")
+}
+
+// registerOperator exposes an operator implementation as a command taking OperatorArgs or ExArgs
+func (bm *BufferManager) registerOperator(name string, description string, fn func(args OperatorArgs)) {
+	bm.tg.Api.Register(CommandInfo{
+		Name:        name,
+		Description: description,
+		Params:      []CommandParam{{Name: "range", Description: "OperatorArgs, or ExArgs for the lines of an ex range"}},
+	}, func(tg *TG, data any) any {
+		args, ok := data.(OperatorArgs)
+		// From the command line, operators act on the lines of the range
+		if ex, isEx := data.(ExArgs); isEx && ex.Buffer != nil {
+			args = OperatorArgs{
+				Buffer:   ex.Buffer,
+				Start:    ex.Buffer.LineStart(ex.Range.Start),
+				End:      ex.Buffer.LineStart(ex.Range.End + 1),
+				Linewise: true,
+				Count:    1,
+			}
+			ok = true
+		}
+		if !ok || args.Buffer == nil {
+			log.Printf("[ERROR] Invalid data format for %s", name)
+			return nil
+		}
+		args.Start = clamp(args.Start, 0, args.Buffer.Len())
+		args.End = clamp(args.End, args.Start, args.Buffer.Len())
+		fn(args)
+		return nil
+	})
+}
+
+func (bm *BufferManager) SetRegister(name string, register Register) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	bm.registers[name] = register
+}
+
+func (bm *BufferManager) GetRegister(name string) (Register, bool) {
+	bm.lock.RLock()
+	defer bm.lock.RUnlock()
+	register, exists := bm.registers[name]
+	return register, exists
+}
+
+// yank stores a range in the unnamed register, whole lines always end with a newline
+func (bm *BufferManager) yank(args OperatorArgs) {
+	text := args.Buffer.Slice(args.Start, args.End)
+	if args.Linewise && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	bm.SetRegister(`"`, Register{Text: text, Linewise: args.Linewise})
+}
+
+func (bm *BufferManager) yankOperator(args OperatorArgs) {
+	bm.yank(args)
+	args.Buffer.MoveCursor(args.Start)
+}
+
+func (bm *BufferManager) deleteOperator(args OperatorArgs) {
+	bm.yank(args)
+	buffer := args.Buffer
+
+	// Deleting the last lines also takes the line break before them
+	if args.Linewise && args.End == buffer.Len() && args.Start > 0 && !strings.HasSuffix(buffer.Slice(args.Start, args.End), "\n") {
+		args.Start--
+	}
+
+	if err := buffer.Delete(args.Start, args.End-args.Start); err != nil {
+		log.Printf("[ERROR] Delete failed: %v", err)
+		return
+	}
+
+	buffer.MoveCursor(args.Start)
+	if args.Linewise {
+		buffer.MoveCursor(motionFirstNonBlank(buffer, args.Start, 1))
+	}
+	buffer.clampToLine()
+}
+
+// changeOperator deletes the range and starts insert mode in its place, keeping an empty line for whole lines
+func (bm *BufferManager) changeOperator(args OperatorArgs) {
+	bm.yank(args)
+	buffer := args.Buffer
+
+	end := args.End
+	if args.Linewise && strings.HasSuffix(buffer.Slice(args.Start, end), "\n") {
+		end--
+	}
+
+	// Entering insert mode first puts the deletion in the same undo step as the typing that follows
+	bm.tg.Key.SetMode(ModeInsert)
+	if err := buffer.Delete(args.Start, end-args.Start); err != nil {
+		log.Printf("[ERROR] Change failed: %v", err)
+		return
+	}
+	buffer.MoveCursor(args.Start)
+}
+
+// shiftLines indents or dedents every line the range touches by one tab stop
+func (bm *BufferManager) shiftLines(args OperatorArgs, direction int) {
+	buffer := args.Buffer
+	first, _ := buffer.OffsetToPosition(args.Start)
+	last, _ := buffer.OffsetToPosition(max(args.Start, args.End-1))
+
+	bm.tg.Undo.Group(buffer, func() {
+		for line := first; line <= last; line++ {
+			text := buffer.Line(line)
+			start := buffer.LineStart(line)
+			if direction > 0 {
+				if text != "" {
+					buffer.Insert(start, "\t")
+				}
+				continue
+			}
+
+			width := 0
+			if strings.HasPrefix(text, "\t") {
+				width = 1
+			} else {
+				for width < TabWidth && width < len(text) && text[width] == ' ' {
+					width++
+				}
+			}
+			buffer.Delete(start, width)
+		}
+	})
+
+	buffer.MoveCursor(motionFirstNonBlank(buffer, buffer.LineStart(first), 1))
+}
+
+// mapText replaces the range with a transformed copy, used for case changes
+func (bm *BufferManager) mapText(args OperatorArgs, transform func(string) string) {
+	text := args.Buffer.Slice(args.Start, args.End)
+	if mapped := transform(text); mapped != text {
+		args.Buffer.Replace(args.Start, len(text), mapped)
+	}
+	args.Buffer.MoveCursor(args.Start)
+	args.Buffer.clampToLine()
+}
+
+// paste puts the unnamed register after or before the cursor, below or above the line for whole lines
+func (bm *BufferManager) paste(after bool, count int) {
+	buffer := bm.Active()
+	register, exists := bm.GetRegister(`"`)
+	if buffer == nil || !exists || register.Text == "" {
+		return
+	}
+
+	text := strings.Repeat(register.Text, count)
+	line, col := buffer.Cursor()
+
+	if register.Linewise {
+		offset := buffer.LineStart(line)
+		if after {
+			offset = buffer.LineStart(line + 1)
+			// The last line has no line break to paste after, move it in front of the text instead
+			if line+1 >= buffer.LineCount() {
+				offset = buffer.Len()
+				text = "\n" + strings.TrimSuffix(text, "\n")
+			}
+		}
+		buffer.Insert(offset, text)
+		if strings.HasPrefix(text, "\n") {
+			offset++
+		}
+		buffer.MoveCursor(motionFirstNonBlank(buffer, offset, 1))
+		return
+	}
+
+	offset := buffer.LineStart(line) + col
+	if after {
+		offset = buffer.LineStart(line) + nextGrapheme(buffer.Line(line), col)
+	}
+	buffer.Insert(offset, text)
+	buffer.MoveCursor(offset + len(text))
+	buffer.MoveCursor(motionLeft(buffer, buffer.Point(), 1))
+}
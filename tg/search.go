@@ -0,0 +1,664 @@
+package TG
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SearchMatch is the byte range of one match in a buffer
+type SearchMatch struct {
+	Start int
+	End   int
+}
+
+// SearchMatches is what SEARCH_MATCHES returns and search.updated carries
+type SearchMatches struct {
+	Pattern   string
+	Matches   []SearchMatch
+	Current   int  // 1-based index of the match under the cursor, 0 when the cursor is not on one
+	Highlight bool // Whether renderers should highlight the matches
+}
+
+// SubstituteArgs is what SUBSTITUTE takes besides ExArgs and a command line string
+type SubstituteArgs struct {
+	Pattern     string // Empty reuses the last search pattern
+	Replacement string // Vim style: \1 to \9 and & refer to groups, \n is a line break
+	Flags       string // g: every match in a line, i/I: ignore/match case, c: confirm, n: only count, e: no error
+	FirstLine   int    // 1-based, 0 means the cursor line and -1 the last line
+	LastLine    int
+}
+
+type searchCache struct {
+	buffer  *Buffer
+	version int
+	pattern string
+	matches []SearchMatch
+}
+
+// substitution is a confirmed substitute waiting for the user to accept or skip each match
+type substitution struct {
+	buffer *Buffer
+	edits  []edit
+	index  int
+	delta  int // How much the edits made so far moved the remaining ones
+	done   int
+	lines  map[int]bool
+}
+
+type edit struct {
+	start, end  int
+	line        int
+	replacement string
+}
+
+type SearchManager struct {
+	pattern   string // Last searched pattern
+	backward  bool   // Last search went backward, n keeps the direction
+	preview   string // Pattern being typed, highlighted instead of the last one
+	highlight bool
+	cache     searchCache
+	confirm   *substitution
+	lock      sync.Mutex
+	tg        *TG
+}
+
+func NewSearchManager() *SearchManager {
+	return &SearchManager{}
+}
+
+func (sm *SearchManager) Load(tg *TG) {
+	sm.tg = tg
+
+	tg.Event.Declare(EventInfo{
+		Name:        "search.updated",
+		Description: "The search pattern or its matches in the active buffer changed",
+		Payload:     "TG.SearchMatches",
+		Aliases:     []string{"SEARCH_UPDATED"},
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "SEARCH",
+		Description: "Search for a regular expression and move to the next match",
+		Params:      []CommandParam{{Name: "pattern", Description: "Pattern, or a map with \"pattern\" and \"backward\""}},
+	}, func(tg *TG, data any) any {
+		pattern, backward := "", false
+		switch params := data.(type) {
+		case string:
+			pattern = params
+		case map[string]any:
+			pattern, _ = params["pattern"].(string)
+			backward, _ = params["backward"].(bool)
+		}
+		sm.Search(pattern, backward)
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "SEARCH_PREVIEW",
+		Description: "Highlight the matches of a pattern while it is typed, an empty pattern stops",
+		Params:      []CommandParam{{Name: "pattern"}},
+	}, func(tg *TG, data any) any {
+		pattern, _ := data.(string)
+		sm.lock.Lock()
+		sm.preview = pattern
+		sm.lock.Unlock()
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "SEARCH_MATCHES", Description: "Return the search matches in a buffer, the active buffer by default"}, func(tg *TG, data any) any {
+		buffer := tg.Buffer.Active()
+		if data != nil {
+			buffer = tg.Buffer.resolve(data)
+		}
+		if buffer == nil {
+			return SearchMatches{}
+		}
+		return sm.Matches(buffer)
+	})
+
+	tg.Api.Register(CommandInfo{Name: "NOHLSEARCH", Description: "Stop highlighting the matches of the last search until the next search"}, func(tg *TG, data any) any {
+		sm.lock.Lock()
+		sm.highlight = false
+		sm.lock.Unlock()
+		sm.updated()
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "SUBSTITUTE",
+		Description: "Replace matches of a pattern in a range of lines",
+		Params:      []CommandParam{{Name: "args", Description: "SubstituteArgs, ExArgs or a command line such as \"%s/a/b/g\""}},
+	}, func(tg *TG, data any) any {
+		var args SubstituteArgs
+		switch params := data.(type) {
+		case SubstituteArgs:
+			args = params
+		case ExArgs:
+			parsed, err := ParseSubstitute(params.Arg)
+			if err != nil {
+				tg.Api.Call("AddMessage", "ERROR", err.Error())
+				return nil
+			}
+			args = parsed
+			args.FirstLine, args.LastLine = params.Range.Start+1, params.Range.End+1
+		case string:
+			// A whole command line such as "%s/a/b/g"
+			tg.Api.Call("EX", params)
+			return nil
+		default:
+			tg.Api.Call("AddMessage", "ERROR", "Invalid data format for SUBSTITUTE")
+			return nil
+		}
+		if err := sm.Substitute(args); err != nil {
+			tg.Api.Call("AddMessage", "ERROR", err.Error())
+		}
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "SUBSTITUTE_CONFIRM",
+		Description: "Answer the question of a confirmed substitute with y, n, a, q or l",
+		Params:      []CommandParam{{Name: "answer"}},
+	}, func(tg *TG, data any) any {
+		answer, _ := data.(string)
+		sm.answer(answer)
+		return nil
+	})
+
+	for _, motion := range []Motion{
+		{Name: "SEARCH_NEXT", Description: "Move to the next match of the last search", Keys: []string{"n"}, Fn: sm.motionNext},
+		{Name: "SEARCH_PREV", Description: "Move to the previous match of the last search", Keys: []string{"N"}, Fn: sm.motionPrev},
+		{Name: "SEARCH_WORD", Description: "Search forward for the word under the cursor", Keys: []string{"*"}, Fn: sm.motionWord(false)},
+		{Name: "SEARCH_WORD_BACKWARD", Description: "Search backward for the word under the cursor", Keys: []string{"#"}, Fn: sm.motionWord(true)},
+	} {
+		tg.Key.RegisterMotion(motion)
+	}
+
+	// A confirmed substitute ends when its mode is left however that happens, and when its buffer
+	// goes away, so its undo group does not stay open
+	tg.Event.Subscribe("mode.changed", func(tg *TG, data any) {
+		if change, _ := data.(ModeChange); change.Old == ModeConfirm && change.New != ModeConfirm {
+			if session := sm.endConfirm(true); session != nil {
+				sm.report(session.done, len(session.lines))
+			}
+		}
+	})
+	tg.Event.Subscribe("buffer.closed", func(tg *TG, data any) {
+		sm.lock.Lock()
+		closed := sm.confirm != nil && sm.confirm.buffer == data
+		sm.lock.Unlock()
+		if closed {
+			// The undo history of the buffer is dropped with it
+			sm.endConfirm(false)
+			tg.Key.SetMode(ModeNormal)
+		}
+	})
+
+	for _, answer := range []string{"y", "n", "a", "q", "l"} {
+		tg.Key.RegisterModeKey(ModeConfirm, answer, "SUBSTITUTE_CONFIRM "+answer)
+	}
+	tg.Key.RegisterModeKey(ModeConfirm, "Esc", "SUBSTITUTE_CONFIRM q")
+}
+
+// compile turns a search pattern into a regexp matching per line
+func compile(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?m)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// Search makes pattern the last search and jumps to its next match in the given direction.
+// An empty pattern repeats the last search.
+func (sm *SearchManager) Search(pattern string, backward bool) {
+	sm.lock.Lock()
+	sm.preview = ""
+	if pattern == "" {
+		pattern = sm.pattern
+	}
+	sm.lock.Unlock()
+
+	if pattern == "" {
+		sm.tg.Api.Call("AddMessage", "ERROR", "No previous search pattern")
+		return
+	}
+	if _, err := compile(pattern); err != nil {
+		sm.tg.Api.Call("AddMessage", "ERROR", err.Error())
+		return
+	}
+
+	sm.lock.Lock()
+	sm.pattern = pattern
+	sm.backward = backward
+	sm.highlight = true
+	sm.lock.Unlock()
+
+	if buffer := sm.tg.Buffer.Active(); buffer != nil {
+		buffer.MoveCursor(sm.jump(buffer, buffer.Point(), 1, backward))
+	}
+}
+
+// Matches returns every match of the pattern being typed, or of the last search, in a buffer
+func (sm *SearchManager) Matches(buffer *Buffer) SearchMatches {
+	sm.lock.Lock()
+	pattern := sm.pattern
+	if sm.preview != "" {
+		pattern = sm.preview
+	}
+	highlight := sm.highlight || sm.preview != ""
+	sm.lock.Unlock()
+
+	result := SearchMatches{Pattern: pattern, Highlight: highlight}
+	if pattern == "" {
+		return result
+	}
+
+	result.Matches = sm.find(buffer, pattern)
+	result.Current = matchAt(result.Matches, buffer.Point())
+	return result
+}
+
+// find returns the matches of a pattern in a buffer, reusing the last result while the buffer is unchanged
+func (sm *SearchManager) find(buffer *Buffer, pattern string) []SearchMatch {
+	version := buffer.Version()
+
+	sm.lock.Lock()
+	cache := sm.cache
+	sm.lock.Unlock()
+	if cache.buffer == buffer && cache.version == version && cache.pattern == pattern {
+		return cache.matches
+	}
+
+	re, err := compile(pattern)
+	if err != nil {
+		return nil
+	}
+	var matches []SearchMatch
+	for _, match := range re.FindAllStringIndex(buffer.String(), -1) {
+		matches = append(matches, SearchMatch{match[0], match[1]})
+	}
+
+	sm.lock.Lock()
+	sm.cache = searchCache{buffer, version, pattern, matches}
+	sm.lock.Unlock()
+	return matches
+}
+
+// matchAt returns the 1-based index of the match starting at offset, or 0
+func matchAt(matches []SearchMatch, offset int) int {
+	i := sort.Search(len(matches), func(i int) bool { return matches[i].Start >= offset })
+	if i < len(matches) && matches[i].Start == offset {
+		return i + 1
+	}
+	return 0
+}
+
+// jump returns the start of the count-th match after or before offset, wrapping around the buffer
+func (sm *SearchManager) jump(buffer *Buffer, offset int, count int, backward bool) int {
+	sm.lock.Lock()
+	pattern := sm.pattern
+	sm.lock.Unlock()
+
+	matches := sm.find(buffer, pattern)
+	if len(matches) == 0 {
+		sm.tg.Api.Call("AddMessage", "ERROR", "Pattern not found: "+pattern)
+		return offset
+	}
+
+	i := sort.Search(len(matches), func(i int) bool { return matches[i].Start > offset })
+	wrapped := false
+	if backward {
+		i = sort.Search(len(matches), func(i int) bool { return matches[i].Start >= offset }) - count
+		for i < 0 {
+			i += len(matches)
+			wrapped = true
+		}
+	} else {
+		i += count - 1
+		for i >= len(matches) {
+			i -= len(matches)
+			wrapped = true
+		}
+	}
+
+	if wrapped && backward {
+		sm.tg.Api.Call("AddMessage", "INFO", "Search hit TOP, continuing at BOTTOM")
+	} else if wrapped {
+		sm.tg.Api.Call("AddMessage", "INFO", "Search hit BOTTOM, continuing at TOP")
+	}
+
+	target := matches[i].Start
+	sm.tg.Event.Dispatch("search.updated", SearchMatches{Pattern: pattern, Matches: matches, Current: i + 1, Highlight: true})
+	return target
+}
+
+func (sm *SearchManager) motionNext(b *Buffer, offset int, count int) int {
+	sm.lock.Lock()
+	backward := sm.backward
+	sm.highlight = true
+	sm.lock.Unlock()
+	return sm.jump(b, offset, count, backward)
+}
+
+func (sm *SearchManager) motionPrev(b *Buffer, offset int, count int) int {
+	sm.lock.Lock()
+	backward := sm.backward
+	sm.highlight = true
+	sm.lock.Unlock()
+	return sm.jump(b, offset, count, !backward)
+}
+
+// motionWord searches for the whole word under or after the cursor, like * and #
+func (sm *SearchManager) motionWord(backward bool) MotionFunc {
+	return func(b *Buffer, offset int, count int) int {
+		line, col := b.OffsetToPosition(offset)
+		text := b.Line(line)
+		for col < len(text) && classAt(text, col) != classWord {
+			col = nextGrapheme(text, col)
+		}
+		if col >= len(text) {
+			sm.tg.Api.Call("AddMessage", "ERROR", "No word under the cursor")
+			return offset
+		}
+
+		word := text[runStart(text, col):runEnd(text, col)]
+		sm.lock.Lock()
+		sm.pattern = `\b` + regexp.QuoteMeta(word) + `\b`
+		sm.backward = backward
+		sm.highlight = true
+		sm.lock.Unlock()
+
+		// Searching backward starts from the beginning of the word so it does not find itself
+		return sm.jump(b, b.LineStart(line)+runStart(text, col), count, backward)
+	}
+}
+
+// updated tells renderers the last search or its highlighting changed
+func (sm *SearchManager) updated() {
+	if buffer := sm.tg.Buffer.Active(); buffer != nil {
+		sm.tg.Event.Dispatch("search.updated", sm.Matches(buffer))
+	}
+}
+
+// ParseSubstitute reads the argument of ":s", "/pattern/replacement/flags", where any punctuation
+// may replace the slashes
+func ParseSubstitute(argument string) (SubstituteArgs, error) {
+	var args SubstituteArgs
+	if argument == "" {
+		return args, fmt.Errorf("Missing pattern, usage: :s/pattern/replacement/flags")
+	}
+
+	delimiter := argument[0]
+	if strings.IndexByte(`\"| `, delimiter) >= 0 || isWordByte(delimiter) {
+		return args, fmt.Errorf("Invalid delimiter %q in %s", delimiter, argument)
+	}
+	parts := splitUnescaped(argument[1:], delimiter)
+	args.Pattern = parts[0]
+	if len(parts) > 1 {
+		args.Replacement = parts[1]
+	}
+	if len(parts) > 2 {
+		args.Flags = parts[2]
+	}
+	return args, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// splitUnescaped splits on a delimiter that is not preceded by a backslash, an escaped delimiter
+// loses its backslash
+func splitUnescaped(text string, delimiter byte) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && text[i+1] == delimiter:
+			current.WriteByte(delimiter)
+			i++
+		case text[i] == '\\' && i+1 < len(text):
+			current.WriteString(text[i : i+2])
+			i++
+		case text[i] == delimiter:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(text[i])
+		}
+	}
+	return append(parts, current.String())
+}
+
+// expandTemplate converts a Vim replacement into a regexp.Expand template
+func expandTemplate(replacement string) string {
+	var template strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			switch next := replacement[i]; {
+			case next >= '0' && next <= '9':
+				template.WriteString("${" + string(next) + "}")
+			case next == 'n' || next == 'r':
+				template.WriteByte('\n')
+			case next == 't':
+				template.WriteByte('\t')
+			default:
+				template.WriteByte(next)
+			}
+		case c == '&':
+			template.WriteString("${0}")
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+	return template.String()
+}
+
+// Substitute replaces matches of a pattern in a range of lines of the active buffer. With the c flag
+// it moves through the matches asking SUBSTITUTE_CONFIRM for an answer instead.
+func (sm *SearchManager) Substitute(args SubstituteArgs) error {
+	buffer := sm.tg.Buffer.Active()
+	if buffer == nil {
+		return fmt.Errorf("No buffer to substitute in")
+	}
+
+	sm.lock.Lock()
+	if args.Pattern == "" {
+		args.Pattern = sm.pattern
+	}
+	sm.lock.Unlock()
+	if args.Pattern == "" {
+		return fmt.Errorf("No previous search pattern")
+	}
+
+	pattern := args.Pattern
+	if strings.Contains(args.Flags, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	cursorLine, _ := buffer.Cursor()
+	first, last := resolveLine(buffer, args.FirstLine, cursorLine), resolveLine(buffer, args.LastLine, cursorLine)
+	if args.LastLine == 0 && args.FirstLine != 0 {
+		last = first
+	}
+	if first > last {
+		first, last = last, first
+	}
+
+	limit := 1
+	if strings.Contains(args.Flags, "g") {
+		limit = -1
+	}
+	template := expandTemplate(args.Replacement)
+
+	var edits []edit
+	for line := first; line <= last; line++ {
+		text := buffer.Line(line)
+		start := buffer.LineStart(line)
+		for _, match := range re.FindAllStringSubmatchIndex(text, limit) {
+			replacement := string(re.ExpandString(nil, template, text, match))
+			edits = append(edits, edit{start + match[0], start + match[1], line, replacement})
+		}
+	}
+
+	sm.lock.Lock()
+	sm.pattern = pattern
+	sm.highlight = true
+	sm.lock.Unlock()
+
+	if len(edits) == 0 {
+		if strings.Contains(args.Flags, "e") {
+			return nil
+		}
+		return fmt.Errorf("Pattern not found: %s", args.Pattern)
+	}
+
+	if strings.Contains(args.Flags, "n") {
+		sm.tg.Api.Call("AddMessage", "INFO", fmt.Sprintf("%d matches on %d lines", len(edits), countLines(edits)))
+		return nil
+	}
+
+	if strings.Contains(args.Flags, "c") {
+		sm.tg.Undo.BeginGroup(buffer)
+		sm.lock.Lock()
+		sm.confirm = &substitution{buffer: buffer, edits: edits, lines: make(map[int]bool)}
+		sm.lock.Unlock()
+		sm.tg.Key.SetMode(ModeConfirm)
+		sm.prompt()
+		return nil
+	}
+
+	sm.tg.Undo.Group(buffer, func() {
+		for i := len(edits) - 1; i >= 0; i-- {
+			e := edits[i]
+			if err := buffer.Replace(e.start, e.end-e.start, e.replacement); err != nil {
+				log.Printf("[ERROR] Substitute failed: %v", err)
+			}
+		}
+	})
+
+	lastEdit := edits[len(edits)-1]
+	buffer.MoveCursor(motionFirstNonBlank(buffer, buffer.LineStart(lastEdit.line), 1))
+	sm.report(len(edits), countLines(edits))
+	return nil
+}
+
+// resolveLine turns a 1-based range line into a 0-based buffer line, 0 being the cursor line and -1 the last one
+func resolveLine(buffer *Buffer, line int, cursorLine int) int {
+	switch {
+	case line == 0:
+		return cursorLine
+	case line < 0:
+		return buffer.LineCount() - 1
+	default:
+		return min(line-1, buffer.LineCount()-1)
+	}
+}
+
+func countLines(edits []edit) int {
+	lines := make(map[int]bool)
+	for _, e := range edits {
+		lines[e.line] = true
+	}
+	return len(lines)
+}
+
+func (sm *SearchManager) report(substitutions int, lines int) {
+	sm.tg.Api.Call("AddMessage", "INFO", fmt.Sprintf("%d substitutions on %d lines", substitutions, lines))
+}
+
+// prompt moves the cursor to the match waiting for an answer
+func (sm *SearchManager) prompt() {
+	sm.lock.Lock()
+	session := sm.confirm
+	sm.lock.Unlock()
+	if session == nil {
+		return
+	}
+
+	e := session.edits[session.index]
+	session.buffer.MoveCursor(e.start + session.delta)
+	sm.updated()
+	sm.tg.Api.Call("AddMessage", "INFO", fmt.Sprintf("Replace with %s (y/n/a/q/l)?", e.replacement))
+}
+
+// answer handles y (replace), n (skip), a (replace all remaining), q (quit) and l (replace and quit)
+// for the match a confirmed substitute waits on
+func (sm *SearchManager) answer(answer string) {
+	sm.lock.Lock()
+	session := sm.confirm
+	sm.lock.Unlock()
+	if session == nil {
+		return
+	}
+
+	replace := func() {
+		e := session.edits[session.index]
+		if err := session.buffer.Replace(e.start+session.delta, e.end-e.start, e.replacement); err != nil {
+			log.Printf("[ERROR] Substitute failed: %v", err)
+			return
+		}
+		session.delta += len(e.replacement) - (e.end - e.start)
+		session.done++
+		session.lines[e.line] = true
+	}
+
+	finished := false
+	switch answer {
+	case "y":
+		replace()
+		session.index++
+	case "n":
+		session.index++
+	case "a":
+		for session.index < len(session.edits) {
+			replace()
+			session.index++
+		}
+	case "l":
+		replace()
+		finished = true
+	case "q":
+		finished = true
+	default:
+		return
+	}
+
+	if !finished && session.index < len(session.edits) {
+		sm.prompt()
+		return
+	}
+
+	if sm.endConfirm(true) == nil {
+		return
+	}
+	sm.tg.Key.SetMode(ModeNormal)
+	sm.report(session.done, len(session.lines))
+}
+
+// endConfirm closes the session of a confirmed substitute, and the undo group of its edits when
+// endGroup is set. It returns the session, nil when none was open.
+func (sm *SearchManager) endConfirm(endGroup bool) *substitution {
+	sm.lock.Lock()
+	session := sm.confirm
+	sm.confirm = nil
+	sm.lock.Unlock()
+	if session != nil && endGroup {
+		sm.tg.Undo.EndGroup(session.buffer)
+	}
+	return session
+}
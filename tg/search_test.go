@@ -0,0 +1,102 @@
+package TG
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseSubstitute(t *testing.T) {
+	tests := []struct {
+		argument string
+		want     SubstituteArgs
+		err      bool
+	}{
+		{argument: "/a/b/g", want: SubstituteArgs{Pattern: "a", Replacement: "b", Flags: "g"}},
+		{argument: "/a/b", want: SubstituteArgs{Pattern: "a", Replacement: "b"}},
+		{argument: "/a", want: SubstituteArgs{Pattern: "a"}},
+		{argument: "//b/", want: SubstituteArgs{Replacement: "b"}},
+		{argument: "#a/b#c#gc", want: SubstituteArgs{Pattern: "a/b", Replacement: "c", Flags: "gc"}},
+		{argument: `/a\/b/c\/d/`, want: SubstituteArgs{Pattern: "a/b", Replacement: "c/d"}},
+		{argument: `/a\.b/\1/`, want: SubstituteArgs{Pattern: `a\.b`, Replacement: `\1`}},
+		{argument: "", err: true},
+		{argument: "xaxbx", err: true},
+		{argument: `"a"b"`, err: true},
+		{argument: " a b ", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSubstitute(test.argument)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseSubstitute(%q) = %+v, want an error", test.argument, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseSubstitute(%q) = %+v, %v, want %+v", test.argument, got, err, test.want)
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		command string
+		keys    string // Typed after the command, the answers of a confirmed substitute
+		want    string
+		message string // Last message shown
+	}{
+		{name: "first match of the cursor line", text: "aa aa\naa", command: "s/a/b/", want: "ba aa\naa", message: "1 substitutions on 1 lines"},
+		{name: "g replaces every match", text: "aa aa\naa", command: "s/a/b/g", want: "bb bb\naa", message: "4 substitutions on 1 lines"},
+		{name: "every line", text: "aa aa\naa", command: "%s/a/b/", want: "ba aa\nba", message: "2 substitutions on 2 lines"},
+		{name: "every line with g", text: "aa aa\naa", command: "%s/a/b/g", want: "bb bb\nbb", message: "6 substitutions on 2 lines"},
+		{name: "line range", text: "a\na\na\na", command: "2,3s/a/b/", want: "a\nb\nb\na", message: "2 substitutions on 2 lines"},
+		{name: "groups and the whole match", text: "key=value", command: `s/(\w+)=(\w+)/\2=\1 [&]/`, want: "value=key [key=value]"},
+		{name: "i ignores case", text: "A a", command: "s/a/b/gi", want: "b b"},
+		{name: "n only counts", text: "aa aa\naa", command: "%s/a/b/gn", want: "aa aa\naa", message: "6 matches on 2 lines"},
+		{name: "n without g counts a match a line", text: "aa aa\naa", command: "%s/a/b/n", want: "aa aa\naa", message: "2 matches on 2 lines"},
+		{name: "no match", text: "a", command: "s/x/y/", want: "a", message: "Pattern not found: x"},
+		{name: "e hides no match", text: "a", command: "s/x/y/e", want: "a"},
+		{name: "c with yes and no", text: "a a a", command: "s/a/b/gc", keys: "yny", want: "b a b", message: "2 substitutions on 1 lines"},
+		{name: "c with all", text: "a a\na", command: "%s/a/bb/gc", keys: "na", want: "a bb\nbb", message: "2 substitutions on 2 lines"},
+		{name: "c with last", text: "a a a", command: "s/a/b/gc", keys: "nl", want: "a b a", message: "1 substitutions on 1 lines"},
+		{name: "c with quit", text: "a a a", command: "s/a/b/gc", keys: "yq", want: "b a a", message: "1 substitutions on 1 lines"},
+		{name: "c left with escape", text: "a a a", command: "s/a/b/gc", keys: "y<Esc>", want: "b a a", message: "1 substitutions on 1 lines"},
+		{name: "c without g", text: "a a\na", command: "%s/a/b/c", keys: "yy", want: "b a\nb", message: "2 substitutions on 2 lines"},
+		{name: "c ignores other keys", text: "a a", command: "s/a/b/gc", keys: "xjyy", want: "b b", message: "2 substitutions on 1 lines"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tg := newTestTG(t)
+			message := ""
+			tg.Api.RegisterCommand("AddMessage", func(tg *TG, args ...any) any {
+				message = fmt.Sprint(args[1])
+				return nil
+			})
+			buffer := tg.Buffer.Create("test", test.text)
+			tg.Buffer.SetActive(buffer)
+
+			tg.Api.Call("EX", test.command)
+			if test.keys != "" {
+				tg.Api.Call("FEED_KEYS", test.keys)
+			}
+			if got := buffer.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if test.message != "" && message != test.message {
+				t.Errorf("message %q, want %q", message, test.message)
+			}
+			if mode := tg.Key.Mode(); mode != ModeNormal {
+				t.Errorf("left in %s mode", mode)
+			}
+
+			// Whatever was replaced goes away with a single undo
+			tg.Undo.Undo(buffer)
+			if got := buffer.String(); got != test.text {
+				t.Errorf("after undo got %q, want %q", got, test.text)
+			}
+		})
+	}
+}
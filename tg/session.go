@@ -0,0 +1,160 @@
+package TG
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sessions are JSON lines: a SessionHeader followed by a SessionRecord for every event declared
+// External, the keys pressed and the screen resizes, see --record and --replay
+
+// SessionHeader is the first line of a session file
+type SessionHeader struct {
+	Version int      `json:"version"`
+	Args    []string `json:"args"` // Command line the session was recorded with, without --record
+}
+
+// SessionRecord is an event a session recorded
+type SessionRecord struct {
+	Time  int64  `json:"t"` // Milliseconds since the recording started
+	Event string `json:"event"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// ScreenSize is the payload of ui.resized
+type ScreenSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+const sessionVersion = 1
+
+// Recording writes the external events of a session to a file as they are dispatched
+type Recording struct {
+	file         *os.File
+	writer       *bufio.Writer
+	encoder      *json.Encoder
+	start        time.Time
+	lock         sync.Mutex
+	subscription int
+	tg           *TG
+}
+
+// RecordSession starts recording the external events to path, args is the command line to replay
+// them with
+func RecordSession(tg *TG, path string, args []string) (*Recording, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot record the session: %w", err)
+	}
+
+	r := &Recording{file: file, writer: bufio.NewWriter(file), start: time.Now(), tg: tg}
+	r.encoder = json.NewEncoder(r.writer)
+	if err := r.encoder.Encode(SessionHeader{Version: sessionVersion, Args: args}); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Cannot record the session: %w", err)
+	}
+
+	// Before any other handler, a handler stopping the event must not hide it from the recording
+	r.subscription = tg.Event.SubscribeWith("*", SubscribeOptions{Priority: math.MaxInt}, func(tg *TG, e *EventContext) {
+		if info, _ := tg.Event.DescribeEvent(e.Name); info.External {
+			r.record(e.Name, e.Data)
+		}
+	})
+	return r, nil
+}
+
+func (r *Recording) record(event string, data any) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.encoder == nil {
+		return
+	}
+	// Flushed every time, the session is most wanted after a crash that skips Close
+	record := SessionRecord{Time: time.Since(r.start).Milliseconds(), Event: event, Data: data}
+	err := r.encoder.Encode(record)
+	if err == nil {
+		err = r.writer.Flush()
+	}
+	if err != nil {
+		r.tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("Recording the session failed: %v", err))
+		r.encoder = nil
+	}
+}
+
+// Close stops recording and writes what is left to the file
+func (r *Recording) Close() error {
+	r.tg.Event.Unsubscribe(r.subscription)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.encoder = nil
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// Session is a recorded session loaded to be replayed
+type Session struct {
+	Header  SessionHeader
+	Records []SessionRecord
+}
+
+// LoadSession reads a session file written by RecordSession
+func LoadSession(path string) (*Session, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	session := &Session{}
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&session.Header); err != nil {
+		return nil, fmt.Errorf("%s is not a session: %w", path, err)
+	}
+	if session.Header.Version != sessionVersion {
+		return nil, fmt.Errorf("%s is a version %d session, only version %d can be replayed", path, session.Header.Version, sessionVersion)
+	}
+
+	for decoder.More() {
+		var line struct {
+			Time  int64           `json:"t"`
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if err := decoder.Decode(&line); err != nil {
+			return nil, fmt.Errorf("%s: event %d: %w", path, len(session.Records)+1, err)
+		}
+		data, err := decodePayload(line.Event, line.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: event %d: %w", path, len(session.Records)+1, err)
+		}
+		session.Records = append(session.Records, SessionRecord{Time: line.Time, Event: line.Event, Data: data})
+	}
+	return session, nil
+}
+
+// decodePayload turns a recorded payload back into the type handlers expect
+func decodePayload(event string, raw json.RawMessage) (any, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var data any
+	switch event {
+	case "ui.resized":
+		var size ScreenSize
+		err := json.Unmarshal(raw, &size)
+		return size, err
+	default:
+		err := json.Unmarshal(raw, &data)
+		return data, err
+	}
+}
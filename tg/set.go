@@ -0,0 +1,95 @@
+package TG
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+func (em *ExManager) registerSet() {
+	em.RegisterCommand(ExCommand{Name: "set", Short: "se", Command: "SET", Usage: ":se[t] [option | option? | nooption | option=value]", Nargs: "*", Complete: "option"})
+
+	em.tg.Api.Register(CommandInfo{
+		Name:        "SET",
+		Description: "List the config options, show one of them or change it",
+		Params:      []CommandParam{{Name: "option", Description: "option, option?, nooption or option=value, or ExArgs", Optional: true}},
+	}, func(tg *TG, data any) any {
+		arg, _ := data.(string)
+		if args, ok := data.(ExArgs); ok {
+			arg = args.Arg
+		}
+		arg = strings.TrimSpace(arg)
+
+		if arg == "" {
+			return tg.Buffer.ShowScratch("[options]", "Options", optionsText(tg.Config))
+		}
+		message, err := setOption(tg.Config, arg)
+		if err != nil {
+			tg.Api.Call("AddMessage", "ERROR", err.Error())
+			return nil
+		}
+		tg.Api.Call("AddMessage", "INFO", message)
+		return nil
+	})
+
+	em.tg.Api.Register(CommandInfo{
+		Name:        "LIST_OPTIONS",
+		Description: "Return the declared config options",
+		Returns:     "[]TG.ConfigOption",
+	}, func(tg *TG, data any) any {
+		return tg.Config.Options()
+	})
+}
+
+// setOption runs the argument of :set, like Vim "option" turns a boolean on and shows anything
+// else, "nooption" turns it off and "option?" shows it
+func setOption(cm *ConfigManager, arg string) (string, error) {
+	key, value, assign := strings.Cut(arg, "=")
+	key = strings.TrimSpace(key)
+
+	option, exists := cm.Option(key)
+	if !assign && !exists {
+		if name, found := strings.CutPrefix(key, "no"); found {
+			if negated, exists := cm.Option(name); exists && negated.Type == OptionBool {
+				option, key, value, assign = negated, name, "false", true
+			}
+		}
+	}
+	if !assign {
+		if name, found := strings.CutSuffix(key, "?"); found {
+			key = strings.TrimSpace(name)
+			option, exists = cm.Option(key)
+		} else if exists && option.Type == OptionBool {
+			value, assign = "true", true
+		}
+	}
+	if _, exists := cm.Option(key); !exists {
+		return "", fmt.Errorf("Unknown option: %s", key)
+	}
+	if option.Type == OptionSection {
+		return "", fmt.Errorf("%s is a section, set the keys below it in a config file", key)
+	}
+
+	if assign {
+		value = strings.TrimSpace(value)
+		if err := option.check(value); err != nil {
+			return "", fmt.Errorf("Invalid value for %s: %v", key, err)
+		}
+		cm.Set(key, value)
+	}
+	return configSourceText(cm, key), nil
+}
+
+// optionsText lists the declared options with their values and where they come from for :set
+func optionsText(cm *ConfigManager) string {
+	var out strings.Builder
+	w := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Option\tType\tValue\tFrom\tDescription\n")
+	for _, option := range cm.Options() {
+		value, _ := cm.Get(option.Key)
+		layer, _ := cm.Source(option.Key)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", option.Key, option.Type, value, layer.Name, option.Description)
+	}
+	w.Flush()
+	return out.String()
+}
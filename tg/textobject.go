@@ -0,0 +1,438 @@
+package TG
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextObjectFunc returns the range a text object covers around offset. Count selects the count-th
+// enclosing or following object. It reports false when there is no such object at offset.
+type TextObjectFunc func(b *Buffer, offset int, count int) (start int, end int, linewise bool, ok bool)
+
+var defaultTextObjects = map[string]TextObjectFunc{
+	"iw": textObjectWord(false),
+	"aw": textObjectWord(true),
+	"is": textObjectSentence(false),
+	"as": textObjectSentence(true),
+	"ip": textObjectParagraph(false),
+	"ap": textObjectParagraph(true),
+	"it": textObjectTag(false),
+	"at": textObjectTag(true),
+}
+
+// Every key that selects a bracket pair, "b" and "B" are the Vim shorthands for () and {}
+var bracketObjects = map[string][2]byte{
+	"(": {'(', ')'}, ")": {'(', ')'}, "b": {'(', ')'},
+	"[": {'[', ']'}, "]": {'[', ']'},
+	"{": {'{', '}'}, "}": {'{', '}'}, "B": {'{', '}'},
+	"<": {'<', '>'}, ">": {'<', '>'},
+}
+
+var quoteObjects = []byte{'"', '\'', '`'}
+
+func (bm *BufferManager) registerTextObjects() {
+	for keys, object := range defaultTextObjects {
+		bm.tg.Key.RegisterTextObject(keys, object)
+	}
+	for keys, pair := range bracketObjects {
+		bm.tg.Key.RegisterTextObject("i"+keys, textObjectBracket(pair[0], pair[1], false))
+		bm.tg.Key.RegisterTextObject("a"+keys, textObjectBracket(pair[0], pair[1], true))
+	}
+	for _, quote := range quoteObjects {
+		bm.tg.Key.RegisterTextObject("i"+string(quote), textObjectQuote(quote, false))
+		bm.tg.Key.RegisterTextObject("a"+string(quote), textObjectQuote(quote, true))
+	}
+}
+
+// RegisterTextObject binds keys to a text object, usable after any operator and to select in visual mode
+func (km *KeyManager) RegisterTextObject(keys string, object TextObjectFunc) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.textObjects[keys] = object
+}
+
+// selectTextObject makes the visual selection cover a text object
+func (km *KeyManager) selectTextObject(object TextObjectFunc, count int) {
+	buffer := km.tg.Buffer.Active()
+	if buffer == nil {
+		return
+	}
+	start, end, _, ok := object(buffer, buffer.Point(), max(count, 1))
+	if !ok || end <= start {
+		return
+	}
+	buffer.SetAnchor(start)
+	line, col := buffer.OffsetToPosition(end)
+	if col == 0 && line > 0 {
+		buffer.MoveCursor(end - 1)
+	} else {
+		buffer.MoveCursor(buffer.LineStart(line) + prevGrapheme(buffer.Line(line), col))
+	}
+}
+
+// classAt returns the character class at a byte column of a line
+func classAt(line string, col int) int {
+	return charClass(firstRune(line[col:]))
+}
+
+// runStart returns where the run of characters of one class containing col begins
+func runStart(line string, col int) int {
+	class := classAt(line, col)
+	for col > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:col])
+		if charClass(r) != class {
+			break
+		}
+		col -= size
+	}
+	return col
+}
+
+// runEnd returns where the run of characters of one class containing col ends
+func runEnd(line string, col int) int {
+	class := classAt(line, col)
+	for col < len(line) {
+		r, size := utf8.DecodeRuneInString(line[col:])
+		if charClass(r) != class {
+			break
+		}
+		col += size
+	}
+	return col
+}
+
+// textObjectWord selects the word or the run of white space under the cursor. With around, the white
+// space after the word is included, or before it when the word ends the line.
+func textObjectWord(around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		line, col := b.OffsetToPosition(offset)
+		text := b.Line(line)
+		if text == "" {
+			return 0, 0, false, false
+		}
+		col = min(col, prevGrapheme(text, len(text)))
+
+		start, end := runStart(text, col), runEnd(text, col)
+		onSpace := classAt(text, col) == classSpace
+		for i := 1; i < count && end < len(text); i++ {
+			// Around a word, a count counts words with their white space rather than runs
+			if around && !onSpace && classAt(text, end) == classSpace {
+				end = runEnd(text, end)
+			}
+			if end < len(text) {
+				end = runEnd(text, end)
+			}
+		}
+
+		if around {
+			switch {
+			case onSpace && end < len(text):
+				end = runEnd(text, end)
+			case !onSpace && end < len(text) && classAt(text, end) == classSpace:
+				end = runEnd(text, end)
+			case !onSpace && start > 0:
+				if before := runStart(text, prevGrapheme(text, start)); classAt(text, before) == classSpace {
+					start = before
+				}
+			}
+		}
+
+		lineStart := b.LineStart(line)
+		return lineStart + start, lineStart + end, false, true
+	}
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// paragraphBounds returns the first and last line of the run of blank or non-blank lines containing line
+func paragraphBounds(b *Buffer, line int) (int, int) {
+	blank := isBlank(b.Line(line))
+	first, last := line, line
+	for first > 0 && isBlank(b.Line(first-1)) == blank {
+		first--
+	}
+	for last < b.LineCount()-1 && isBlank(b.Line(last+1)) == blank {
+		last++
+	}
+	return first, last
+}
+
+// textObjectParagraph selects whole lines of the paragraph, or the blank lines, under the cursor.
+// With around, the blank lines after the paragraph are included, or before it when it ends the buffer.
+func textObjectParagraph(around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		line, _ := b.OffsetToPosition(offset)
+		first, last := paragraphBounds(b, line)
+		onBlank := isBlank(b.Line(line))
+
+		runs := count
+		if around {
+			runs = count * 2
+		}
+		for i := 1; i < runs && last < b.LineCount()-1; i++ {
+			_, last = paragraphBounds(b, last+1)
+		}
+
+		// Nothing follows the paragraph, take the blank lines in front of it instead
+		if around && !onBlank && !isBlank(b.Line(last)) && first > 0 {
+			first, _ = paragraphBounds(b, first-1)
+		}
+
+		return b.LineStart(first), b.LineStart(last + 1), true, true
+	}
+}
+
+// sentence is one sentence of a paragraph: where it starts, where its text ends and where the
+// white space after it ends
+type sentence struct {
+	start, end, next int
+}
+
+// splitSentences cuts text into sentences ending in '.', '!' or '?', optionally followed by closing
+// brackets or quotes, and then white space
+func splitSentences(text string, from, to int) []sentence {
+	var sentences []sentence
+	pos := from
+	for pos < to {
+		start := pos
+		end := to
+		for i := pos; i < to; i++ {
+			if strings.IndexByte(".!?", text[i]) < 0 {
+				continue
+			}
+			j := i + 1
+			for j < to && strings.IndexByte(")]\"'", text[j]) >= 0 {
+				j++
+			}
+			if j == to || strings.IndexByte(" \t\n", text[j]) >= 0 {
+				end = j
+				break
+			}
+		}
+		next := end
+		for next < to && strings.IndexByte(" \t\n", text[next]) >= 0 {
+			next++
+		}
+		sentences = append(sentences, sentence{start, end, next})
+		pos = next
+	}
+	return sentences
+}
+
+// textObjectSentence selects the sentence under the cursor within its paragraph. With around, the white
+// space after it is included, or before it when it ends the paragraph.
+func textObjectSentence(around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		line, _ := b.OffsetToPosition(offset)
+		if isBlank(b.Line(line)) {
+			return 0, 0, false, false
+		}
+		first, last := paragraphBounds(b, line)
+		text := b.String()
+		from := b.LineStart(first)
+		from += len(text[from:]) - len(strings.TrimLeft(text[from:], " \t"))
+		sentences := splitSentences(text, from, b.LineEnd(last))
+		if len(sentences) == 0 {
+			return 0, 0, false, false
+		}
+
+		current := 0
+		for current < len(sentences)-1 && sentences[current].next <= offset {
+			current++
+		}
+		lastSentence := min(current+count-1, len(sentences)-1)
+
+		start, end := sentences[current].start, sentences[lastSentence].end
+		if around {
+			if next := sentences[lastSentence].next; next > end {
+				end = next
+			} else if current > 0 {
+				start = sentences[current-1].end
+			}
+		}
+		return start, end, false, true
+	}
+}
+
+// findOpen returns the count-th unmatched open bracket at or before pos, a close bracket at pos
+// counts as inside its pair
+func findOpen(text string, pos int, open, close byte, count int) int {
+	depth := 0
+	for i := min(pos, len(text)-1); i >= 0; i-- {
+		switch text[i] {
+		case close:
+			if i != pos {
+				depth++
+			}
+		case open:
+			if depth > 0 {
+				depth--
+				continue
+			}
+			count--
+			if count == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findClose returns the close bracket matching the open one at pos
+func findClose(text string, pos int, open, close byte) int {
+	depth := 0
+	for i := pos; i < len(text); i++ {
+		switch text[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// textObjectBracket selects the text inside the count-th bracket pair around the cursor, or the pair
+// itself with around. A pair spanning lines keeps the lines holding the brackets when inner.
+func textObjectBracket(open, close byte, around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		text := b.String()
+		start := findOpen(text, offset, open, close, count)
+		if start < 0 {
+			return 0, 0, false, false
+		}
+		end := findClose(text, start, open, close)
+		if end < 0 {
+			return 0, 0, false, false
+		}
+		if around {
+			return start, end + 1, false, true
+		}
+
+		start++
+		if start < end && text[start] == '\n' {
+			start++
+			if lineStart := strings.LastIndexByte(text[:end], '\n') + 1; lineStart >= start && isBlank(text[lineStart:end]) {
+				end = lineStart
+			}
+		}
+		return start, max(start, end), false, true
+	}
+}
+
+// textObjectQuote selects the text between a pair of quotes on the cursor line. Quotes pair up from the
+// start of the line, when the cursor is not inside a pair the next pair on the line is used. With
+// around, the quotes and the white space after them, or before them if there is none, are included.
+func textObjectQuote(quote byte, around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		line, col := b.OffsetToPosition(offset)
+		text := b.Line(line)
+
+		var quotes []int
+		for i := 0; i < len(text); i++ {
+			if text[i] == '\\' {
+				i++
+				continue
+			}
+			if text[i] == quote {
+				quotes = append(quotes, i)
+			}
+		}
+
+		before := 0
+		for before < len(quotes) && quotes[before] < col {
+			before++
+		}
+		first := before
+		if before%2 == 1 {
+			first = before - 1
+		}
+		if first+1 >= len(quotes) {
+			return 0, 0, false, false
+		}
+
+		start, end := quotes[first], quotes[first+1]+1
+		if !around {
+			start, end = start+1, end-1
+		} else if trailing := len(text[end:]) - len(strings.TrimLeft(text[end:], " \t")); trailing > 0 {
+			end += trailing
+		} else {
+			start = len(strings.TrimRight(text[:start], " \t"))
+		}
+
+		lineStart := b.LineStart(line)
+		return lineStart + start, lineStart + end, false, true
+	}
+}
+
+type tagPair struct {
+	openStart, openEnd, closeStart, closeEnd int
+}
+
+var tagPattern = regexp.MustCompile(`<(/?)([A-Za-z][^\s/>]*)[^>]*?(/?)>`)
+
+// tagPairs matches every opening tag of the text with its closing tag, skipping self-closing and
+// unclosed tags
+func tagPairs(text string) []tagPair {
+	type openTag struct {
+		name       string
+		start, end int
+	}
+	var stack []openTag
+	var pairs []tagPair
+
+	for _, match := range tagPattern.FindAllStringSubmatchIndex(text, -1) {
+		closing := match[3] > match[2]
+		selfClosing := match[7] > match[6]
+		name := text[match[4]:match[5]]
+
+		switch {
+		case selfClosing:
+		case !closing:
+			stack = append(stack, openTag{name, match[0], match[1]})
+		default:
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].name == name {
+					pairs = append(pairs, tagPair{stack[i].start, stack[i].end, match[0], match[1]})
+					stack = stack[:i]
+					break
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// textObjectTag selects the content of the count-th tag pair around the cursor, or the pair with its
+// tags when around
+func textObjectTag(around bool) TextObjectFunc {
+	return func(b *Buffer, offset int, count int) (int, int, bool, bool) {
+		var enclosing []tagPair
+		for _, pair := range tagPairs(b.String()) {
+			if pair.openStart <= offset && offset < pair.closeEnd {
+				enclosing = append(enclosing, pair)
+			}
+		}
+		if count > len(enclosing) {
+			return 0, 0, false, false
+		}
+
+		// Pairs that start later are nested deeper
+		sort.Slice(enclosing, func(i, j int) bool {
+			return enclosing[i].openStart > enclosing[j].openStart
+		})
+
+		pair := enclosing[count-1]
+		if around {
+			return pair.openStart, pair.closeEnd, false, true
+		}
+		return pair.openEnd, pair.closeStart, false, true
+	}
+}
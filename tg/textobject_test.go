@@ -0,0 +1,44 @@
+package TG
+
+import "testing"
+
+func TestTextObjects(t *testing.T) {
+	tests := []struct {
+		text string
+		keys string
+		want string
+	}{
+		{text: "one t|wo three", keys: "diw", want: "one | three"},
+		{text: "one t|wo three", keys: "daw", want: "one |three"},
+		{text: "one two t|hree", keys: "daw", want: "one tw|o"},
+		{text: "one t|wo three four", keys: "d2aw", want: "one |four"},
+		{text: "a.b|c.d", keys: "diw", want: "a.|.d"},
+		{text: "f(a, |b)", keys: "di(", want: "f(|)"},
+		{text: "f(a, |b)", keys: "da)", want: "|f"},
+		{text: "f(a, |b)", keys: "cibX", want: "f(X|)"},
+		{text: "((a|b))", keys: "d2i(", want: "(|)"},
+		{text: "x[1|2]", keys: "di]", want: "x[|]"},
+		{text: "{\n\ta|\n}", keys: "diB", want: "{\n|}"},
+		{text: "<a|b>", keys: "di<", want: "<|>"},
+		{text: "a |b", keys: "di(", want: "a |b"},
+		{text: `say "he|llo" now`, keys: `di"`, want: `say "|" now`},
+		{text: `say "he|llo" now`, keys: `da"`, want: `say |now`},
+		{text: "'a' |x 'b'", keys: "di'", want: "'a' x '|'"},
+		{text: "say `h|i`", keys: "di`", want: "say `|`"},
+		{text: "<a>x|y</a>", keys: "dit", want: "<a>|</a>"},
+		{text: "z<a>x|y</a>", keys: "dat", want: "|z"},
+		{text: "<a><b>x|y</b></a>", keys: "d2it", want: "<a>|</a>"},
+		{text: "One. Tw|o three. Four.", keys: "dis", want: "One. | Four."},
+		{text: "One. Tw|o three. Four.", keys: "das", want: "One. |Four."},
+		{text: "a\n|b\n\nc", keys: "dip", want: "|\nc"},
+		{text: "a\n|b\n\nc", keys: "dap", want: "|c"},
+		{text: "one t|wo three", keys: "viwd", want: "one | three"},
+		{text: "one t|wo three", keys: "yiwP", want: "one tw|otwo three"},
+	}
+
+	for _, test := range tests {
+		if got := typeKeys(t, test.text, test.keys); got != test.want {
+			t.Errorf("%s on %q: got %q, want %q", test.keys, test.text, got, test.want)
+		}
+	}
+}
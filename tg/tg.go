@@ -1,50 +1,143 @@
 package TG
 
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Options holds the startup settings chosen on the command line
+type Options struct {
+	ConfigPath      string            // Config file loaded over the user and project ones, none by default
+	ConfigOverrides map[string]string // Config values given on the command line, they win over every file
+	Project         string            // File or directory the project config is looked for from, see ConfigProject
+	PluginsDir      string            // Directory the plugin .so files are loaded from
+	NoPlugins       bool              // Only load the plugins the UI cannot run without
+	Replay          *Session          // Session the UI replays on a simulated screen instead of reading the terminal
+}
+
 type TG struct {
-	Api    *ApiBridge
-	Event  *EventManager
-	Config *ConfigManager
-	Key    *KeyManager
+	Options Options
+	Api     *ApiBridge
+	Event   *EventManager
+	Config  *ConfigManager
+	Key     *KeyManager
+	Buffer  *BufferManager
+	Undo    *UndoManager
+	Search  *SearchManager
+	Ex      *ExManager
+	Jobs    *JobManager
 }
 
-func NewTG() *TG {
+func NewTG(options Options) *TG {
+
+	if options.PluginsDir == "" {
+		options.PluginsDir = "./plugins"
+	}
 
 	eventManager := NewEventManager()
 	apiBridge := NewApiBridge()
-	configManager := NewConfigManager()
+	configManager := NewConfigManager(options)
 	keyManager := NewKeyManager()
+	bufferManager := NewBufferManager()
+	undoManager := NewUndoManager()
+	searchManager := NewSearchManager()
+	exManager := NewExManager()
+	jobManager := NewJobManager()
 
 	tg := &TG{
-		Event:  eventManager,
-		Api:    apiBridge,
-		Config: configManager,
-		Key:    keyManager,
+		Options: options,
+		Event:   eventManager,
+		Api:     apiBridge,
+		Config:  configManager,
+		Key:     keyManager,
+		Buffer:  bufferManager,
+		Undo:    undoManager,
+		Search:  searchManager,
+		Ex:      exManager,
+		Jobs:    jobManager,
 	}
 
-	for name, action := range defaultCommands {
-		tg.Api.RegisterCommand(name, action)
+	for _, option := range defaultOptions {
+		tg.Config.Declare(option.Key, option.Type, option.Default, option.Description)
+	}
+	for _, event := range defaultEvents {
+		tg.Event.Declare(event)
+	}
+	for _, command := range defaultCommands {
+		tg.Api.Register(command.info, command.fn)
 	}
 
-	configManager.Load()
+	if err := configManager.Load(); err != nil {
+		log.Printf("[ERROR] Loading the config: %v", err)
+	}
+	configManager.Watch(tg)
 	keyManager.Load(tg)
 	apiBridge.Load(tg)
 	eventManager.Load(tg)
+	bufferManager.Load(tg)
+	undoManager.Load(tg)
+	searchManager.Load(tg)
+	exManager.Load(tg)
+	jobManager.Load(tg)
 
 	return tg
 }
 
-// Default configurations
-var defaultConfig = map[string]string{
-	"pluginmanager": "default",
+// Options of the core, the managers declare their own
+var defaultOptions = []ConfigOption{
+	{Key: "pluginmanager", Type: OptionString, Default: "default", Description: `Plugin loading the others, "default" for plugin-manager`},
 }
 
-var defaultKeys = map[string]string{
-	"g":  "",
-	"gx": "quit",
+var defaultKeys = map[string]map[string]string{
+	ModeNormal: {
+		"g":  "",
+		"gx": "quit",
+		"i":  "SET_MODE insert",
+		"v":  "SET_MODE visual",
+	},
+	ModeInsert: {
+		"Esc": "SET_MODE normal",
+	},
+	ModeVisual: {
+		"Esc": "SET_MODE normal",
+		"v":   "SET_MODE normal",
+	},
+	ModeCommand: {},
 }
 
-var defaultCommands = map[string]Event{
-	"quit": func(tg *TG, data any) {
-		tg.Event.Dispatch("ON_Quit", data)
-	},
+var defaultEvents = []EventInfo{
+	{Name: "app.started", Description: "The plugins may be loaded, main dispatches it once the editor is set up", Aliases: []string{"ON_APP_START"}},
+	{Name: "app.quit", Description: "The editor is quitting", Payload: "Whatever was passed to quit", Aliases: []string{"ON_Quit"}},
+}
+
+var defaultCommands = []struct {
+	info CommandInfo
+	fn   any
+}{
+	{CommandInfo{Name: "quit", Description: "Quit the editor, unless a buffer has unsaved changes and it is not forced"}, func(tg *TG, data any) {
+		if _, _, force := tg.Buffer.fileParams(data); !force {
+			for _, buffer := range tg.Buffer.List() {
+				if buffer.Modified() {
+					tg.Api.Call("AddMessage", "ERROR", fmt.Sprintf("%s has unsaved changes (add ! to override)", buffer.Name()))
+					return
+				}
+			}
+		}
+		tg.Event.Dispatch("app.quit", data)
+	}},
+	{CommandInfo{
+		Name:        "CONFIG_SOURCE",
+		Description: "Tell which config layer, and file, the value of a key comes from",
+		Params:      []CommandParam{{Name: "key", Description: "Config key, or ExArgs"}},
+		Returns:     "string",
+	}, func(tg *TG, data any) any {
+		key, _ := data.(string)
+		if args, ok := data.(ExArgs); ok {
+			key = args.Arg
+		}
+		text := configSourceText(tg.Config, strings.TrimSpace(key))
+		tg.Api.Call("AddMessage", "INFO", text)
+		return text
+	}},
 }
@@ -0,0 +1,611 @@
+package TG
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Edit is one recorded buffer change, enough to apply it in either direction
+type Edit struct {
+	Offset   int
+	Deleted  string
+	Inserted string
+}
+
+// undoState is a node of the undo tree: the edits that lead to it from its parent
+type undoState struct {
+	Seq       int
+	Parent    int
+	LastChild int // Child REDO follows, the most recently visited one
+	Edits     []Edit
+	Time      time.Time
+}
+
+// UndoTree keeps every state a buffer went through, branching whenever an edit follows an undo
+type UndoTree struct {
+	States  map[int]*undoState
+	Current int
+	Counter int
+	Writes  []int // State the buffer was in at each write, oldest first
+
+	grouping int        // Depth of open groups, edits join one state while above zero
+	group    *undoState // State collecting the edits of the open group
+	applying bool       // Set while undo or redo edits the buffer so they are not recorded
+}
+
+// undoFile is what gets persisted next to the user's state so undo survives restarts
+type undoFile struct {
+	Hash    string
+	Current int
+	Counter int
+	Writes  []int
+	States  []*undoState
+}
+
+type UndoManager struct {
+	trees        map[*Buffer]*UndoTree
+	insertBuffer *Buffer // Buffer the group of the insert session was opened on, nil outside insert mode
+	lock         sync.Mutex
+	tg           *TG
+}
+
+func NewUndoManager() *UndoManager {
+	return &UndoManager{
+		trees: make(map[*Buffer]*UndoTree),
+	}
+}
+
+func newUndoTree() *UndoTree {
+	return &UndoTree{
+		States: map[int]*undoState{0: {Seq: 0, Time: time.Now()}},
+	}
+}
+
+func (um *UndoManager) Load(tg *TG) {
+	um.tg = tg
+
+	tg.Config.Declare("undofile", OptionBool, false, "Keep the undo history of files so it survives restarts")
+	tg.Config.Declare("undodir", OptionString, "", "Directory of the undo files, tg-edit/undo in $XDG_STATE_HOME when empty")
+
+	tg.Event.Subscribe("buffer.changed", func(tg *TG, data any) {
+		if change, ok := data.(BufferChange); ok {
+			um.record(change)
+		}
+	})
+
+	tg.Event.Subscribe("buffer.closed", func(tg *TG, data any) {
+		if buffer, ok := data.(*Buffer); ok {
+			um.lock.Lock()
+			delete(um.trees, buffer)
+			if um.insertBuffer == buffer {
+				um.insertBuffer = nil
+			}
+			um.lock.Unlock()
+		}
+	})
+
+	// Everything typed in one insert session is undone at once. The group is ended on the buffer it
+	// was opened on, the active buffer may have changed meanwhile.
+	tg.Event.Subscribe("mode.changed", func(tg *TG, data any) {
+		change, _ := data.(ModeChange)
+		if change.Old == ModeInsert {
+			um.endInsert()
+		}
+		if change.New == ModeInsert {
+			if buffer := tg.Buffer.Active(); buffer != nil {
+				um.BeginGroup(buffer)
+				um.lock.Lock()
+				um.insertBuffer = buffer
+				um.lock.Unlock()
+			}
+		}
+	})
+
+	tg.Event.Subscribe("buffer.loaded", func(tg *TG, data any) {
+		if buffer, ok := data.(*Buffer); ok && um.persistent() {
+			um.restore(buffer)
+		}
+	})
+
+	tg.Event.Subscribe("buffer.written", func(tg *TG, data any) {
+		buffer, ok := data.(*Buffer)
+		if !ok {
+			return
+		}
+		um.recordWrite(buffer)
+		if um.persistent() {
+			if err := um.persist(buffer); err != nil {
+				log.Printf("[ERROR] Failed to save undo history for %s: %v", buffer.Path(), err)
+			}
+		}
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "UNDO",
+		Description: "Undo the last change of the active buffer, count times",
+		Params:      []CommandParam{{Name: "count", Optional: true}},
+	}, func(tg *TG, data any) any {
+		um.withActive(func(buffer *Buffer) {
+			for i := 0; i < countArg(data); i++ {
+				if !um.Undo(buffer) {
+					tg.Api.Call("AddMessage", "INFO", "Already at oldest change")
+					break
+				}
+			}
+		})
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "REDO",
+		Description: "Redo the last undone change of the active buffer, count times",
+		Params:      []CommandParam{{Name: "count", Optional: true}},
+	}, func(tg *TG, data any) any {
+		um.withActive(func(buffer *Buffer) {
+			for i := 0; i < countArg(data); i++ {
+				if !um.Redo(buffer) {
+					tg.Api.Call("AddMessage", "INFO", "Already at newest change")
+					break
+				}
+			}
+		})
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "EARLIER",
+		Description: "Go back in the undo history by a count of changes, a time such as 10s, 5m or 1d, or file writes such as 1f",
+		Params:      []CommandParam{{Name: "amount", Description: "Changes, a time with s, m, h or d, or writes with f", Optional: true}},
+	}, func(tg *TG, data any) any {
+		um.withActive(func(buffer *Buffer) {
+			if err := um.TimeTravel(buffer, data, -1); err != nil {
+				tg.Api.Call("AddMessage", "ERROR", err.Error())
+			}
+		})
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{
+		Name:        "LATER",
+		Description: "Go forward in the undo history by a count of changes, a time such as 10s, 5m or 1d, or file writes such as 1f",
+		Params:      []CommandParam{{Name: "amount", Description: "Changes, a time with s, m, h or d, or writes with f", Optional: true}},
+	}, func(tg *TG, data any) any {
+		um.withActive(func(buffer *Buffer) {
+			if err := um.TimeTravel(buffer, data, 1); err != nil {
+				tg.Api.Call("AddMessage", "ERROR", err.Error())
+			}
+		})
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "UNDO_BEGIN", Description: "Start grouping the following changes of the active buffer into one undo step"}, func(tg *TG, data any) any {
+		um.withActive(um.BeginGroup)
+		return nil
+	})
+
+	tg.Api.Register(CommandInfo{Name: "UNDO_END", Description: "Finish the undo step started by UNDO_BEGIN"}, func(tg *TG, data any) any {
+		um.withActive(um.EndGroup)
+		return nil
+	})
+
+	tg.Key.RegisterKey("u", "UNDO")
+	tg.Key.RegisterKey("Ctrl+R", "REDO")
+}
+
+func (um *UndoManager) withActive(fn func(buffer *Buffer)) {
+	if buffer := um.tg.Buffer.Active(); buffer != nil {
+		fn(buffer)
+	}
+}
+
+// tree returns the undo tree of a buffer, caller must hold the lock
+func (um *UndoManager) tree(buffer *Buffer) *UndoTree {
+	tree, exists := um.trees[buffer]
+	if !exists {
+		tree = newUndoTree()
+		um.trees[buffer] = tree
+	}
+	return tree
+}
+
+// BeginGroup makes the following edits of a buffer a single undoable unit until EndGroup.
+// Groups nest, only the outermost EndGroup closes the unit.
+func (um *UndoManager) BeginGroup(buffer *Buffer) {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	um.tree(buffer).grouping++
+}
+
+func (um *UndoManager) EndGroup(buffer *Buffer) {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	tree := um.tree(buffer)
+	if tree.grouping == 0 {
+		return
+	}
+	tree.grouping--
+	if tree.grouping == 0 {
+		tree.group = nil
+	}
+}
+
+// endInsert ends the group of the insert session, if its buffer is still open
+func (um *UndoManager) endInsert() {
+	um.lock.Lock()
+	buffer := um.insertBuffer
+	um.insertBuffer = nil
+	um.lock.Unlock()
+	if buffer != nil {
+		um.EndGroup(buffer)
+	}
+}
+
+// Group runs fn with every edit it makes to the buffer recorded as one undo step
+func (um *UndoManager) Group(buffer *Buffer, fn func()) {
+	um.BeginGroup(buffer)
+	defer um.EndGroup(buffer)
+	fn()
+}
+
+func (um *UndoManager) record(change BufferChange) {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+
+	tree := um.tree(change.Buffer)
+	if tree.applying {
+		return
+	}
+
+	edit := Edit{Offset: change.Offset, Deleted: change.Deleted, Inserted: change.Inserted}
+	if tree.group != nil {
+		tree.group.Edits = append(tree.group.Edits, edit)
+		tree.group.Time = time.Now()
+		return
+	}
+
+	tree.Counter++
+	state := &undoState{
+		Seq:    tree.Counter,
+		Parent: tree.Current,
+		Edits:  []Edit{edit},
+		Time:   time.Now(),
+	}
+	tree.States[state.Seq] = state
+	tree.States[tree.Current].LastChild = state.Seq
+	tree.Current = state.Seq
+
+	if tree.grouping > 0 {
+		tree.group = state
+	}
+}
+
+// recordWrite remembers the state a buffer was written in, for :earlier and :later with f
+func (um *UndoManager) recordWrite(buffer *Buffer) {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	tree := um.tree(buffer)
+	if len(tree.Writes) == 0 || tree.Writes[len(tree.Writes)-1] != tree.Current {
+		tree.Writes = append(tree.Writes, tree.Current)
+	}
+}
+
+// Undo reverts the current state, returning false when there is nothing left to undo
+func (um *UndoManager) Undo(buffer *Buffer) bool {
+	um.lock.Lock()
+	tree := um.tree(buffer)
+	state := tree.States[tree.Current]
+	tree.group = nil
+	um.lock.Unlock()
+
+	if state.Seq == 0 {
+		return false
+	}
+
+	um.apply(buffer, tree, state, true)
+
+	um.lock.Lock()
+	tree.States[state.Parent].LastChild = state.Seq
+	tree.Current = state.Parent
+	um.lock.Unlock()
+	return true
+}
+
+// Redo re-applies the most recently undone child of the current state
+func (um *UndoManager) Redo(buffer *Buffer) bool {
+	um.lock.Lock()
+	tree := um.tree(buffer)
+	state, exists := tree.States[tree.States[tree.Current].LastChild]
+	tree.group = nil
+	um.lock.Unlock()
+
+	if !exists || state.Seq == 0 {
+		return false
+	}
+
+	um.apply(buffer, tree, state, false)
+
+	um.lock.Lock()
+	tree.Current = state.Seq
+	um.lock.Unlock()
+	return true
+}
+
+// apply replays the edits of a state forward, or backward to undo it, and moves the cursor to them
+func (um *UndoManager) apply(buffer *Buffer, tree *UndoTree, state *undoState, reverse bool) {
+	um.lock.Lock()
+	tree.applying = true
+	um.lock.Unlock()
+
+	defer func() {
+		um.lock.Lock()
+		tree.applying = false
+		um.lock.Unlock()
+	}()
+
+	if reverse {
+		for i := len(state.Edits) - 1; i >= 0; i-- {
+			edit := state.Edits[i]
+			if err := buffer.Replace(edit.Offset, len(edit.Inserted), edit.Deleted); err != nil {
+				log.Printf("[ERROR] Undo failed: %v", err)
+				return
+			}
+		}
+		buffer.MoveCursor(state.Edits[0].Offset)
+	} else {
+		for _, edit := range state.Edits {
+			if err := buffer.Replace(edit.Offset, len(edit.Deleted), edit.Inserted); err != nil {
+				log.Printf("[ERROR] Redo failed: %v", err)
+				return
+			}
+		}
+		buffer.MoveCursor(state.Edits[0].Offset)
+	}
+
+	if um.tg.Key.Mode() != ModeInsert {
+		buffer.clampToLine()
+	}
+}
+
+// TimeTravel moves through states in the order they were created regardless of branches. The
+// amount is a number of steps, a duration such as "30s", "5m", "1h" or "2d", or a number of file
+// writes such as "1f". Going back 1f from changes made since the last write returns to that write,
+// from before the first write to the state before any change; going forward past the last write
+// ends at the newest state.
+func (um *UndoManager) TimeTravel(buffer *Buffer, amount any, direction int) error {
+	if args, ok := amount.(ExArgs); ok {
+		amount = nil
+		if args.Arg != "" {
+			amount = args.Arg
+		}
+	}
+
+	um.lock.Lock()
+	tree := um.tree(buffer)
+	target := tree.Current
+
+	switch value := amount.(type) {
+	case nil:
+		target += direction
+	case int:
+		target += direction * value
+	case string:
+		if steps, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			target += direction * steps
+			break
+		}
+		value = strings.TrimSpace(value)
+		if writes, found := strings.CutSuffix(value, "f"); found {
+			count, err := strconv.Atoi(writes)
+			if err != nil || count < 0 {
+				um.lock.Unlock()
+				return fmt.Errorf("invalid number of file writes %q", value)
+			}
+			target = tree.writeTarget(count, direction)
+			break
+		}
+		duration, err := parseUndoTime(value)
+		if err != nil {
+			um.lock.Unlock()
+			return fmt.Errorf("invalid time %q, use a count, a duration like 5m or 1d, or writes like 1f", value)
+		}
+		when := tree.States[tree.Current].Time.Add(time.Duration(direction) * duration)
+		target = 0
+		for seq, state := range tree.States {
+			if !state.Time.After(when) && seq > target {
+				target = seq
+			}
+		}
+	default:
+		um.lock.Unlock()
+		return fmt.Errorf("invalid time %v", amount)
+	}
+	target = clamp(target, 0, tree.Counter)
+	um.lock.Unlock()
+
+	um.gotoState(buffer, tree, target)
+	return nil
+}
+
+// writeTarget returns the state count file writes before or after the current state, the caller
+// holds the lock
+func (tree *UndoTree) writeTarget(count int, direction int) int {
+	// The last write at or before the current state, in the order the states were created
+	last := -1
+	for i, seq := range tree.Writes {
+		if seq <= tree.Current {
+			last = i
+		}
+	}
+
+	if direction > 0 {
+		if last+count >= len(tree.Writes) {
+			return tree.Counter
+		}
+		return tree.Writes[last+count]
+	}
+	// Changes made since the last write count as one step back to it
+	i := last - count
+	if last >= 0 && tree.Writes[last] != tree.Current {
+		i++
+	}
+	if i < 0 {
+		return 0
+	}
+	return tree.Writes[i]
+}
+
+// parseUndoTime reads a duration as time.ParseDuration does, or a number of days such as "2d"
+func parseUndoTime(text string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(text, "d"); found {
+		count, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(text)
+}
+
+// gotoState undoes up to the common ancestor of the current and target states then redoes down to the target
+func (um *UndoManager) gotoState(buffer *Buffer, tree *UndoTree, target int) {
+	// Chain of states from the target up to the root
+	um.lock.Lock()
+	chain := []int{}
+	position := map[int]int{}
+	for seq := target; ; seq = tree.States[seq].Parent {
+		position[seq] = len(chain)
+		chain = append(chain, seq)
+		if seq == 0 {
+			break
+		}
+	}
+	um.lock.Unlock()
+
+	for {
+		um.lock.Lock()
+		_, onChain := position[tree.Current]
+		um.lock.Unlock()
+		if onChain || !um.Undo(buffer) {
+			break
+		}
+	}
+
+	um.lock.Lock()
+	meeting := position[tree.Current]
+	um.lock.Unlock()
+
+	for i := meeting - 1; i >= 0; i-- {
+		um.lock.Lock()
+		tree.States[tree.Current].LastChild = chain[i]
+		um.lock.Unlock()
+		um.Redo(buffer)
+	}
+}
+
+func (um *UndoManager) persistent() bool {
+	persistent, _ := um.tg.Config.GetBool("undofile")
+	return persistent
+}
+
+// undoPath maps a file to its undo file, "/home/me/a.go" becomes "%home%me%a.go" inside the undo directory
+func (um *UndoManager) undoPath(path string) (string, error) {
+	dir, _ := um.tg.Config.Get("undodir")
+	if dir == "" {
+		stateHome := os.Getenv("XDG_STATE_HOME")
+		if stateHome == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			stateHome = filepath.Join(home, ".local", "state")
+		}
+		dir = filepath.Join(stateHome, "tg-edit", "undo")
+	}
+	return filepath.Join(dir, strings.ReplaceAll(path, string(filepath.Separator), "%")), nil
+}
+
+func (um *UndoManager) persist(buffer *Buffer) error {
+	path, err := um.undoPath(buffer.Path())
+	if err != nil {
+		return err
+	}
+
+	um.lock.Lock()
+	tree := um.tree(buffer)
+	file := undoFile{
+		Hash:    contentHash(buffer.String()),
+		Current: tree.Current,
+		Counter: tree.Counter,
+		Writes:  tree.Writes,
+	}
+	for seq := 0; seq <= tree.Counter; seq++ {
+		if state, exists := tree.States[seq]; exists {
+			file.States = append(file.States, state)
+		}
+	}
+	data, err := json.Marshal(file)
+	um.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return WriteAtomic(path, data, 0600)
+}
+
+// restore loads the saved history of a freshly opened file, ignoring it if the file was changed elsewhere
+func (um *UndoManager) restore(buffer *Buffer) {
+	um.lock.Lock()
+	fresh := um.tree(buffer).Counter == 0
+	um.lock.Unlock()
+	if !fresh {
+		return
+	}
+
+	path, err := um.undoPath(buffer.Path())
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var file undoFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("[ERROR] Corrupt undo file %s: %v", path, err)
+		return
+	}
+	if file.Hash != contentHash(buffer.String()) {
+		log.Printf("Undo file %s does not match the file content, ignoring it", path)
+		return
+	}
+
+	tree := &UndoTree{States: make(map[int]*undoState), Current: file.Current, Counter: file.Counter, Writes: file.Writes}
+	for _, state := range file.States {
+		tree.States[state.Seq] = state
+	}
+	if _, exists := tree.States[0]; !exists {
+		return
+	}
+
+	um.lock.Lock()
+	um.trees[buffer] = tree
+	um.lock.Unlock()
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,160 @@
+package TG
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTG makes a TG without plugins and with no config files around
+func newTestTG(t *testing.T) *TG {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_DIRS", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	return NewTG(Options{Project: t.TempDir()})
+}
+
+func TestTimeTravel(t *testing.T) {
+	tests := []struct {
+		from      int
+		amount    any
+		direction int
+		want      string
+		err       bool
+	}{
+		// The states are "", "a", "ab", "abc" and "abcd", written at "a" and "abc", a day apart
+		{from: 4, amount: nil, direction: -1, want: "abc"},
+		{from: 4, amount: 2, direction: -1, want: "ab"},
+		{from: 4, amount: "3", direction: -1, want: "a"},
+		{from: 0, amount: "10", direction: 1, want: "abcd"},
+		{from: 4, amount: "1f", direction: -1, want: "abc"},
+		{from: 4, amount: "2f", direction: -1, want: "a"},
+		{from: 4, amount: "3f", direction: -1, want: ""},
+		{from: 3, amount: "1f", direction: -1, want: "a"},
+		{from: 2, amount: "1f", direction: -1, want: "a"},
+		{from: 1, amount: "1f", direction: -1, want: ""},
+		{from: 0, amount: "1f", direction: 1, want: "a"},
+		{from: 1, amount: "1f", direction: 1, want: "abc"},
+		{from: 2, amount: "1f", direction: 1, want: "abc"},
+		{from: 1, amount: "2f", direction: 1, want: "abcd"},
+		{from: 4, amount: "1d", direction: -1, want: "abc"},
+		{from: 4, amount: "2d", direction: -1, want: "ab"},
+		{from: 4, amount: "36h", direction: -1, want: "ab"},
+		{from: 4, amount: "10d", direction: -1, want: ""},
+		{from: 0, amount: "1d", direction: 1, want: "a"},
+		{from: 0, amount: "90m", direction: 1, want: ""},
+		{from: 0, amount: "25h", direction: 1, want: "a"},
+		{from: 4, amount: ExArgs{Arg: "1f"}, direction: -1, want: "abc"},
+		{from: 4, amount: ExArgs{}, direction: -1, want: "abc"},
+		{from: 4, amount: "1x", direction: -1, err: true},
+		{from: 4, amount: "xf", direction: -1, err: true},
+		{from: 4, amount: "d", direction: -1, err: true},
+		{from: 4, amount: 1.5, direction: -1, err: true},
+	}
+
+	for _, test := range tests {
+		tg := newTestTG(t)
+		buffer := tg.Buffer.Create("test", "")
+		path := filepath.Join(t.TempDir(), "test.txt")
+		for _, text := range []string{"a", "b", "c", "d"} {
+			if err := buffer.Insert(buffer.Len(), text); err != nil {
+				t.Fatal(err)
+			}
+			if text == "a" || text == "c" {
+				if err := tg.Buffer.Write(buffer, path, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		tree := tg.Undo.trees[buffer]
+		start := time.Now().Add(-24 * time.Hour * 10)
+		for seq, state := range tree.States {
+			state.Time = start.Add(time.Duration(seq) * 24 * time.Hour)
+		}
+		tg.Undo.gotoState(buffer, tree, test.from)
+
+		err := tg.Undo.TimeTravel(buffer, test.amount, test.direction)
+		if test.err {
+			if err == nil {
+				t.Errorf("from %d by %v: want an error, got %q", test.from, test.amount, buffer.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("from %d by %v: %v", test.from, test.amount, err)
+		} else if got := buffer.String(); got != test.want {
+			t.Errorf("from %d by %v in direction %d: got %q, want %q", test.from, test.amount, test.direction, got, test.want)
+		}
+	}
+}
+
+// Steps are "+text" to type at the end, "-" to delete the last byte, "u" and "r" to undo and redo,
+// "e<n>" and "l<n>" for :earlier and :later, and "{" and "}" to begin and end a group
+func TestUndoBranches(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		want  string
+		noops int // Undos and redos that had nothing to do
+	}{
+		{name: "undo and redo", steps: []string{"+a", "+b", "+c", "u", "u", "r"}, want: "ab"},
+		{name: "undo past the start", steps: []string{"+a", "u", "u"}, want: "", noops: 1},
+		{name: "redo past the end", steps: []string{"+a", "u", "r", "r"}, want: "a", noops: 1},
+		{name: "edit after undo drops nothing", steps: []string{"+a", "+b", "u", "+c"}, want: "ac"},
+		{name: "redo follows the newest branch", steps: []string{"+a", "+b", "u", "+c", "u", "u", "r", "r"}, want: "ac"},
+		{name: "redo follows the branch undone last", steps: []string{"+a", "+b", "u", "+c", "e1", "u", "u", "r", "r"}, want: "ab"},
+		{name: "earlier reaches an undone branch", steps: []string{"+a", "+b", "u", "+c", "e1"}, want: "ab"},
+		{name: "later reaches the newer branch", steps: []string{"+a", "+b", "u", "+c", "e2", "l2"}, want: "ac"},
+		{name: "deletes undo", steps: []string{"+abc", "-", "-", "u"}, want: "ab"},
+		{name: "deletes on a branch", steps: []string{"+ab", "-", "u", "+c", "e1", "r"}, want: "a", noops: 1},
+		{name: "a group undoes at once", steps: []string{"{", "+a", "+b", "}", "+c", "u", "u"}, want: ""},
+		{name: "nested groups end with the outermost", steps: []string{"{", "+a", "{", "+b", "}", "+c", "}", "+d", "u"}, want: "abc"},
+		{name: "undo ends an open group", steps: []string{"{", "+a", "+b", "u", "+c", "+d", "}", "u"}, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tg := newTestTG(t)
+			buffer := tg.Buffer.Create("test", "")
+			noops := 0
+			for _, step := range test.steps {
+				var err error
+				switch step[0] {
+				case '+':
+					err = buffer.Insert(buffer.Len(), step[1:])
+				case '-':
+					err = buffer.Delete(buffer.Len()-1, 1)
+				case 'u':
+					if !tg.Undo.Undo(buffer) {
+						noops++
+					}
+				case 'r':
+					if !tg.Undo.Redo(buffer) {
+						noops++
+					}
+				case 'e':
+					err = tg.Undo.TimeTravel(buffer, step[1:], -1)
+				case 'l':
+					err = tg.Undo.TimeTravel(buffer, step[1:], 1)
+				case '{':
+					tg.Undo.BeginGroup(buffer)
+				case '}':
+					tg.Undo.EndGroup(buffer)
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", step, err)
+				}
+			}
+			if got := buffer.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if noops != test.noops {
+				t.Errorf("%d undos and redos did nothing, want %d", noops, test.noops)
+			}
+		})
+	}
+}